@@ -0,0 +1,46 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package client
+
+import "context"
+
+// BatchHints are hints about how a batch should be sent which are understood
+// by the DistSender. They allow callers which pace their own traffic, like the
+// requestbatcher, to prevent that pacing from being undone when a batch is
+// split across ranges.
+type BatchHints struct {
+	// MaxConcurrency is the maximum number of parts of a batch which spans
+	// multiple ranges which may be sent in parallel. A MaxConcurrency of 1
+	// causes the parts to be sent sequentially. If MaxConcurrency <= 0 then
+	// the DistSender's own limit applies.
+	MaxConcurrency int
+}
+
+// contextBatchHintsKey is an empty type for the handle associated with the
+// BatchHints value (see context.Value).
+type contextBatchHintsKey struct{}
+
+// ContextWithBatchHints returns a context which carries hints for the batches
+// sent with it.
+func ContextWithBatchHints(ctx context.Context, hints BatchHints) context.Context {
+	return context.WithValue(ctx, contextBatchHintsKey{}, hints)
+}
+
+// BatchHintsFromContext returns the hints carried by ctx, or the zero value if
+// there are none.
+func BatchHintsFromContext(ctx context.Context) BatchHints {
+	hints, _ := ctx.Value(contextBatchHintsKey{}).(BatchHints)
+	return hints
+}
@@ -896,6 +896,11 @@ func (ds *DistSender) divideAndSendBatchToRanges(
 	// accumulated so far.
 	var numResults int64
 	canParallelize := (ba.Header.MaxSpanRequestKeys == 0) && !stopAtRangeBoundary
+	// The number of partial batches sent asynchronously is limited by the
+	// batch's hints, if any. The final partial batch is always sent
+	// synchronously so at most MaxConcurrency-1 may be sent asynchronously.
+	hints := client.BatchHintsFromContext(ctx)
+	var numAsync int
 
 	for ; ri.Valid(); ri.Seek(ctx, seekKey, scanDir) {
 		responseCh := make(chan response, 1)
@@ -956,8 +961,10 @@ func (ds *DistSender) divideAndSendBatchToRanges(
 		// If we can reserve one of the limited goroutines available for parallel
 		// batch RPCs, send asynchronously.
 		if canParallelize && !lastRange && ds.rpcContext != nil &&
+			(hints.MaxConcurrency <= 0 || numAsync < hints.MaxConcurrency-1) &&
 			ds.sendPartialBatchAsync(ctx, ba, rs, ri.Desc(), ri.Token(), batchIdx, responseCh) {
 			// Sent the batch asynchronously.
+			numAsync++
 		} else {
 			resp := ds.sendPartialBatch(ctx, ba, rs, ri.Desc(), ri.Token(), batchIdx, true /* needsTruncate */)
 			responseCh <- resp
@@ -1565,6 +1565,99 @@ func TestMultiRangeGapReverse(t *testing.T) {
 	}
 }
 
+// TestBatchHintsMaxConcurrency verifies that the partial batches of a batch
+// which spans multiple ranges are sent with no more concurrency than permitted
+// by the BatchHints of the context in which it is sent.
+func TestBatchHintsMaxConcurrency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.TODO())
+
+	g, clock := makeGossip(t, stopper)
+	rpcContext := rpc.NewContext(
+		log.AmbientContext{Tracer: tracing.NewTracer()},
+		&base.Config{Insecure: true},
+		clock,
+		stopper,
+		&cluster.MakeTestingClusterSettings().Version,
+	)
+
+	var descs []roachpb.RangeDescriptor
+	splits := []roachpb.Key{
+		roachpb.Key("a"), roachpb.Key("b"), roachpb.Key("c"), roachpb.Key("d"),
+		roachpb.Key("e"), roachpb.Key("f"),
+	}
+	for i, split := range splits {
+		var startKey roachpb.RKey
+		if i > 0 {
+			startKey = descs[i-1].EndKey
+		}
+		descs = append(descs, roachpb.RangeDescriptor{
+			RangeID:  roachpb.RangeID(i + 1),
+			StartKey: startKey,
+			EndKey:   keys.MustAddr(split),
+			Replicas: []roachpb.ReplicaDescriptor{{NodeID: 1, StoreID: 1}},
+		})
+	}
+
+	// The sender records the largest number of partial batches it has been
+	// sent concurrently. Each waits a little so that those sent asynchronously
+	// overlap.
+	var inFlight, maxInFlight int32
+	sender := client.SenderFunc(
+		func(_ context.Context, args roachpb.BatchRequest) (*roachpb.BatchResponse, *roachpb.Error) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				if max := atomic.LoadInt32(&maxInFlight); n <= max ||
+					atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return args.CreateReply(), nil
+		})
+
+	cfg := DistSenderConfig{
+		AmbientCtx:        log.AmbientContext{Tracer: tracing.NewTracer()},
+		Clock:             clock,
+		RPCContext:        rpcContext,
+		RangeDescriptorDB: mockRangeDescriptorDBForDescs(descs...),
+		TestingKnobs: ClientTestingKnobs{
+			TransportFactory: SenderTransportFactory(
+				tracing.NewTracer(),
+				sender,
+			),
+		},
+	}
+	ds := NewDistSender(cfg, g)
+
+	// The scan spans the five ranges from "a" to "f".
+	txn := roachpb.MakeTransaction("foo", nil, 1.0, clock.Now(), 0)
+	for _, maxConcurrency := range []int{0, 1, 2} {
+		t.Run(fmt.Sprintf("max-concurrency=%d", maxConcurrency), func(t *testing.T) {
+			atomic.StoreInt32(&maxInFlight, 0)
+			ctx := context.Background()
+			if maxConcurrency > 0 {
+				ctx = client.ContextWithBatchHints(ctx, client.BatchHints{MaxConcurrency: maxConcurrency})
+			}
+			var ba roachpb.BatchRequest
+			ba.Txn = &txn
+			ba.Add(roachpb.NewScan(splits[0], splits[5]))
+			if _, pErr := ds.Send(ctx, ba); pErr != nil {
+				t.Fatal(pErr)
+			}
+			max := int(atomic.LoadInt32(&maxInFlight))
+			if maxConcurrency > 0 && max > maxConcurrency {
+				t.Fatalf("expected at most %d partial batches in flight, found %d", maxConcurrency, max)
+			}
+			if maxConcurrency == 0 && max <= 2 {
+				t.Fatalf("expected the partial batches to be sent in parallel, found at most %d in flight", max)
+			}
+		})
+	}
+}
+
 // TestMultiRangeMergeStaleDescriptor simulates the situation in which the
 // DistSender executes a multi-range scan which encounters the stale descriptor
 // of a range which has since incorporated its right neighbor by means of a
@@ -0,0 +1,83 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// adaptiveSizer tunes the effective MaxMsgsPerBatch of a batcher based on the
+// latency with which batches are sent, see Config.TargetBatchLatency. Batches
+// grow gradually while they are sent within the target latency and shrink
+// quickly once they are not.
+type adaptiveSizer struct {
+	target time.Duration
+	min    int64
+	cur    int64 // accessed atomically
+}
+
+func newAdaptiveSizer(cfg *Config) *adaptiveSizer {
+	return &adaptiveSizer{
+		target: cfg.TargetBatchLatency,
+		min:    int64(cfg.MinMsgsPerBatch),
+		cur:    int64(cfg.MaxMsgsPerBatch),
+	}
+}
+
+// limit returns the effective limit on the number of requests in a batch given
+// the configured maximum. It has no effect if max is not positive.
+func (a *adaptiveSizer) limit(max int) int {
+	if max <= 0 {
+		return max
+	}
+	if cur := int(atomic.LoadInt64(&a.cur)); cur < max {
+		return cur
+	}
+	return max
+}
+
+// observe adjusts the effective limit given that a batch of numRequests
+// requests took latency to send.
+func (a *adaptiveSizer) observe(numRequests int, latency time.Duration, max int) {
+	if max <= 0 {
+		return
+	}
+	for {
+		cur := atomic.LoadInt64(&a.cur)
+		// The maximum may have been lowered below the current size.
+		size := cur
+		if size > int64(max) {
+			size = int64(max)
+		}
+		var next int64
+		if latency > a.target {
+			if next = size * 3 / 4; next < a.min {
+				next = a.min
+			}
+		} else if int64(numRequests) >= size {
+			// The batch was limited by the current size, so it may grow.
+			next = size + size/8 + 1
+		} else {
+			return
+		}
+		if next > int64(max) {
+			next = int64(max)
+		}
+		if next == cur || atomic.CompareAndSwapInt64(&a.cur, cur, next) {
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+const (
+	// denseArrivals is the number of requests expected to arrive at a range
+	// within MaxWait at which Config.AdaptiveMaxWait waits the full MaxWait.
+	denseArrivals = 4
+	// minAdaptiveMaxWait is the shortest MaxWait chosen by
+	// Config.AdaptiveMaxWait so that requests which arrive together are still
+	// sent together.
+	minAdaptiveMaxWait = 100 * time.Microsecond
+	// arrivalGapWeight is the weight of the most recent gap between arrivals
+	// in the moving average of a range's gaps.
+	arrivalGapWeight = 0.25
+	// arrivalStateTTL is the amount of time after which the arrival rate of a
+	// range which has received no requests is forgotten.
+	arrivalStateTTL = time.Minute
+	// arrivalSweepInterval is the number of arrivals between sweeps of the
+	// ranges whose arrival rates have expired.
+	arrivalSweepInterval = 1024
+)
+
+// arrivalRate is the moving average of the gaps between the arrivals of
+// requests to a range.
+type arrivalRate struct {
+	last time.Time
+	gap  float64 // nanoseconds
+}
+
+// arrivalRates tracks the arrival rates of the ranges assigned to a shard for
+// use with Config.AdaptiveMaxWait. It is only accessed by the run loop.
+type arrivalRates struct {
+	ranges     map[roachpb.RangeID]*arrivalRate
+	sinceSweep int
+}
+
+// observe records the arrival of a request to rangeID at now and returns the
+// MaxWait for the range's batch given the configured maxWait. Ranges to which
+// several requests are expected to arrive within maxWait wait for it in full
+// while ranges to which requests arrive sparsely, for which waiting is
+// unlikely to yield a larger batch, wait proportionally less.
+func (a *arrivalRates) observe(
+	rangeID roachpb.RangeID, now time.Time, maxWait time.Duration,
+) time.Duration {
+	if a.ranges == nil {
+		a.ranges = map[roachpb.RangeID]*arrivalRate{}
+	}
+	if a.sinceSweep++; a.sinceSweep >= arrivalSweepInterval {
+		a.sweep(now)
+	}
+	r, ok := a.ranges[rangeID]
+	if !ok {
+		// Without a history the range waits the full maxWait.
+		a.ranges[rangeID] = &arrivalRate{last: now}
+		return maxWait
+	}
+	gap := float64(now.Sub(r.last))
+	if r.gap == 0 {
+		r.gap = gap
+	} else {
+		r.gap = arrivalGapWeight*gap + (1-arrivalGapWeight)*r.gap
+	}
+	r.last = now
+	if maxWait <= 0 || r.gap <= 0 {
+		return maxWait
+	}
+	expected := float64(maxWait) / r.gap
+	if expected >= denseArrivals {
+		return maxWait
+	}
+	wait := time.Duration(float64(maxWait) * expected / denseArrivals)
+	if wait < minAdaptiveMaxWait {
+		wait = minAdaptiveMaxWait
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	return wait
+}
+
+// sweep forgets the ranges which have received no requests for
+// arrivalStateTTL.
+func (a *arrivalRates) sweep(now time.Time) {
+	a.sinceSweep = 0
+	for rangeID, r := range a.ranges {
+		if now.Sub(r.last) > arrivalStateTTL {
+			delete(a.ranges, rangeID)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// BackedUpEvent describes a range whose queue has remained backed up, see
+// Config.BackedUpThreshold.
+type BackedUpEvent struct {
+	// RangeID is the range whose queue is backed up.
+	RangeID roachpb.RangeID
+	// QueuedRequests is the number of requests to the range which are queued
+	// or held waiting to be sent.
+	QueuedRequests int
+	// Duration is the amount of time for which the queue has exceeded the
+	// threshold.
+	Duration time.Duration
+}
+
+// backedUpState tracks a range whose queue has exceeded the threshold.
+type backedUpState struct {
+	since    time.Time
+	reported bool
+}
+
+// numQueued returns the number of requests to rangeID which are queued
+// in the shard's batches or held in its ready batches. It must be called on
+// the run loop.
+func (s *shard) numQueued(rangeID roachpb.RangeID) int {
+	var n int
+	s.batches.forRange(rangeID, func(ba *batch) {
+		n += len(ba.reqs)
+	})
+	for _, ba := range s.ready {
+		if ba.rangeID() == rangeID {
+			n += len(ba.reqs)
+		}
+	}
+	return n
+}
+
+// checkBackedUp updates the backed up state of rangeID and reports the range
+// if its queue has exceeded Config.BackedUpThreshold for at least
+// Config.BackedUpDuration. Each period during which a range is backed up is
+// reported at most once. It must be called on the run loop.
+func (s *shard) checkBackedUp(ctx context.Context, rangeID roachpb.RangeID, now time.Time) {
+	cfg := &s.b.cfg
+	if cfg.BackedUpThreshold <= 0 {
+		return
+	}
+	n := s.numQueued(rangeID)
+	st, ok := s.backedUp[rangeID]
+	if n < cfg.BackedUpThreshold {
+		if ok {
+			delete(s.backedUp, rangeID)
+		}
+		return
+	}
+	if !ok {
+		s.backedUp[rangeID] = &backedUpState{since: now}
+		return
+	}
+	if st.reported || now.Sub(st.since) < cfg.BackedUpDuration {
+		return
+	}
+	st.reported = true
+	ev := BackedUpEvent{RangeID: rangeID, QueuedRequests: n, Duration: now.Sub(st.since)}
+	s.b.metrics.BackedUpRanges.Inc(1)
+	log.Warningf(ctx, "%d requests to r%d have been queued for more than %s",
+		ev.QueuedRequests, ev.RangeID, log.Safe(ev.Duration))
+	if cfg.OnBackedUp != nil {
+		cfg.OnBackedUp(ctx, ev)
+	}
+}
+
+// checkAllBackedUp calls checkBackedUp for each range which is currently
+// backed up.
+func (s *shard) checkAllBackedUp(ctx context.Context, now time.Time) {
+	for rangeID := range s.backedUp {
+		s.checkBackedUp(ctx, rangeID, now)
+	}
+}
@@ -0,0 +1,2926 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package requestbatcher is a library to enable easy batching of roachpb
+// requests.
+//
+// Batching in general represents a tradeoff between throughput and latency. The
+// underlying assumption being that batched operations are cheaper than an
+// individual operation. If this is not the case for your workload, don't use
+// this library.
+//
+// Batching assumes that data with the same key can be sent in a single batch.
+// The initial implementation uses rangeID as the key explicitly to avoid
+// creating an overly general solution without motivation but interested readers
+// should recognize that it would be easy to extend this package to accept an
+// arbitrary comparable key.
+//
+// The exported API of this package is intended to be depended upon by other
+// components and by tooling outside of pkg/. Changes to it are made in a
+// backwards compatible manner: new behavior is added through new Config fields
+// or SendOptions whose zero values preserve the existing behavior, and
+// exported identifiers are deprecated for at least one release before they
+// are removed. Unexported identifiers, the names of metrics and the content of
+// log and trace messages are not part of the API.
+package requestbatcher
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/log/logtags"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+// The motivating use case for this package are opportunities to perform cleanup
+// operations in a single raft transaction rather than several. Three main
+// opportunities are known:
+//
+//   1) Intent resolution
+//   2) Txn heartbeating
+//   3) Txn record garbage collection
+//
+// The first two have a relatively tight time bound expectations. In other words
+// it would be surprising and negative for a client if operations were not sent
+// soon after they were queued. The transaction record GC workload can be rather
+// asynchronous. This motivates the need for some knobs to control the maximum
+// acceptable amount of time to buffer operations before sending.
+// Another wrinkle is dealing with the different ways in which sending a batch
+// may fail. A batch may fail in an ambiguous way (RPC/network errors), it may
+// fail completely (which is likely indistinguishable from the ambiguous
+// failure) and lastly it may fail partially. Today's Sender contract is fairly
+// ambiguous about the contract between BatchResponse inner responses and errors
+// returned from a batch request.
+
+// TODO(ajwerner): Do we need to consider ordering dependencies between
+// operations? For the initial motivating use cases for this library there are
+// no data dependencies between operations and the only key will be the guess
+// for where an operation should go.
+
+// TODO(ajwerner): Consider filtering requests which might have been canceled
+// before sending a batch.
+
+// TODO(ajwerner): Consider more dynamic policies with regards to deadlines.
+// Perhaps we want to wait no more than some percentile of the duration of
+// historical operations and stay idle only some other percentile. For example
+// imagine if the max delay was the 50th and the max idle was the 10th? This
+// has a problem when much of the prior workload was say local operations and
+// happened very rapidly. Perhaps we need to provide some bounding envelope?
+
+// TODO(ajwerner): Consider a more general purpose interface for this package.
+// While several interface-oriented interfaces have been explored they all felt
+// heavy and allocation intensive
+
+// TODO(ajwerner): Consider providing an interface which enables a single
+// goroutine to dispatch a number of requests destined for different ranges to
+// the RequestBatcher which may then wait for completion of all of the requests.
+// What is the right contract for error handling? Imagine a situation where a
+// client has dispatched N requests and one has been sent and returns with an
+// error while others are queued. What should happen? Should the client receive
+// the error rapidly? Should the other requests be sent at all? Should they be
+// filtered before sending?
+
+// Config contains the dependencies and configuration for a Batcher.
+type Config struct {
+
+	// Name of the batcher. It is used as the name of the batcher's stopper
+	// tasks, as a log tag on the contexts of its goroutines, to annotate the
+	// errors which originate in the batcher, and in the default MetricPrefix.
+	Name string
+
+	// Sender can round-trip a batch. Sender must not be nil.
+	Sender client.Sender
+
+	// Stopper controls the lifecycle of the Batcher. Stopper must not be nil.
+	Stopper *stop.Stopper
+
+	// MaxSizePerBatch is the maximum number of bytes in individual requests in a
+	// batch. If MaxSizePerBatch <= 0 then no limit is enforced.
+	MaxSizePerBatch int
+
+	// MaxCommandSize, if positive, is the largest total size in bytes of the
+	// requests in a batch containing writes. A write which would cause a
+	// batch to exceed it is added to a new batch instead so that batches are
+	// not rejected by the replica for exceeding the maximum size of a raft
+	// command, which would fail all of their requests. It should be set
+	// somewhat below kv.raft.command.max_size to allow for the overhead of
+	// the command's encoding. A single request larger than MaxCommandSize is
+	// sent on its own.
+	MaxCommandSize int
+
+	// MaxCostPerBatch is the maximum total estimated cost, as computed by
+	// Cost, of the requests in a batch. Because requests vary widely in the
+	// work they impose on the server, bounding batches by cost yields more
+	// uniform server-side execution times than bounding them by count or
+	// size alone. If MaxCostPerBatch <= 0 or Cost is nil then no limit is
+	// enforced.
+	MaxCostPerBatch int64
+
+	// Cost, if non-nil, estimates the server-side cost of evaluating a
+	// request, for example the number of keys it is expected to touch
+	// multiplied by a per-method weight. It is called once for each request
+	// passed to Send.
+	Cost func(roachpb.Request) int64
+
+	// MaxKeysPerBatch is the maximum total number of keys, as estimated by
+	// KeyCount, which the requests in a batch may touch. A request which would
+	// cause a batch to exceed the limit is added to a new batch instead so
+	// that, for example, a ResolveIntentRangeRequest covering thousands of
+	// keys is not batched with many other requests. If MaxKeysPerBatch <= 0
+	// then no limit is enforced.
+	MaxKeysPerBatch int64
+
+	// KeyCount, if non-nil, estimates the number of keys a request touches.
+	// It is called once for each request passed to Send when MaxKeysPerBatch
+	// is positive. If KeyCount is nil then point requests are estimated to
+	// touch a single key and ranged requests, whose extent is unknown, are
+	// estimated to touch MaxKeysPerBatch keys so that they are sent on their
+	// own.
+	KeyCount func(roachpb.Request) int64
+
+	// SpanTooWide, if non-nil, limits the key span covered by a batch. It is
+	// called with the span from the smallest to the largest key which a
+	// batch would cover were a request added to it, and if it returns true
+	// the batch is sent without the request which begins a new batch
+	// instead. This prevents batched ranged operations from acquiring latches
+	// over enormous spans which block unrelated traffic to the range. A
+	// single request is never split.
+	SpanTooWide func(roachpb.Span) bool
+
+	// MaxMsgsPerBatch is the maximum number of messages. Requests count as
+	// one message unless sent with a SendOptions.Weight.
+	// If MaxMsgsPerBatch <= 0 then no limit is enforced.
+	MaxMsgsPerBatch int
+
+	// MaxWait is the maximum amount of time a message should wait in a batch
+	// before being sent. If MaxWait is <= 0 then no wait timeout is enforced.
+	// It is inadvisable to disable both MaxIdle and MaxWait.
+	MaxWait time.Duration
+
+	// MaxIdle is the amount of time a batch should wait between message additions
+	// before being sent. The idle timer allows clients to observe low latencies
+	// when throughput is low. If MaxWait is <= 0 then no wait timeout is
+	// enforced. It is inadvisable to disable both MaxIdle and MaxWait.
+	MaxIdle time.Duration
+
+	// MaxAmbiguousRetries is the maximum number of times a batch which fails
+	// with an AmbiguousResultError will be retried. Only batches composed
+	// entirely of requests sent with SendOptions.Idempotent are eligible for
+	// retry, all other batches return the ambiguous error to every caller. If
+	// MaxAmbiguousRetries <= 0 then ambiguous failures are never retried.
+	MaxAmbiguousRetries int
+
+	// AmbiguousPolicy decides how a batch which fails with an
+	// AmbiguousResultError is handled. It is AmbiguousRetryIdempotent by
+	// default.
+	AmbiguousPolicy AmbiguousPolicy
+
+	// ResolveAmbiguous is called for each request of a batch which fails with
+	// an AmbiguousResultError when AmbiguousPolicy is AmbiguousResolve. It
+	// determines whether the request was applied, in which case the request
+	// succeeds with an empty response. Otherwise the request is queued again,
+	// subject to MaxRetryAttempts and MaxRetryDuration. If it returns an error
+	// the request fails with it. It is called on the goroutine which sent the
+	// batch, which keeps its place in the in-flight limits until it returns.
+	ResolveAmbiguous func(context.Context, roachpb.Request) (applied bool, err error)
+
+	// RetryTransientErrors, if true, causes a batch which fails with a
+	// retryable error, such as a SendError or a RangeNotFoundError, to be sent
+	// again with backoff rather than failing each of its requests. The batch
+	// keeps its place in the in-flight limits while it waits.
+	RetryTransientErrors bool
+
+	// RetryOptions configures the backoff between the attempts to send a
+	// batch when RetryTransientErrors is set. Zero values are replaced with
+	// the defaults of the retry package. The Closer is ignored; retries stop
+	// when the batcher stops or once the contexts of all of the batch's
+	// requests are done. If MaxRetries is 0 then a default of 10 is used.
+	RetryOptions retry.Options
+
+	// IsRetryableError, if non-nil, decides which errors are retried when
+	// RetryTransientErrors is set in place of the default.
+	IsRetryableError func(*roachpb.Error) bool
+
+	// RedispatchBackoff configures the backoff before the requests of a batch
+	// are queued again after it fails with an AmbiguousResultError, a
+	// NotLeaseHolderError or a WriteIntentError whose intents were handed off
+	// to OnWriteIntentError. The backoff grows with the number of times the
+	// requests have been retried. Zero values are replaced with an initial
+	// backoff of 10ms, a maximum of 1s, a multiplier of 2 and a randomization
+	// factor of 0.15; background clients should choose longer backoffs so as
+	// to yield to foreground traffic. MaxRetries and the Closer are ignored.
+	RedispatchBackoff retry.Options
+
+	// MaxRangeMismatchRetries is the maximum number of times a request is
+	// queued again after its batch fails with a RangeKeyMismatchError, as
+	// happens when its range splits while the request is queued. Each request
+	// is queued to the range which the descriptors returned with the error
+	// indicate contains it, so the batch is split across the new ranges.
+	// Requests which neither descriptor contains fail with the error. If
+	// MaxRangeMismatchRetries <= 0 then the error is returned to the callers.
+	MaxRangeMismatchRetries int
+
+	// MaxNotLeaseHolderRetries is the maximum number of times a request is
+	// queued again after its batch fails with a NotLeaseHolderError, as
+	// happens during a lease transfer. The requests are queued after a
+	// backoff according to RedispatchBackoff, by which time the lease hint
+	// carried by the error has been passed to UpdateLeaseHolder. If
+	// MaxNotLeaseHolderRetries <= 0 then the error is returned to the callers.
+	MaxNotLeaseHolderRetries int
+
+	// OnWriteIntentError, if non-nil, is passed the intents encountered by a
+	// batch which fails with a WriteIntentError, to be resolved or added to a
+	// queue of intents to resolve. It is called on the goroutine which sent
+	// the batch, which keeps its place in the in-flight limits until it
+	// returns. If it returns true, indicating that the intents were resolved,
+	// the batch's requests are queued again, subject to MaxRetryAttempts and
+	// MaxRetryDuration. Otherwise the error is returned to the callers.
+	OnWriteIntentError func(context.Context, []roachpb.Intent) (resolved bool)
+
+	// AttributeErrors, if true, causes only the request identified by the
+	// index of a failed batch's error to fail with the error. The batch's other
+	// requests are queued again, as they were not applied. It assumes that a
+	// batch is evaluated atomically, which does not hold if the Sender splits
+	// a batch across ranges, so it should only be used if the requests are
+	// idempotent or the batches' ranges are known not to split.
+	AttributeErrors bool
+
+	// ErrorPropagation chooses whether the error of a failed batch fails all of
+	// its requests, as suits latency-sensitive clients, or only those which
+	// caused it, at the cost of sending the others again. It is
+	// ErrorPropagationFailFast by default.
+	ErrorPropagation ErrorPropagation
+
+	// MaxRetryAttempts and MaxRetryDuration bound the work spent retrying a
+	// request, whether its batch is retried after a transient error or it is
+	// queued again after an ambiguous failure, a range key mismatch or another
+	// request's error. A request which has been retried MaxRetryAttempts times,
+	// or was first queued MaxRetryDuration ago, fails with an error whose
+	// cause is ErrRetryBudgetExceeded rather than being retried again. Limits
+	// which are <= 0 are not enforced.
+	MaxRetryAttempts int
+	MaxRetryDuration time.Duration
+
+	// ClassifyError, if non-nil, decides how a batch which fails with an
+	// error is handled, taking precedence over RetryTransientErrors,
+	// MaxAmbiguousRetries, MaxRangeMismatchRetries and AttributeErrors unless
+	// it returns DispositionDefault. It allows a client with knowledge of its
+	// requests to retry or fail them as appropriate.
+	ClassifyError func(*roachpb.Error) ErrorDisposition
+
+	// MaxConsecutiveFailures, if positive, detects requests which fail every
+	// batch they are part of, such as a request which always trips an
+	// assertion on the server and fails its peers along with it. A request
+	// which is queued again after MaxConsecutiveFailures consecutive failed
+	// batches fails with an error whose cause is ErrTooManyFailures, unless
+	// IsolateFailingRequests is set.
+	MaxConsecutiveFailures int
+
+	// IsolateFailingRequests, if true, causes a request which reaches
+	// MaxConsecutiveFailures to be sent in batches of its own, as though sent
+	// with SendOptions.Exclusive, so that it no longer fails its peers. It
+	// fails with an error whose cause is ErrTooManyFailures once it reaches
+	// MaxConsecutiveFailures again.
+	IsolateFailingRequests bool
+
+	// QuarantineDuration is the amount of time for which requests to a range
+	// are rejected after a batch sent to it fails with an error classified as
+	// DispositionQuarantine. If QuarantineDuration <= 0 then a default of 10
+	// seconds is used.
+	QuarantineDuration time.Duration
+
+	// MaxSpanRequestKeys, if positive, is set as the MaxSpanRequestKeys of the
+	// header of each batch, limiting the number of keys processed by the
+	// ranged requests in the batch. Ranged requests which are not completed
+	// within the limit are returned with a ResumeSpan.
+	MaxSpanRequestKeys int64
+
+	// MaxResumesPerRequest is the maximum number of times the remainder of a
+	// ranged request whose response carries a ResumeSpan is queued to be sent
+	// in a later batch. The caller receives a single response, combining the
+	// responses to each portion, once the full span has been processed or the
+	// limit has been reached, in which case the response carries the
+	// remaining ResumeSpan. If MaxResumesPerRequest <= 0 then responses with
+	// a ResumeSpan are returned to the caller as is.
+	MaxResumesPerRequest int
+
+	// MaxPendingRequests is the maximum number of requests which may be queued
+	// waiting to be sent. Send returns an error rather than queue a request
+	// beyond this limit. If MaxPendingRequests <= 0 then no limit is enforced.
+	MaxPendingRequests int
+
+	// MaxPendingBytes is the maximum total size of the requests which may be
+	// queued waiting to be sent. Send returns an error rather than queue a
+	// request beyond this limit. If MaxPendingBytes <= 0 then no limit is
+	// enforced.
+	MaxPendingBytes int
+
+	// NumShards is the number of run loops across which ranges are partitioned.
+	// Each shard assembles and times out batches for its ranges independently
+	// so that very high request rates are not bottlenecked on a single
+	// goroutine. If NumShards <= 0 then a single run loop is used.
+	NumShards int
+
+	// MaxSendWorkers is the maximum number of goroutines used to send batches.
+	// Workers are added as dispatched batches back up and removed after
+	// SendWorkerIdleTimeout without work, down to MinSendWorkers. Batches
+	// dispatched while every worker is busy wait in a backlog of at most 4
+	// batches per worker. Once the backlog is full no further batches are
+	// dispatched until a worker makes room, which is also the case once
+	// MaxInFlightBatches is reached. If MaxSendWorkers <= 0 then each batch is
+	// sent on its own goroutine.
+	MaxSendWorkers int
+
+	// MinSendWorkers is the number of send workers which are kept running
+	// even while idle. It is ignored if MaxSendWorkers <= 0 and is otherwise
+	// at least 1 and at most MaxSendWorkers.
+	MinSendWorkers int
+
+	// SendWorkerIdleTimeout is the amount of time a send worker beyond
+	// MinSendWorkers waits for a batch before exiting. If
+	// SendWorkerIdleTimeout <= 0 then a default of 10s is used.
+	SendWorkerIdleTimeout time.Duration
+
+	// MaxInFlightBatches is the maximum number of batches which may be in the
+	// process of being sent at a time. Batches which become ready to send
+	// beyond this limit are held until an in-flight batch completes, at which
+	// point batches to the ranges with the fewest batches in flight are sent
+	// first. If MaxInFlightBatches <= 0 then no limit is enforced.
+	MaxInFlightBatches int
+
+	// MaxInFlightBatchesPerRange is the maximum number of batches to a single
+	// range which may be in flight at a time. Ready batches to a range at this
+	// limit are held while batches to other ranges continue to be sent which
+	// prevents a slow range from delaying unrelated ranges. Batches of
+	// requests sent with SendOptions.Target or GlobalBatching are not
+	// addressed to a single range and so are not subject to the limit, nor to
+	// RangeOverloaded. If MaxInFlightBatchesPerRange <= 0 then no limit is
+	// enforced.
+	MaxInFlightBatchesPerRange int
+
+	// MaxInFlightRequests is the maximum total number of requests in the
+	// batches which may be in flight at a time. Because batches vary widely in
+	// size this bounds the work imposed on the server far better than
+	// MaxInFlightBatches alone. A batch which exceeds the limit on its own is
+	// sent when no other batches are in flight. If MaxInFlightRequests <= 0
+	// then no limit is enforced.
+	MaxInFlightRequests int
+
+	// MaxInFlightBytes is like MaxInFlightRequests but limits the total size
+	// of the requests in flight. If MaxInFlightBytes <= 0 then no limit is
+	// enforced.
+	MaxInFlightBytes int
+
+	// RangeOverloaded, if non-nil, reports whether the store which will
+	// evaluate batches to a range is overloaded, for example because its IO
+	// overload score is high or its followers have been paused. At most one
+	// batch to an overloaded range is in flight at a time; further batches are
+	// held as though they had reached MaxInFlightBatchesPerRange so that
+	// batched background traffic backs off before admission control must
+	// throttle all traffic to the store. It is called whenever a batch to the
+	// range is ready to be sent and so must be cheap. It is not called with
+	// any of the batcher's locks held and so may use accessors such as
+	// InFlightForRange, but it must not send requests.
+	RangeOverloaded func(roachpb.RangeID) bool
+
+	// OrderConflictingBatches, if true, preserves the order of batches to the
+	// same range whose keys may conflict when more than one batch to a range
+	// may be in flight, see MaxInFlightBatchesPerRange. A batch whose span,
+	// from its smallest to its largest key, overlaps that of a batch to the
+	// same range which is in flight or was held before it is held until that
+	// batch completes, so that requests to the same keys are evaluated in the
+	// order in which their batches were sent.
+	OrderConflictingBatches bool
+
+	// SendHints are attached to the context with which each batch is sent so
+	// that a DistSender does not undo the pacing imposed by the batcher, for
+	// example by sending the parts of a batch which has become split across
+	// ranges in parallel.
+	SendHints client.BatchHints
+
+	// BackedUpThreshold, if positive, is the number of requests to a single
+	// range which may be queued, including those in batches held by the
+	// in-flight limits, before the range's queue is considered backed up. A
+	// range whose queue remains backed up for BackedUpDuration is logged,
+	// counted in Metrics.BackedUpRanges and reported to OnBackedUp so that
+	// operators are alerted to stuck work rather than discovering it through
+	// its side effects.
+	BackedUpThreshold int
+
+	// BackedUpDuration is the amount of time for which a range's queue must
+	// remain backed up before it is reported.
+	BackedUpDuration time.Duration
+
+	// OnBackedUp, if non-nil, is called on the run loop which owns the range
+	// whenever a backed up range is reported, for example to record an event
+	// in the cluster's event log. It must not block or call back into the
+	// RequestBatcher.
+	OnBackedUp func(ctx context.Context, ev BackedUpEvent)
+
+	// PrefetchRangeDescriptor, if non-nil, is called in the background with the
+	// start key of the first request of each newly queued batch. It is intended
+	// to warm the range descriptor cache which will be consulted when the batch
+	// is sent so that the lookup latency is hidden while the batch waits to be
+	// flushed. Errors are ignored.
+	PrefetchRangeDescriptor func(ctx context.Context, key roachpb.RKey) error
+
+	// UpdateRangeInfos, if non-nil, is called with the RangeInfos returned in
+	// the response to each batch so that the routing information learned by
+	// batched requests may be added to the node's range descriptor and lease
+	// holder caches. Batches are sent with Header.ReturnRangeInfo set if it is
+	// non-nil.
+	UpdateRangeInfos func(ctx context.Context, infos []roachpb.RangeInfo)
+
+	// UpdateLeaseHolder, if non-nil, is called with the lease holder indicated
+	// by a NotLeaseHolderError returned for a batch. Its signature matches
+	// that of kv.LeaseHolderCache.Update.
+	UpdateLeaseHolder func(ctx context.Context, rangeID roachpb.RangeID, storeID roachpb.StoreID)
+
+	// Clock, if non-nil, is updated with the timestamp carried by the response
+	// or error of each batch as is done by the DistSender. It should be set
+	// when Sender does not already do this, for example when it is a raw
+	// transport.
+	Clock *hlc.Clock
+
+	// Policy, if non-nil, decides when batches are sent in place of
+	// MaxMsgsPerBatch, MaxWait, MaxIdle, MinMsgsPerBatch and FlushJitter. The
+	// other limits on batches, such as MaxSizePerBatch, and the deadlines of
+	// individual requests continue to apply.
+	Policy BatchPolicy
+
+	// FlushJitter, if positive, shortens the MaxWait and MaxIdle of each batch
+	// by a random duration of up to FlushJitter chosen when the batch is
+	// created. It spreads out the sending of batches to many ranges which
+	// received their first requests at the same time, for example from a GC
+	// pass fanning out, rather than sending them all at once.
+	FlushJitter time.Duration
+
+	// FlushTimerResolution, if positive, schedules the deadlines of pending
+	// batches on a timing wheel with buckets of FlushTimerResolution rather
+	// than in a heap ordered by deadline. Registering, moving and canceling a
+	// deadline is then O(1) rather than O(log(n)) in the number of pending
+	// batches, which matters to shards with many thousands of pending
+	// batches. The cost is precision: batches are sent up to
+	// FlushTimerResolution after their deadline, and the timer of each shard
+	// ticks every FlushTimerResolution while any of its batches has a deadline.
+	FlushTimerResolution time.Duration
+
+	// AdaptiveMaxWait, if true, shortens the MaxWait of the batches to ranges
+	// to which requests arrive sparsely, for which waiting is unlikely to yield
+	// a larger batch. Ranges to which several requests arrive within MaxWait
+	// wait for it in full. The arrival rate of each range is measured as
+	// requests are queued.
+	AdaptiveMaxWait bool
+
+	// FlushBeforeContextDeadline, if positive, causes a batch to be sent no
+	// later than FlushBeforeContextDeadline before the earliest context
+	// deadline of its requests so that they are not left to time out in the
+	// queue. It should approximate the time needed to send a batch.
+	FlushBeforeContextDeadline time.Duration
+
+	// CompatibilityRules, if non-empty, are consulted before a request is
+	// added to the pending batch to its range. If any rule reports that the
+	// request may not be sent with one of the batch's requests then the batch
+	// is sent without it and the request starts a new batch. NeverBatch and
+	// DontMix construct common rules.
+	CompatibilityRules []CompatibilityRule
+
+	// SeparateReadsAndWrites, if true, batches the read-only requests to a
+	// range separately from its other requests so that batches of reads are
+	// not forced through the write path and remain eligible for optimizations
+	// such as follower reads. The two batches to a range are sent
+	// independently.
+	SeparateReadsAndWrites bool
+
+	// GlobalBatching, if true, batches requests together regardless of the
+	// range to which they are addressed. It is intended for Senders, such as
+	// the DistSender, which split batches which span multiple ranges
+	// themselves, and lets low-rate consumers amortize their requests across
+	// all of their traffic. The rangeID passed to Send is ignored and every
+	// request is treated as addressed to range 0 by the batcher's per-range
+	// facilities, such as ForEachPending and RangeOverrides, other than the
+	// per-range in-flight limits, which do not apply.
+	GlobalBatching bool
+
+	// RangeOverrides, if non-nil, returns the batching parameters for a range
+	// which differ from the batcher's Limits, for example a shorter MaxWait
+	// and a larger MaxMsgsPerBatch for hot ranges. It is called on the run
+	// loop whenever a new batch is created for a range and so must be cheap.
+	RangeOverrides func(roachpb.RangeID) RangeOverrides
+
+	// TargetBatchLatency, if positive, causes the batcher to tune the number
+	// of requests in its batches based on the latency with which they are
+	// sent. Batches grow while they are sent within TargetBatchLatency and
+	// shrink when they are not, between MinMsgsPerBatch and MaxMsgsPerBatch.
+	// It has no effect unless MaxMsgsPerBatch is positive.
+	TargetBatchLatency time.Duration
+
+	// MinMsgsPerBatch is the number of requests a batch must contain before
+	// MaxIdle applies to it. Smaller batches are only sent upon reaching
+	// MaxWait, which lets background consumers trade latency for better
+	// amortization. It is also the smallest number of requests to which
+	// TargetBatchLatency may shrink batches. If MinMsgsPerBatch <= 0 then a
+	// default of 1 is used.
+	MinMsgsPerBatch int
+
+	// HighPriorityMaxWait is the maximum amount of time a request sent with
+	// PriorityHigh waits in a batch before the batch is sent. If
+	// HighPriorityMaxWait is <= 0 then the batch is sent as soon as such a
+	// request is added to it.
+	HighPriorityMaxWait time.Duration
+
+	// CoalesceIncrements, if true, merges the IncrementRequests to the same
+	// key in a batch into a single IncrementRequest. Each caller receives the
+	// value it would have observed had the merged requests been applied in the
+	// order in which they were queued.
+	CoalesceIncrements bool
+
+	// CoalesceRangeStats, if true, sends only the first of the
+	// RangeStatsRequests in a batch. As every request in a batch is addressed
+	// to the same range, the other callers receive a copy of its response.
+	// This lets tooling which polls the statistics of many ranges do so
+	// cheaply by sending a RangeStatsRequest per range through the batcher.
+	CoalesceRangeStats bool
+
+	// HedgeDelay is the amount of time after which a read-only batch which
+	// has not received a response is sent again with HedgeSender. Whichever
+	// response arrives first is returned and the other send is canceled. If
+	// HedgeDelay <= 0 then batches are never hedged.
+	HedgeDelay time.Duration
+
+	// HedgeSender is used to send hedged batches. It is expected to route
+	// batches to a different replica than Sender, for example by preferring
+	// followers. If HedgeSender is nil then Sender is used.
+	HedgeSender client.Sender
+
+	// ShadowSender, if non-nil, is sent a copy of every batch which is
+	// flushed. Copies are sent asynchronously and their responses are ignored
+	// so they do not affect the callers of the batcher, which makes it
+	// suitable for mirroring traffic to a test cluster or an audit pipeline.
+	// The outcome of the copies is recorded in Stats.
+	ShadowSender client.Sender
+
+	// MaxShadowInFlight is the maximum number of copies of batches which may
+	// be in flight to ShadowSender at once. Copies beyond it are dropped. If
+	// MaxShadowInFlight <= 0 then a default of 16 is used.
+	MaxShadowInFlight int
+
+	// DryRun, if true, causes batches to be assembled, recorded in the
+	// batcher's metrics and traced as usual but never sent. Each request
+	// completes with an empty response of the appropriate type or, if
+	// DryRunError is non-nil, with DryRunError. Sender may be nil if DryRun is
+	// true.
+	DryRun bool
+
+	// DryRunError, if non-nil, is the error with which requests complete when
+	// DryRun is true.
+	DryRunError error
+
+	// HistogramWindow is the window over which the latency histograms in the
+	// batcher's Metrics are maintained. If HistogramWindow <= 0 then a default
+	// of 1m is used.
+	HistogramWindow time.Duration
+
+	// Histograms configures the range and precision of the histograms in the
+	// batcher's Metrics. Zero values are replaced with defaults.
+	Histograms HistogramOptions
+
+	// Registry, if non-nil, is the registry with which the batcher's Metrics
+	// are registered upon construction. Batchers which are not given a
+	// registry expose their metrics only through Metrics.
+	Registry *metric.Registry
+
+	// MetricPrefix is prepended to the names of the batcher's metrics. It
+	// should be unique among the batchers which share a registry. If
+	// MetricPrefix is empty then "requestbatcher.<Name>" is used, or
+	// "requestbatcher" if Name is also empty.
+	MetricPrefix string
+}
+
+// RequestBatcher batches requests destined for a single range based on
+// a configured batching policy.
+type RequestBatcher struct {
+	pool    pool
+	cfg     Config
+	metrics Metrics
+	stats   stats
+
+	// limits holds the current *Limits which may be changed with SetLimits.
+	// The corresponding fields of cfg hold their initial values.
+	limits atomic.Value
+
+	shards   []*shard
+	pending  pendingBudget
+	inFlight inFlightLimiter
+
+	// sendPool is nil if batches are sent on their own goroutines.
+	sendPool *sendPool
+	// prefetcher is nil if Config.PrefetchRangeDescriptor is nil.
+	prefetcher *prefetcher
+	// adaptive is nil if Config.TargetBatchLatency is not set.
+	adaptive *adaptiveSizer
+	// shadowSem limits the number of copies of batches in flight to
+	// Config.ShadowSender.
+	shadowSem chan struct{}
+	// dedup tracks the requests sent with SendOptions.IdempotencyKey.
+	dedup dedupRegistry
+	// quarantined tracks the ranges quarantined by DispositionQuarantine.
+	quarantined quarantineSet
+
+	// The run loops are started lazily upon the first call to Send so that
+	// batchers which never see traffic do not cost any goroutines.
+	startOnce sync.Once
+	startErr  error
+	started   int32 // accessed atomically
+
+	callers struct {
+		syncutil.Mutex
+		m map[string]*Caller
+	}
+}
+
+// shard is a single run loop and the batches for the ranges assigned to it.
+type shard struct {
+	b       *RequestBatcher
+	batches batchQueue
+	// queue holds the requests handed to the run loop by Send.
+	queue requestQueue
+
+	// ready holds batches which are ready to be sent but are being held back by
+	// the in-flight limits. It is only accessed by the run loop.
+	ready []*batch
+	// sendDone has a capacity of 1 and is signaled whenever an in-flight batch
+	// completes so that the run loop may send ready batches.
+	sendDone chan struct{}
+	// inspectChan is used to run functions which inspect or flush the
+	// shard's batches on the run loop. They are passed the run loop's context.
+	inspectChan chan func(context.Context)
+	// backedUp tracks the ranges whose queues exceed Config.BackedUpThreshold.
+	// It is only accessed by the run loop.
+	backedUp map[roachpb.RangeID]*backedUpState
+	// arrivals tracks the arrival rates of ranges for Config.AdaptiveMaxWait.
+	// It is only accessed by the run loop.
+	arrivals arrivalRates
+	// batchSizeHint is a moving average of the number of requests in the
+	// batches dispatched by the shard. New batches which do not reuse a large
+	// enough slice preallocate room for this many requests. It is only
+	// accessed by the run loop.
+	batchSizeHint int
+}
+
+// New creates a new RequestBatcher.
+func New(cfg Config) *RequestBatcher {
+	validateConfig(&cfg)
+	b := &RequestBatcher{
+		cfg:     cfg,
+		pool:    makePool(),
+		metrics: makeMetrics(cfg.MetricPrefix, cfg.HistogramWindow, cfg.Histograms),
+		pending: makePendingBudget(&cfg),
+		shards:  make([]*shard, cfg.NumShards),
+	}
+	b.inFlight.init(&cfg)
+	b.limits.Store(&Limits{
+		MaxMsgsPerBatch:            cfg.MaxMsgsPerBatch,
+		MaxWait:                    cfg.MaxWait,
+		MaxIdle:                    cfg.MaxIdle,
+		MaxInFlightBatches:         cfg.MaxInFlightBatches,
+		MaxInFlightBatchesPerRange: cfg.MaxInFlightBatchesPerRange,
+	})
+	if cfg.Registry != nil {
+		cfg.Registry.AddMetricStruct(&b.metrics)
+	}
+	for i := range b.shards {
+		b.shards[i] = &shard{
+			b:           b,
+			batches:     makeBatchQueue(cfg.FlushTimerResolution),
+			queue:       makeRequestQueue(),
+			sendDone:    make(chan struct{}, 1),
+			inspectChan: make(chan func(context.Context)),
+			backedUp:    map[roachpb.RangeID]*backedUpState{},
+		}
+	}
+	if cfg.MaxSendWorkers > 0 {
+		b.sendPool = newSendPool(b)
+	}
+	if cfg.PrefetchRangeDescriptor != nil {
+		b.prefetcher = newPrefetcher(&cfg)
+	}
+	if cfg.TargetBatchLatency > 0 {
+		b.adaptive = newAdaptiveSizer(&cfg)
+	}
+	if cfg.ShadowSender != nil {
+		b.shadowSem = make(chan struct{}, cfg.MaxShadowInFlight)
+	}
+	return b
+}
+
+// maybeStart starts the run loops if they have not already been started.
+func (b *RequestBatcher) maybeStart() error {
+	b.startOnce.Do(func() {
+		atomic.StoreInt32(&b.started, 1)
+		if err := b.start(); err == stop.ErrUnavailable {
+			b.startErr = b.annotateError(ErrStopped)
+		} else {
+			b.startErr = err
+		}
+	})
+	return b.startErr
+}
+
+func (b *RequestBatcher) start() error {
+	ctx := context.Background()
+	if b.cfg.Name != "" {
+		ctx = logtags.AddTag(ctx, b.cfg.Name, nil)
+	}
+	if b.sendPool != nil {
+		b.sendPool.start(ctx)
+	}
+	if b.prefetcher != nil {
+		if err := b.cfg.Stopper.RunAsyncTask(
+			ctx, b.cfg.Name, func(ctx context.Context) {
+				ctx, cancel := b.cfg.Stopper.WithCancelOnQuiesce(ctx)
+				defer cancel()
+				b.prefetcher.run(ctx)
+			},
+		); err != nil {
+			return err
+		}
+	}
+	for _, s := range b.shards {
+		if err := b.cfg.Stopper.RunAsyncTask(ctx, b.cfg.Name, s.run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardFor returns the shard responsible for batching requests to rangeID.
+func (b *RequestBatcher) shardFor(rangeID roachpb.RangeID) *shard {
+	return b.shards[uint64(rangeID)%uint64(len(b.shards))]
+}
+
+// shardForRequest returns the shard which owns the batch to which r is added.
+func (b *RequestBatcher) shardForRequest(r *request) *shard {
+	if r.target != (roachpb.ReplicationTarget{}) {
+		return b.shards[uint64(r.target.NodeID)%uint64(len(b.shards))]
+	}
+	return b.shardFor(r.rangeID)
+}
+
+func validateConfig(cfg *Config) {
+	if cfg.Stopper == nil {
+		panic("cannot construct a Batcher with a nil Stopper")
+	} else if cfg.Sender == nil && !cfg.DryRun {
+		panic("cannot construct a Batcher with a nil Sender")
+	}
+	if cfg.NumShards <= 0 {
+		cfg.NumShards = 1
+	}
+	if cfg.MaxSendWorkers > 0 {
+		if cfg.MinSendWorkers < 1 {
+			cfg.MinSendWorkers = 1
+		} else if cfg.MinSendWorkers > cfg.MaxSendWorkers {
+			cfg.MinSendWorkers = cfg.MaxSendWorkers
+		}
+		if cfg.SendWorkerIdleTimeout <= 0 {
+			cfg.SendWorkerIdleTimeout = defaultSendWorkerIdleTimeout
+		}
+	}
+	if cfg.ShadowSender != nil && cfg.MaxShadowInFlight <= 0 {
+		cfg.MaxShadowInFlight = defaultMaxShadowInFlight
+	}
+	if cfg.MinMsgsPerBatch <= 0 {
+		cfg.MinMsgsPerBatch = 1
+	}
+	if cfg.RetryOptions.MaxRetries == 0 {
+		cfg.RetryOptions.MaxRetries = defaultRetryMaxRetries
+	}
+	backoff := &cfg.RedispatchBackoff
+	if backoff.InitialBackoff <= 0 {
+		backoff.InitialBackoff = defaultRedispatchInitialBackoff
+	}
+	if backoff.MaxBackoff <= 0 {
+		backoff.MaxBackoff = defaultRedispatchMaxBackoff
+	}
+	if backoff.Multiplier <= 0 {
+		backoff.Multiplier = defaultRedispatchMultiplier
+	}
+	if backoff.RandomizationFactor <= 0 {
+		backoff.RandomizationFactor = defaultRedispatchRandomizationFactor
+	}
+	if cfg.QuarantineDuration <= 0 {
+		cfg.QuarantineDuration = defaultQuarantineDuration
+	}
+	if cfg.HistogramWindow <= 0 {
+		cfg.HistogramWindow = defaultHistogramWindow
+	}
+	cfg.Histograms.setDefaults()
+	if cfg.MetricPrefix == "" {
+		cfg.MetricPrefix = defaultMetricPrefix
+		if cfg.Name != "" {
+			cfg.MetricPrefix += "." + cfg.Name
+		}
+	}
+}
+
+// AmbiguousPolicy is the way in which a batch which fails with an
+// AmbiguousResultError is handled, see Config.AmbiguousPolicy.
+type AmbiguousPolicy int
+
+const (
+	// AmbiguousRetryIdempotent retries a batch composed entirely of requests
+	// sent with SendOptions.Idempotent up to Config.MaxAmbiguousRetries times
+	// and returns the error to the callers of any other batch.
+	AmbiguousRetryIdempotent AmbiguousPolicy = iota
+	// AmbiguousSurface returns the error to the callers as is.
+	AmbiguousSurface
+	// AmbiguousResolve passes each request to Config.ResolveAmbiguous to
+	// determine whether it was applied.
+	AmbiguousResolve
+)
+
+// ErrorPropagation is the way in which the error of a failed batch reaches
+// its requests, see Config.ErrorPropagation.
+type ErrorPropagation int
+
+const (
+	// ErrorPropagationFailFast fails every request in a batch with the
+	// batch's error, unless it is retried or attributed according to the
+	// other options of the Config.
+	ErrorPropagationFailFast ErrorPropagation = iota
+	// ErrorPropagationPerRequest fails only the requests implicated in a
+	// batch's error. If the error identifies the request which caused it, it
+	// is handled as though Config.AttributeErrors were set. Otherwise each of
+	// the batch's requests is queued again to be sent in a batch of its own,
+	// so that the requests which were not at fault succeed. It makes the same
+	// assumption of atomic batch evaluation as Config.AttributeErrors.
+	ErrorPropagationPerRequest
+)
+
+// Priority is the priority of a request, see SendOptions.Priority.
+type Priority int
+
+const (
+	// PriorityNormal is the priority of requests which do not specify one.
+	PriorityNormal Priority = iota
+	// PriorityHigh is for latency-sensitive requests. They are placed ahead
+	// of the other requests in their batch and cause it to be sent within
+	// Config.HighPriorityMaxWait.
+	PriorityHigh
+	// PriorityLow is for background requests. They do not reset their
+	// batch's MaxIdle timer, so a batch composed entirely of low priority
+	// requests waits the full MaxWait unless it fills up. MaxIdle still
+	// applies if MaxWait is not set.
+	PriorityLow
+)
+
+// SendOptions are per-request options which may be passed to
+// SendWithOptions.
+type SendOptions struct {
+
+	// Idempotent indicates that the request may safely be applied more than
+	// once. Batches composed entirely of idempotent requests may be retried
+	// after an ambiguous failure, see Config.MaxAmbiguousRetries.
+	Idempotent bool
+
+	// Reservation, if non-nil, is the reservation from which the request
+	// consumes queue capacity. If the reservation has been released or does
+	// not have enough capacity remaining the request competes for the
+	// batcher's unreserved capacity.
+	Reservation *Reservation
+
+	// NoCopy indicates that the batcher may take ownership of the request
+	// rather than making a defensive copy of it. The caller must not modify
+	// the request until the call to Send returns. Race builds assert that the
+	// request is not modified before it is sent.
+	NoCopy bool
+
+	// ReadConsistency is the consistency with which a read-only request is
+	// evaluated. Requests to a range with different read consistencies are
+	// sent in separate batches, each with the corresponding header. Requests
+	// which are not read-only must use CONSISTENT, the zero value.
+	ReadConsistency roachpb.ReadConsistencyType
+
+	// Caller, if non-nil, is the Caller to which the request is attributed.
+	// The request is rejected with ErrQuotaExceeded if it would exceed the
+	// caller's quota.
+	Caller *Caller
+
+	// Target, if non-zero, causes the request to be batched with the other
+	// requests to the same node and store rather than with those to the same
+	// range. The rangeID passed to SendWithOptions is ignored and the batch's
+	// header addresses the target replica, so Sender must route batches by
+	// their header's Replica, as a transport does. StoreID may be zero to
+	// batch by node alone. Per-range facilities, such as ForEachPending and
+	// RangeOverrides, treat such requests as addressed to range 0, but the
+	// per-range in-flight limits do not apply to them.
+	Target roachpb.ReplicationTarget
+
+	// Weight, if positive, is the number of messages the request counts as
+	// toward MaxMsgsPerBatch, for example the number of intents covered by a
+	// ResolveIntentRangeRequest, so that a heavyweight request may fill a
+	// batch by itself. Requests with a Weight <= 0 count as one message.
+	Weight int
+
+	// MaxWait, if positive, bounds the amount of time the request may wait
+	// in a batch before the batch is sent. The batch is sent at the earliest
+	// of the deadlines of its requests and Limits.MaxWait, so MaxWait may
+	// only shorten the time a request waits.
+	MaxWait time.Duration
+
+	// Priority is the priority of the request. Foreground requests may use
+	// PriorityHigh to be sent sooner and background requests PriorityLow to
+	// be batched more aggressively.
+	Priority Priority
+
+	// UserPriority, if non-zero, is the user priority with which the request
+	// is evaluated, see roachpb.Header. Requests with different user
+	// priorities are sent in separate batches, each with the corresponding
+	// header. It is distinct from Priority, which only affects batching.
+	UserPriority roachpb.UserPriority
+
+	// Immediate, if true, causes the request to be sent in a batch of its own
+	// as soon as it is queued rather than waiting for MaxIdle or joining the
+	// range's pending batch. The batch is still subject to the in-flight
+	// limits and is recorded in the batcher's metrics, so urgent requests
+	// remain visible to backpressure.
+	Immediate bool
+
+	// Exclusive, if true, causes the request to be sent in a BatchRequest of
+	// its own, for example because it is a large AddSSTable. The range's
+	// pending batch is sent ahead of it, so it is still queued behind the
+	// requests which preceded it and is subject to the in-flight limits. The
+	// requests of a group sent with SendGroup are sent together.
+	Exclusive bool
+
+	// IdempotencyKey, if non-empty, identifies requests which are
+	// interchangeable, such as resolutions of the same intent. If a request to
+	// the same range with the same key is already pending or in flight, the
+	// request is not queued and instead receives a copy of that request's
+	// response, or its error, once it completes. Requests attached to another
+	// consume no queue capacity. It is ignored by SendGroup and SendStream.
+	IdempotencyKey string
+
+	// union is the RequestUnion passed to SendUnion, if any.
+	union roachpb.RequestUnion
+}
+
+// Metrics returns the batcher's metrics. Batchers constructed without a
+// Config.Registry may use it to register their metrics explicitly.
+func (b *RequestBatcher) Metrics() *Metrics {
+	return &b.metrics
+}
+
+// Limits are the batching parameters which may be changed after construction
+// with SetLimits. They have the same meaning as the Config fields of the same
+// names.
+type Limits struct {
+	MaxMsgsPerBatch            int
+	MaxWait                    time.Duration
+	MaxIdle                    time.Duration
+	MaxInFlightBatches         int
+	MaxInFlightBatchesPerRange int
+}
+
+// Limits returns the batcher's current Limits.
+func (b *RequestBatcher) Limits() Limits {
+	return *b.loadLimits()
+}
+
+// SetLimits changes the batcher's Limits. Batches which are already queued
+// observe the new MaxWait and MaxIdle the next time a request is added to
+// them. Batches held back by MaxInFlightBatches or MaxInFlightBatchesPerRange
+// are reconsidered immediately.
+func (b *RequestBatcher) SetLimits(limits Limits) {
+	b.limits.Store(&limits)
+	b.inFlight.setMaxBatches(limits.MaxInFlightBatches, limits.MaxInFlightBatchesPerRange)
+	b.notifySendDone()
+}
+
+func (b *RequestBatcher) loadLimits() *Limits {
+	return b.limits.Load().(*Limits)
+}
+
+// RangeOverrides are the batching parameters for a single range returned by
+// Config.RangeOverrides. Fields which are zero take the value of the
+// batcher's Limits.
+type RangeOverrides struct {
+	MaxMsgsPerBatch int
+	MaxWait         time.Duration
+	MaxIdle         time.Duration
+}
+
+// batchLimits returns the Limits with which requests are added to a batch with
+// the given overrides. They reflect the effective MaxMsgsPerBatch if
+// Config.TargetBatchLatency is set and the overrides do not replace it.
+func (b *RequestBatcher) batchLimits(overrides RangeOverrides) *Limits {
+	limits := b.loadLimits()
+	if b.adaptive == nil && overrides == (RangeOverrides{}) {
+		return limits
+	}
+	adjusted := *limits
+	if b.adaptive != nil {
+		adjusted.MaxMsgsPerBatch = b.adaptive.limit(limits.MaxMsgsPerBatch)
+	}
+	if overrides.MaxMsgsPerBatch != 0 {
+		adjusted.MaxMsgsPerBatch = overrides.MaxMsgsPerBatch
+	}
+	if overrides.MaxWait != 0 {
+		adjusted.MaxWait = overrides.MaxWait
+	}
+	if overrides.MaxIdle != 0 {
+		adjusted.MaxIdle = overrides.MaxIdle
+	}
+	return &adjusted
+}
+
+// EffectiveMaxMsgsPerBatch returns the maximum number of requests currently
+// permitted in a batch to a range without overrides. It differs from
+// Limits().MaxMsgsPerBatch when batches are being sized according to
+// Config.TargetBatchLatency.
+func (b *RequestBatcher) EffectiveMaxMsgsPerBatch() int {
+	return b.batchLimits(RangeOverrides{}).MaxMsgsPerBatch
+}
+
+// Stats returns the current values of the batcher's counters.
+func (b *RequestBatcher) Stats() Stats {
+	return b.stats.snapshot()
+}
+
+// Send sends req as a part of a batch. An error is returned if the context
+// is canceled before the sending of the request completes. ErrQueueFull and
+// ErrStopped, annotated with the batcher's name, are returned if the batcher
+// cannot accept the request or is stopping.
+func (b *RequestBatcher) Send(
+	ctx context.Context, rangeID roachpb.RangeID, req roachpb.Request,
+) (roachpb.Response, error) {
+	return b.SendWithOptions(ctx, rangeID, req, SendOptions{})
+}
+
+// SendImmediate is like Send but bypasses batching, see
+// SendOptions.Immediate.
+func (b *RequestBatcher) SendImmediate(
+	ctx context.Context, rangeID roachpb.RangeID, req roachpb.Request,
+) (roachpb.Response, error) {
+	return b.SendWithOptions(ctx, rangeID, req, SendOptions{Immediate: true})
+}
+
+// SendUnion is like SendWithOptions but takes the request already wrapped in
+// a RequestUnion, which is added to the batch's BatchRequest as is. It lets
+// callers which send many requests, such as intent resolution, avoid the
+// allocation of the union's wrapper for each request. The batcher takes
+// ownership of the request as though opts.NoCopy were set.
+func (b *RequestBatcher) SendUnion(
+	ctx context.Context, rangeID roachpb.RangeID, ru roachpb.RequestUnion, opts SendOptions,
+) (roachpb.Response, error) {
+	req := ru.GetInner()
+	if req == nil {
+		return nil, b.annotateError(errors.New("empty RequestUnion"))
+	}
+	opts.NoCopy = true
+	opts.union = ru
+	return b.SendWithOptions(ctx, rangeID, req, opts)
+}
+
+// SendWithOptions is like Send but allows the caller to specify per-request
+// options.
+func (b *RequestBatcher) SendWithOptions(
+	ctx context.Context, rangeID roachpb.RangeID, req roachpb.Request, opts SendOptions,
+) (roachpb.Response, error) {
+	responseChan := b.pool.getResponseChan()
+	if err := b.enqueue(ctx, rangeID, req, opts, completion{responseChan: responseChan}); err != nil {
+		b.pool.putResponseChan(responseChan)
+		return nil, err
+	}
+	select {
+	case resp := <-responseChan:
+		// It's only safe to put responseChan back in the pool if it has been
+		// received from.
+		b.pool.putResponseChan(responseChan)
+		return resp.resp, resp.err
+	case <-b.cfg.Stopper.ShouldQuiesce():
+		return nil, b.annotateError(ErrStopped)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// checkReadConsistency returns an error if req may not be sent with the read
+// consistency in opts.
+func (b *RequestBatcher) checkReadConsistency(req roachpb.Request, opts SendOptions) error {
+	if opts.ReadConsistency != roachpb.CONSISTENT && !roachpb.IsReadOnly(req) {
+		return b.annotateError(errors.Errorf(
+			"%s request may not be sent with %s read consistency", req.Method(), opts.ReadConsistency))
+	}
+	return nil
+}
+
+// SendAsync queues req like SendWithOptions but rather than waiting for the
+// response it calls fn with the response or error once the request completes.
+// It lets callers which fan out many requests avoid dedicating a goroutine to
+// each of them. If the request cannot be queued, for example because the
+// queue is full or ctx is canceled, fn is called with the error before
+// SendAsync returns. Once the request has been queued, canceling ctx does not
+// prevent it from being sent; fn is called with its result regardless.
+//
+// fn is called exactly once, on one of the batcher's goroutines which
+// demultiplexes the responses to a batch or, if the batcher is stopping, on
+// the run loop which owns the request's range. It must not block and must not
+// call back into the RequestBatcher synchronously. The response passed to fn
+// is owned by the caller.
+func (b *RequestBatcher) SendAsync(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
+	req roachpb.Request,
+	opts SendOptions,
+	fn func(roachpb.Response, *roachpb.Error),
+) {
+	if err := b.enqueue(ctx, rangeID, req, opts, completion{callback: fn}); err != nil {
+		fn(nil, roachpb.NewError(err))
+	}
+}
+
+// Result is the outcome of a request sent with SendWithChan.
+type Result struct {
+	// Token is the token passed to SendWithChan.
+	Token interface{}
+	// Response is the response to the request if it succeeded.
+	Response roachpb.Response
+	// Err is the error with which the request failed, if any.
+	Err error
+}
+
+// SendWithChan queues req like SendWithOptions but rather than waiting for the
+// response it delivers a Result carrying token on results once the request
+// completes. A single consumer may share one channel across many requests and
+// use the tokens to tell them apart, which avoids a goroutine and a channel
+// per request. If an error is returned the request was not queued and no
+// Result is delivered. Once the request has been queued, canceling ctx does
+// not prevent it from being sent.
+//
+// The batcher's goroutines block sending on results, so its capacity must be
+// at least the number of requests outstanding on it at any time.
+func (b *RequestBatcher) SendWithChan(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
+	req roachpb.Request,
+	opts SendOptions,
+	results chan<- Result,
+	token interface{},
+) error {
+	return b.enqueue(ctx, rangeID, req, opts, completion{results: results, token: token})
+}
+
+// SendStream queues req, typically a ranged read, like SendWithOptions and
+// returns a channel on which its results are delivered page by page. Each
+// response which carries a ResumeSpan is delivered as a Result and the
+// remainder of the request's span is queued to be sent in a later batch, so
+// the caller need not reissue the request itself. The final response, which
+// has no ResumeSpan, or the error with which the request fails is delivered
+// last, after which the channel is closed. Config.MaxResumesPerRequest does
+// not apply to such requests; Config.MaxSpanRequestKeys determines the size of
+// the pages.
+//
+// The batcher's goroutines block delivering results until the caller receives
+// them or ctx is canceled, in which case the request fails with ctx's error,
+// which may not be delivered, and the channel is closed.
+func (b *RequestBatcher) SendStream(
+	ctx context.Context, rangeID roachpb.RangeID, req roachpb.Request, opts SendOptions,
+) (<-chan Result, error) {
+	stream := make(chan Result, 1)
+	opts.IdempotencyKey = ""
+	if err := b.enqueue(ctx, rangeID, req, opts, completion{stream: stream}); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// SendNoReply queues req like SendWithOptions without waiting for or
+// delivering its response, for best-effort work whose result is never read.
+// If onError is non-nil it is called if the request fails once queued, under
+// the same contract as the callback passed to SendAsync. An error is returned
+// if the request could not be queued.
+func (b *RequestBatcher) SendNoReply(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
+	req roachpb.Request,
+	opts SendOptions,
+	onError func(error),
+) error {
+	return b.enqueue(ctx, rangeID, req, opts, completion{noReply: true, onError: onError})
+}
+
+// completion describes how the result of a request is delivered. One of
+// responseChan, callback, results, stream and future is set unless noReply is
+// true.
+type completion struct {
+	// responseChan receives the result of a request sent with Send.
+	responseChan chan<- response
+	// callback is called with the result of a request sent with SendAsync.
+	callback func(roachpb.Response, *roachpb.Error)
+	// results receives the result of a request sent with SendWithChan along
+	// with token.
+	results chan<- Result
+	token   interface{}
+	// stream receives the pages of the result of a request sent with
+	// SendStream and is closed once the request completes.
+	stream chan Result
+	// future is completed with the result of a request sent with SendFuture.
+	future *Future
+	// noReply is true for requests sent with SendNoReply, whose errors are
+	// passed to onError, if it is non-nil, and whose responses are dropped.
+	noReply bool
+	onError func(error)
+}
+
+// enqueue passes req to the run loop which owns its range. The request's
+// result is delivered as described by done. If an error is returned the
+// request was not queued and done is not used.
+func (b *RequestBatcher) enqueue(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
+	req roachpb.Request,
+	opts SendOptions,
+	done completion,
+) error {
+	if err := b.maybeStart(); err != nil {
+		return err
+	}
+	var key dedupKey
+	if opts.IdempotencyKey != "" {
+		if err := b.checkReadConsistency(req, opts); err != nil {
+			return err
+		}
+		key = dedupKey{rangeID: rangeID, key: opts.IdempotencyKey}
+		if b.dedup.maybeAttach(ctx, key, done) {
+			b.stats.recordDeduplicated()
+			return nil
+		}
+	}
+	r, err := b.newQueuedRequest(ctx, rangeID, req, opts, done)
+	if err != nil {
+		b.releaseDedup(key, err)
+		return err
+	}
+	r.dedupKey = key
+	if err := b.submit(r); err != nil {
+		b.abandonRequest(r)
+		b.releaseDedup(key, err)
+		return err
+	}
+	return nil
+}
+
+// releaseDedup fails the requests attached to key, if it is set, with err
+// after the request which registered it could not be queued.
+func (b *RequestBatcher) releaseDedup(key dedupKey, err error) {
+	if key != (dedupKey{}) {
+		b.respondToFollowers(b.dedup.release(key), response{err: err})
+	}
+}
+
+// newQueuedRequest returns a request for req which has acquired its share of
+// the batcher's pending quota and of the quota of opts.Caller, if any. The
+// request must either be passed to a run loop or released with
+// abandonRequest.
+func (b *RequestBatcher) newQueuedRequest(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
+	req roachpb.Request,
+	opts SendOptions,
+	done completion,
+) (*request, error) {
+	if err := b.checkReadConsistency(req, opts); err != nil {
+		return nil, err
+	}
+	if b.cfg.GlobalBatching || opts.Target != (roachpb.ReplicationTarget{}) {
+		rangeID = 0
+	}
+	if err := b.checkQuarantine(rangeID); err != nil {
+		return nil, err
+	}
+	r := b.pool.newRequest(ctx, rangeID, req, opts, done.responseChan)
+	r.done = done
+	if b.cfg.Cost != nil {
+		r.cost = b.cfg.Cost(r.req)
+	}
+	if b.cfg.MaxKeysPerBatch > 0 {
+		r.keys = estimateKeys(&b.cfg, r.req)
+	}
+	if b.cfg.SeparateReadsAndWrites {
+		r.readOnly = roachpb.IsReadOnly(r.req)
+	}
+	if opts.Caller != nil {
+		if err := opts.Caller.tryAcquire(r); err != nil {
+			b.pool.putRequest(r)
+			return nil, b.annotateError(err)
+		}
+		r.caller = opts.Caller
+	}
+	var err error
+	if opts.Reservation != nil && opts.Reservation.tryConsume(r) {
+		r.reservation = opts.Reservation
+	} else {
+		err = b.pending.tryAcquire(r)
+	}
+	if err != nil {
+		telemetry.Inc(queueFullCounter)
+		err = b.annotateError(err)
+		releaseCaller(r)
+		b.pool.putRequest(r)
+		return nil, err
+	}
+	return r, nil
+}
+
+// abandonRequest releases the quota held by r, which was returned by
+// newQueuedRequest but not passed to a run loop, and returns it to the pool.
+// Capacity consumed from a reservation is returned to the reservation.
+func (b *RequestBatcher) abandonRequest(r *request) {
+	if r.reservation == nil || !r.reservation.refund(r) {
+		b.pending.release(r)
+	}
+	releaseCaller(r)
+	b.pool.putRequest(r)
+}
+
+// SendGroup sends reqs to the range identified by rangeID as an indivisible
+// unit: they are added to the same batch, in order, and are sent together in
+// one BatchRequest. It is useful for requests which must be evaluated
+// together, such as a QueryIntent followed by the ResolveIntent it guards.
+// The responses are returned in the order of reqs. If any of the requests
+// fails, the first error is returned.
+//
+// The limits on the size of a batch may be exceeded to keep a group together
+// and the requests of a group are never split across batches by
+// Config.SeparateReadsAndWrites or Config.CompatibilityRules. A group is only
+// kept together the first time it is sent, so opts.Idempotent may not be set,
+// and requests which are resumed after a ResumeSpan are resumed individually.
+func (b *RequestBatcher) SendGroup(
+	ctx context.Context, rangeID roachpb.RangeID, reqs []roachpb.Request, opts SendOptions,
+) ([]roachpb.Response, error) {
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+	if opts.Idempotent {
+		return nil, b.annotateError(errors.New("requests sent with SendGroup may not be retried"))
+	}
+	if err := b.maybeStart(); err != nil {
+		return nil, err
+	}
+	results := make(chan Result, len(reqs))
+	group := make([]*request, 0, len(reqs))
+	abandon := func() {
+		for _, r := range group {
+			b.abandonRequest(r)
+		}
+	}
+	for i, req := range reqs {
+		r, err := b.newQueuedRequest(ctx, rangeID, req, opts, completion{results: results, token: i})
+		if err != nil {
+			abandon()
+			return nil, err
+		}
+		group = append(group, r)
+	}
+	// The requests of a group must share a batch key, so a group which mixes
+	// reads and writes is batched with writes.
+	readOnly := true
+	for _, r := range group {
+		readOnly = readOnly && r.readOnly
+	}
+	for _, r := range group {
+		r.readOnly = readOnly
+	}
+	group[0].group = group
+	if err := b.submit(group[0]); err != nil {
+		abandon()
+		return nil, err
+	}
+	resps := make([]roachpb.Response, len(reqs))
+	var err error
+	for range reqs {
+		select {
+		case res := <-results:
+			if res.Err != nil && err == nil {
+				err = res.Err
+			}
+			resps[res.Token.(int)] = res.Response
+		case <-b.cfg.Stopper.ShouldQuiesce():
+			return nil, b.annotateError(ErrStopped)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resps, nil
+}
+
+// Saturation returns the largest fraction of any of the batcher's budgets, as
+// configured by MaxPendingRequests, MaxPendingBytes, and the MaxInFlight
+// limits, which is currently consumed. Once the saturation of the queue
+// budgets reaches 1, Send will begin to reject requests. Callers which
+// produce work in the background may use Saturation to throttle themselves
+// before hitting such errors. If no budgets are configured the saturation is
+// always 0.
+func (b *RequestBatcher) Saturation() float64 {
+	return maxFloat(b.pending.saturation(), b.inFlight.saturation())
+}
+
+// PendingRequest describes a request which is queued waiting to be sent.
+type PendingRequest struct {
+	// Request is the queued request. It must not be modified.
+	Request roachpb.Request
+	// EnqueueTime is the time at which the request was first queued.
+	EnqueueTime time.Time
+	// Retries is the number of times the request has been requeued.
+	Retries int
+	// Idempotent is true if the request was sent with SendOptions.Idempotent.
+	Idempotent bool
+}
+
+// ForEachPending calls fn for each request to rangeID which has been queued
+// but not yet handed to the Sender, in the order the requests will appear
+// in their batch. fn is called on the run loop which owns the range's batches
+// and so must not block or call back into the RequestBatcher. It is intended
+// for tests and debugging.
+func (b *RequestBatcher) ForEachPending(
+	ctx context.Context, rangeID roachpb.RangeID, fn func(PendingRequest),
+) error {
+	if atomic.LoadInt32(&b.started) == 0 {
+		return nil
+	}
+	if b.cfg.GlobalBatching {
+		rangeID = 0
+	}
+	s := b.shardFor(rangeID)
+	visit := func(ba *batch) {
+		for _, r := range ba.reqs {
+			fn(PendingRequest{
+				Request:     r.req,
+				EnqueueTime: r.enqueueTime,
+				Retries:     r.retries,
+				Idempotent:  r.idempotent,
+			})
+		}
+	}
+	done := make(chan struct{})
+	f := func(context.Context) {
+		defer close(done)
+		for _, ba := range s.ready {
+			if ba.rangeID() == rangeID {
+				visit(ba)
+			}
+		}
+		s.batches.forRange(rangeID, visit)
+	}
+	select {
+	case s.inspectChan <- f:
+	case <-b.cfg.Stopper.ShouldQuiesce():
+		return b.annotateError(ErrStopped)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// Flush sends the batches of requests to the range identified by rangeID
+// which are pending, regardless of their timers and thresholds. It lets a
+// caller which has queued the last request of a logical operation avoid
+// waiting for MaxIdle. Batches are subject to the in-flight limits as usual;
+// Flush returns once they have been dispatched rather than once they have been
+// sent.
+func (b *RequestBatcher) Flush(ctx context.Context, rangeID roachpb.RangeID) error {
+	if atomic.LoadInt32(&b.started) == 0 {
+		return nil
+	}
+	if b.cfg.GlobalBatching {
+		rangeID = 0
+	}
+	s := b.shardFor(rangeID)
+	done := make(chan struct{})
+	f := func(ctx context.Context) {
+		defer close(done)
+		var toFlush []*batch
+		s.batches.forRange(rangeID, func(ba *batch) {
+			toFlush = append(toFlush, ba)
+		})
+		for _, ba := range toFlush {
+			s.batches.remove(ba)
+			ba.reason = flushExplicit
+			s.dispatch(ctx, ba)
+		}
+	}
+	select {
+	case s.inspectChan <- f:
+	case <-b.cfg.Stopper.ShouldQuiesce():
+		return b.annotateError(ErrStopped)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// FlushAll sends every pending batch, regardless of its range, timers and
+// thresholds, and returns once each of them, along with the batches which
+// were held by the in-flight limits or were waiting in the backlog of the send
+// workers, has been handed to the Sender. It lets callers bound the staleness
+// of the work queued in the batcher.
+func (b *RequestBatcher) FlushAll(ctx context.Context) error {
+	if atomic.LoadInt32(&b.started) == 0 {
+		return nil
+	}
+	var flushed []chan struct{}
+	for _, s := range b.shards {
+		s := s
+		done := make(chan struct{})
+		f := func(ctx context.Context) {
+			defer close(done)
+			for _, ba := range s.ready {
+				flushed = append(flushed, ba.flushedChan())
+			}
+			for ba := s.batches.popFront(); ba != nil; ba = s.batches.popFront() {
+				ba.reason = flushExplicit
+				flushed = append(flushed, ba.flushedChan())
+				s.dispatch(ctx, ba)
+			}
+		}
+		select {
+		case s.inspectChan <- f:
+		case <-b.cfg.Stopper.ShouldQuiesce():
+			return b.annotateError(ErrStopped)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-done
+	}
+	if b.sendPool != nil {
+		flushed = b.sendPool.appendBacklogFlushed(flushed)
+	}
+	for _, c := range flushed {
+		select {
+		case <-c:
+		case <-b.cfg.Stopper.ShouldQuiesce():
+			return b.annotateError(ErrStopped)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// sendBatch dispatches ba to be sent asynchronously. It is called from the run
+// loop and so should do as little work as possible; assembling the
+// BatchRequest and all per-request accounting happens in send.
+func (b *RequestBatcher) sendBatch(ctx context.Context, ba *batch) {
+	if b.sendPool != nil {
+		b.sendPool.dispatch(ctx, ba)
+		return
+	}
+	b.cfg.Stopper.RunWorker(ctx, func(ctx context.Context) {
+		b.send(ctx, ba)
+	})
+}
+
+// send sends ba and responds to each of its requests.
+func (b *RequestBatcher) send(ctx context.Context, ba *batch) {
+	defer b.sendDone(ba.rangeID(), len(ba.reqs), ba.size, ba.span)
+	queueWait, latency := b.metrics.histograms(ba.reason)
+	b.metrics.BatchRequests.RecordValue(int64(len(ba.reqs)))
+	b.metrics.BatchBytes.RecordValue(int64(ba.size))
+	recordBatchTelemetry(len(ba.reqs), ba.reason)
+	sendTime := timeutil.Now()
+	for _, r := range ba.reqs {
+		b.pending.release(r)
+		assertUnmodified(ctx, r)
+		wait := sendTime.Sub(r.enqueueTime)
+		queueWait.RecordValue(wait.Nanoseconds())
+		// The arguments are only boxed if the request is being traced, as this
+		// is done for every request.
+		if log.HasSpanOrEvent(r.ctx) {
+			log.Eventf(r.ctx, "sending batch of %d requests to r%d flushed due to %s after waiting %s",
+				len(ba.reqs), ba.rangeID(), ba.reason, log.Safe(wait))
+		}
+	}
+	defer b.pool.putBatch(ba)
+	arena := b.pool.getArena()
+	defer b.pool.putArena(arena)
+	var ci *coalescedBatch
+	if b.cfg.CoalesceIncrements || b.cfg.CoalesceRangeStats {
+		ci = coalesce(ba.reqs, b.cfg.CoalesceIncrements, b.cfg.CoalesceRangeStats, arena)
+	}
+	br := ba.batchRequest(arena, ci)
+	br.ReturnRangeInfo = b.cfg.UpdateRangeInfos != nil
+	br.MaxSpanRequestKeys = b.cfg.MaxSpanRequestKeys
+	b.shadow(ctx, br)
+	if b.cfg.SendHints != (client.BatchHints{}) {
+		ctx = client.ContextWithBatchHints(ctx, b.cfg.SendHints)
+	}
+	ba.markFlushed()
+	var resp *roachpb.BatchResponse
+	var pErr *roachpb.Error
+	var budgetExceeded bool
+	if b.cfg.DryRun {
+		b.stats.recordSent(len(ba.reqs))
+		resp, pErr = b.dryRun(ctx, br)
+	} else {
+		var waitHedge func()
+		start := timeutil.Now()
+		resp, pErr, waitHedge, budgetExceeded = b.sendWithRetries(ctx, ba, br)
+		defer waitHedge()
+		if b.adaptive != nil {
+			b.adaptive.observe(ba.weight, timeutil.Since(start), b.loadLimits().MaxMsgsPerBatch)
+		}
+	}
+	b.maybeUpdateClock(resp, pErr)
+	// The routing information must be extracted before the responses are
+	// handed to the callers who then own them.
+	b.updateRoutingInfo(ctx, resp, pErr)
+	if pErr != nil && !budgetExceeded {
+		switch b.classifyError(pErr) {
+		case DispositionDefault:
+			if b.shouldRetryAmbiguous(ba, pErr) {
+				b.requeue(ctx, ba, pErr.GoError())
+				return
+			}
+			if b.maybeResolveAmbiguous(ctx, ba, pErr) {
+				return
+			}
+			perRequest := b.cfg.ErrorPropagation == ErrorPropagationPerRequest
+			if b.maybeReroute(ctx, ba, pErr) || b.maybeRedispatch(ctx, ba, pErr) ||
+				b.maybeHandOffIntents(ctx, ba, pErr) ||
+				((b.cfg.AttributeErrors || perRequest) && b.maybeAttributeError(ctx, ba, ci, pErr)) ||
+				(perRequest && b.maybeIsolate(ctx, ba, pErr)) {
+				return
+			}
+		case DispositionFailRequest:
+			if b.maybeAttributeError(ctx, ba, ci, pErr) {
+				return
+			}
+		case DispositionQuarantine:
+			b.quarantine(ctx, ba.rangeID(), pErr)
+		}
+	}
+	var err error
+	if pErr != nil {
+		b.stats.recordFailed(len(ba.reqs))
+		err = pErr.GoError()
+		if budgetExceeded {
+			err = b.annotateError(&lastError{sentinel: ErrRetryBudgetExceeded, last: err})
+		}
+	}
+	respTime := timeutil.Now()
+	for i, r := range ba.reqs {
+		res := response{}
+		if resp != nil && ci != nil {
+			res.resp = ci.response(i, resp)
+		} else if resp != nil && i < len(resp.Responses) {
+			res.resp = resp.Responses[i].GetInner()
+		}
+		if err != nil {
+			res.err = err
+		}
+		if b.maybeResume(ctx, r, &res) {
+			continue
+		}
+		latency.RecordValue(respTime.Sub(r.enqueueTime).Nanoseconds())
+		b.sendResponse(r, res)
+	}
+}
+
+// dryRun returns the response with which the requests in br complete when the
+// batcher is in dry-run mode.
+func (b *RequestBatcher) dryRun(
+	ctx context.Context, br roachpb.BatchRequest,
+) (*roachpb.BatchResponse, *roachpb.Error) {
+	log.Eventf(ctx, "dry run: not sending batch of %d requests", len(br.Requests))
+	if b.cfg.DryRunError != nil {
+		return nil, roachpb.NewError(b.cfg.DryRunError)
+	}
+	return br.CreateReply(), nil
+}
+
+// maybeUpdateClock forwards the configured Clock to the timestamp carried by
+// the response to a batch.
+func (b *RequestBatcher) maybeUpdateClock(resp *roachpb.BatchResponse, pErr *roachpb.Error) {
+	if b.cfg.Clock == nil {
+		return
+	}
+	if pErr != nil {
+		if pErr.Now != (hlc.Timestamp{}) {
+			b.cfg.Clock.Update(pErr.Now)
+		}
+	} else if resp != nil && resp.Now != (hlc.Timestamp{}) {
+		b.cfg.Clock.Update(resp.Now)
+	}
+}
+
+// updateRoutingInfo passes the routing information contained in the response
+// to a batch to the configured callbacks.
+func (b *RequestBatcher) updateRoutingInfo(
+	ctx context.Context, resp *roachpb.BatchResponse, pErr *roachpb.Error,
+) {
+	if b.cfg.UpdateLeaseHolder != nil && pErr != nil {
+		if nlhe, ok := pErr.GetDetail().(*roachpb.NotLeaseHolderError); ok && nlhe.LeaseHolder != nil {
+			b.cfg.UpdateLeaseHolder(ctx, nlhe.RangeID, nlhe.LeaseHolder.StoreID)
+		}
+	}
+	if b.cfg.UpdateRangeInfos == nil || resp == nil {
+		return
+	}
+	var infos []roachpb.RangeInfo
+	for i := range resp.Responses {
+		for _, info := range resp.Responses[i].GetInner().Header().RangeInfos {
+			// Every response from the same range carries the same RangeInfo.
+			if n := len(infos); n > 0 && infos[n-1].Desc.RangeID == info.Desc.RangeID {
+				continue
+			}
+			infos = append(infos, info)
+		}
+	}
+	if len(infos) > 0 {
+		b.cfg.UpdateRangeInfos(ctx, infos)
+	}
+}
+
+// sendDone releases the in-flight accounting for a completed batch and
+// notifies the run loops which may now be able to send a held batch.
+func (b *RequestBatcher) sendDone(
+	rangeID roachpb.RangeID, numRequests, size int, span roachpb.Span,
+) {
+	b.inFlight.release(rangeID, numRequests, size, span)
+	b.notifySendDone()
+}
+
+// notifySendDone signals the run loops to send any held batches which the
+// in-flight limits now permit.
+func (b *RequestBatcher) notifySendDone() {
+	for _, s := range b.shards {
+		select {
+		case s.sendDone <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// failBatch responds to every request in ba, which has been dispatched but not
+// sent, with err.
+func (b *RequestBatcher) failBatch(ba *batch, err error) {
+	ba.reason = flushShutdown
+	b.stats.recordFailed(len(ba.reqs))
+	for _, r := range ba.reqs {
+		log.Eventf(r.ctx, "failing batch of %d requests to r%d flushed due to %s: %v",
+			len(ba.reqs), ba.rangeID(), ba.reason, redactError(err))
+		b.pending.release(r)
+		b.sendResponse(r, response{err: err})
+	}
+	ba.markFlushed()
+	b.pool.putBatch(ba)
+}
+
+// shouldRetryAmbiguous returns true if pErr is an AmbiguousResultError and
+// every request in ba is idempotent and has retries remaining.
+func (b *RequestBatcher) shouldRetryAmbiguous(ba *batch, pErr *roachpb.Error) bool {
+	if b.cfg.AmbiguousPolicy != AmbiguousRetryIdempotent {
+		return false
+	}
+	if _, ok := pErr.GetDetail().(*roachpb.AmbiguousResultError); !ok {
+		return false
+	}
+	for _, r := range ba.reqs {
+		if !r.idempotent || r.retries >= b.cfg.MaxAmbiguousRetries {
+			return false
+		}
+	}
+	return true
+}
+
+// maybeResolveAmbiguous is called when ba fails with pErr. If pErr is an
+// AmbiguousResultError and Config.AmbiguousPolicy is AmbiguousResolve, each
+// request is passed to Config.ResolveAmbiguous and succeeds, is queued again
+// or fails according to its result, and true is returned. If false is
+// returned the caller is responsible for responding to the requests.
+func (b *RequestBatcher) maybeResolveAmbiguous(
+	ctx context.Context, ba *batch, pErr *roachpb.Error,
+) bool {
+	if b.cfg.AmbiguousPolicy != AmbiguousResolve || b.cfg.ResolveAmbiguous == nil {
+		return false
+	}
+	if _, ok := pErr.GetDetail().(*roachpb.AmbiguousResultError); !ok {
+		return false
+	}
+	for _, r := range ba.reqs {
+		applied, err := b.cfg.ResolveAmbiguous(ctx, r.req)
+		switch {
+		case err != nil:
+			b.stats.recordFailed(1)
+			b.sendResponse(r, response{err: err})
+		case applied:
+			var br roachpb.BatchRequest
+			br.Add(r.req)
+			b.sendResponse(r, response{resp: br.CreateReply().Responses[0].GetInner()})
+		default:
+			b.retry(ctx, r, pErr.GoError())
+		}
+	}
+	return true
+}
+
+// maybeAttributeError is called when ba, sent as ci if it was coalesced,
+// fails with pErr. If pErr identifies the request which caused it, that
+// request, along with any requests coalesced with it, fails with pErr and the
+// others are queued again, and true is returned. If false is returned the
+// caller is responsible for responding to the requests.
+func (b *RequestBatcher) maybeAttributeError(
+	ctx context.Context, ba *batch, ci *coalescedBatch, pErr *roachpb.Error,
+) bool {
+	if pErr.Index == nil {
+		return false
+	}
+	idx := int(pErr.Index.Index)
+	numSent := len(ba.reqs)
+	if ci != nil {
+		numSent = len(ci.reqs)
+	}
+	if idx < 0 || idx >= numSent {
+		return false
+	}
+	err := pErr.GoError()
+	for i, r := range ba.reqs {
+		sentIdx := i
+		if ci != nil {
+			sentIdx = ci.respIdx[i]
+		}
+		if sentIdx == idx {
+			b.stats.recordFailed(1)
+			b.sendResponse(r, response{err: err})
+			continue
+		}
+		b.retry(ctx, r, err)
+	}
+	return true
+}
+
+// maybeIsolate is called when ba fails with pErr, which does not identify the
+// request which caused it. If ba contains more than one request, each of
+// them is queued again to be sent in a batch of its own and true is
+// returned. If false is returned the caller is responsible for responding to
+// the requests.
+func (b *RequestBatcher) maybeIsolate(ctx context.Context, ba *batch, pErr *roachpb.Error) bool {
+	if len(ba.reqs) <= 1 {
+		return false
+	}
+	log.Eventf(ctx, "isolating %d requests after batch failed with %s", len(ba.reqs), redactPErr(pErr))
+	err := pErr.GoError()
+	for _, r := range ba.reqs {
+		r.exclusive = true
+		b.retry(ctx, r, err)
+	}
+	return true
+}
+
+// requeue passes the requests in ba back to the run loop to be sent again in
+// a later batch after a backoff according to Config.RedispatchBackoff. If the
+// batcher is stopping, the requests are failed instead.
+func (b *RequestBatcher) requeue(ctx context.Context, ba *batch, err error) {
+	b.waitRedispatch(ctx, ba)
+	for _, r := range ba.reqs {
+		b.retry(ctx, r, err)
+	}
+}
+
+// retry queues r, whose batch failed with err, to be sent again unless doing
+// so would exceed the retry budget or Config.MaxConsecutiveFailures, in which
+// case r fails.
+func (b *RequestBatcher) retry(ctx context.Context, r *request, err error) {
+	if b.retryBudgetExceeded(r.retries, r.enqueueTime) {
+		b.stats.recordFailed(1)
+		b.sendResponse(r, response{err: b.annotateError(&lastError{sentinel: ErrRetryBudgetExceeded, last: err})})
+		return
+	}
+	r.failures++
+	if max := b.cfg.MaxConsecutiveFailures; max > 0 && r.failures >= max {
+		if !b.cfg.IsolateFailingRequests || r.isolated {
+			b.stats.recordFailed(1)
+			b.sendResponse(r, response{err: b.annotateError(&lastError{sentinel: ErrTooManyFailures, last: err})})
+			return
+		}
+		log.Eventf(r.ctx, "isolating %s request after %d failed batches", log.Safe(r.req.Method()), r.failures)
+		r.isolated, r.exclusive, r.failures = true, true, 0
+	}
+	r.retries++
+	if err := b.resubmit(r); err != nil {
+		b.stats.recordFailed(1)
+		b.sendResponse(r, response{err: err})
+	}
+}
+
+// retryBudgetExceeded returns true if a request which has been retried
+// retries times and was first queued at enqueueTime may not be retried again
+// according to Config.MaxRetryAttempts and Config.MaxRetryDuration.
+func (b *RequestBatcher) retryBudgetExceeded(retries int, enqueueTime time.Time) bool {
+	if b.cfg.MaxRetryAttempts > 0 && retries >= b.cfg.MaxRetryAttempts {
+		return true
+	}
+	return b.cfg.MaxRetryDuration > 0 && !enqueueTime.IsZero() &&
+		timeutil.Since(enqueueTime) >= b.cfg.MaxRetryDuration
+}
+
+// resubmit passes r, which was previously accepted by Send, back to the run
+// loop which owns its range. It returns an error if the batcher is stopping.
+func (b *RequestBatcher) resubmit(r *request) error {
+	b.pending.acquire(r)
+	if err := b.submit(r); err != nil {
+		b.pending.release(r)
+		return err
+	}
+	return nil
+}
+
+func (b *RequestBatcher) sendResponse(req *request, resp response) {
+	releaseCaller(req)
+	ctx, done := req.ctx, req.done
+	var followers []follower
+	if req.dedupKey != (dedupKey{}) {
+		followers = b.dedup.release(req.dedupKey)
+	}
+	b.pool.putRequest(req)
+	// The followers receive copies of the response, so they must be made
+	// before the response is handed to its owner.
+	b.respondToFollowers(followers, resp)
+	b.deliver(ctx, done, resp)
+}
+
+// deliver passes resp to the caller as described by done.
+func (b *RequestBatcher) deliver(ctx context.Context, done completion, resp response) {
+	switch {
+	case done.noReply:
+		if resp.err != nil && done.onError != nil {
+			done.onError(resp.err)
+		}
+	case done.callback != nil:
+		var pErr *roachpb.Error
+		if resp.err != nil {
+			pErr = roachpb.NewError(resp.err)
+		}
+		done.callback(resp.resp, pErr)
+	case done.results != nil:
+		done.results <- Result{Token: done.token, Response: resp.resp, Err: resp.err}
+	case done.future != nil:
+		done.future.complete(resp.resp, resp.err)
+	case done.stream != nil:
+		select {
+		case done.stream <- Result{Response: resp.resp, Err: resp.err}:
+		case <-ctx.Done():
+		}
+		close(done.stream)
+	default:
+		// This send should never block because responseChan is buffered.
+		done.responseChan <- resp
+	}
+}
+
+func addRequestToBatch(
+	cfg *Config, limits *Limits, now time.Time, ba *batch, r *request,
+) (shouldSend bool) {
+	if r.enqueueTime.IsZero() {
+		r.enqueueTime = now
+	}
+	if r.retries > 0 {
+		// Requests which are being retried have already waited in a batch once.
+		// Place them ahead of the requests which have not yet been sent and
+		// measure MaxWait from when they were first enqueued.
+		ba.reqs = append(ba.reqs, nil)
+		copy(ba.reqs[ba.numRetried+1:], ba.reqs[ba.numRetried:])
+		ba.reqs[ba.numRetried] = r
+		ba.numRetried++
+		if r.enqueueTime.Before(ba.startTime) {
+			ba.startTime = r.enqueueTime
+		}
+	} else if r.priority == PriorityHigh {
+		// High priority requests follow the retried requests and the high
+		// priority requests which were added before them.
+		i := ba.numRetried + ba.numHigh
+		ba.reqs = append(ba.reqs, nil)
+		copy(ba.reqs[i+1:], ba.reqs[i:])
+		ba.reqs[i] = r
+		ba.numHigh++
+	} else {
+		ba.reqs = append(ba.reqs, r)
+	}
+	if r.priority == PriorityLow {
+		ba.numLow++
+	}
+	ba.size += r.size
+	ba.weight += r.weight
+	ba.cost += r.cost
+	ba.keys += r.keys
+	if cfg.MaxCommandSize > 0 && !ba.hasWrite {
+		ba.hasWrite = !roachpb.IsReadOnly(r.req)
+	}
+	if cfg.SpanTooWide != nil || cfg.OrderConflictingBatches {
+		if len(ba.reqs) == 1 {
+			ba.span = r.req.Header().Span()
+		} else {
+			ba.span = ba.span.Combine(r.req.Header().Span())
+		}
+	}
+	if r.maxWait > 0 || r.priority == PriorityHigh {
+		maxWait := r.maxWait
+		if r.priority == PriorityHigh && (maxWait <= 0 || cfg.HighPriorityMaxWait < maxWait) {
+			maxWait = cfg.HighPriorityMaxWait
+		}
+		reqDeadline := r.enqueueTime.Add(maxWait)
+		if ba.reqDeadline.IsZero() || reqDeadline.Before(ba.reqDeadline) {
+			ba.reqDeadline = reqDeadline
+		}
+	}
+	if cfg.FlushBeforeContextDeadline > 0 {
+		if ctxDeadline, ok := r.ctx.Deadline(); ok {
+			ctxDeadline = ctxDeadline.Add(-cfg.FlushBeforeContextDeadline)
+			if ba.ctxDeadline.IsZero() || ctxDeadline.Before(ba.ctxDeadline) {
+				ba.ctxDeadline = ctxDeadline
+			}
+		}
+	}
+	if r.priority != PriorityLow || len(ba.reqs) == 1 {
+		// Low priority requests do not reset the idle timer of a batch which
+		// already exists.
+		ba.lastUpdated = now
+	}
+	ba.deadline = time.Time{}
+	if r.exclusive {
+		ba.reason = flushSize
+		return true
+	}
+	if cfg.Policy != nil {
+		state := BatchState{ba: ba}
+		if cfg.Policy.ShouldFlush(state) {
+			ba.reason = flushPolicy
+			return true
+		}
+		ba.deadline = cfg.Policy.NextFlushTime(state)
+	} else {
+		allLow := ba.numLow == len(ba.reqs) && limits.MaxWait > 0
+		if limits.MaxIdle > 0 && len(ba.reqs) >= cfg.MinMsgsPerBatch && !allLow {
+			ba.deadline = ba.lastUpdated.Add(jittered(limits.MaxIdle, ba.jitter))
+		}
+		if limits.MaxWait > 0 {
+			waitDeadline := ba.startTime.Add(jittered(limits.MaxWait, ba.jitter))
+			if ba.deadline.IsZero() || waitDeadline.Before(ba.deadline) {
+				ba.deadline = waitDeadline
+			}
+		}
+	}
+	if !ba.reqDeadline.IsZero() && (ba.deadline.IsZero() || ba.reqDeadline.Before(ba.deadline)) {
+		ba.deadline = ba.reqDeadline
+	}
+	if !ba.ctxDeadline.IsZero() && (ba.deadline.IsZero() || ba.ctxDeadline.Before(ba.deadline)) {
+		ba.deadline = ba.ctxDeadline
+	}
+	if cfg.Policy == nil && limits.MaxMsgsPerBatch > 0 && ba.weight >= limits.MaxMsgsPerBatch {
+		ba.reason = flushSize
+		return true
+	}
+	if cfg.MaxSizePerBatch > 0 && ba.size >= cfg.MaxSizePerBatch {
+		ba.reason = flushBytes
+		return true
+	}
+	if cfg.MaxCostPerBatch > 0 && ba.cost >= cfg.MaxCostPerBatch {
+		ba.reason = flushCost
+		return true
+	}
+	if cfg.MaxKeysPerBatch > 0 && ba.keys >= cfg.MaxKeysPerBatch {
+		ba.reason = flushKeys
+		return true
+	}
+	return false
+}
+
+// flushBeforeAdding returns true, along with the reason, if ba must be sent
+// before r is added to it because adding r would cause ba to exceed the span
+// limit imposed by cfg.SpanTooWide, cfg.MaxKeysPerBatch or cfg.MaxCommandSize,
+// or because r is incompatible with ba according to cfg.CompatibilityRules or
+// SendOptions.Exclusive.
+func flushBeforeAdding(cfg *Config, ba *batch, r *request) (flushReason, bool) {
+	if r.exclusive {
+		return flushIncompatible, true
+	}
+	if cfg.SpanTooWide != nil && cfg.SpanTooWide(ba.span.Combine(r.req.Header().Span())) {
+		return flushSpan, true
+	}
+	if cfg.MaxKeysPerBatch > 0 && ba.keys+r.keys > cfg.MaxKeysPerBatch {
+		return flushKeys, true
+	}
+	if cfg.MaxCommandSize > 0 && ba.size+r.size > cfg.MaxCommandSize &&
+		(ba.hasWrite || !roachpb.IsReadOnly(r.req)) {
+		return flushBytes, true
+	}
+	if len(cfg.CompatibilityRules) > 0 && !compatible(cfg.CompatibilityRules, ba, r) {
+		return flushIncompatible, true
+	}
+	return 0, false
+}
+
+// estimateKeys returns the number of keys req is estimated to touch for the
+// purpose of enforcing cfg.MaxKeysPerBatch.
+func estimateKeys(cfg *Config, req roachpb.Request) int64 {
+	if cfg.KeyCount != nil {
+		return cfg.KeyCount(req)
+	}
+	if len(req.Header().EndKey) > 0 {
+		return cfg.MaxKeysPerBatch
+	}
+	return 1
+}
+
+// limits returns the Limits which apply to ba, accounting for its range's
+// overrides and for Config.AdaptiveMaxWait.
+func (s *shard) limits(ba *batch) *Limits {
+	limits := s.b.batchLimits(ba.overrides)
+	if !s.b.cfg.AdaptiveMaxWait || ba.adaptiveMaxWait <= 0 || ba.adaptiveMaxWait >= limits.MaxWait {
+		return limits
+	}
+	adjusted := *limits
+	adjusted.MaxWait = ba.adaptiveMaxWait
+	return &adjusted
+}
+
+// jittered returns d shortened by jitter without becoming negative.
+func jittered(d, jitter time.Duration) time.Duration {
+	if jitter >= d {
+		return 0
+	}
+	return d - jitter
+}
+
+// timerFlushReason returns the reason ba is being sent upon reaching its
+// deadline.
+func timerFlushReason(cfg *Config, limits *Limits, ba *batch) flushReason {
+	if !ba.ctxDeadline.IsZero() && !ba.ctxDeadline.After(ba.deadline) {
+		return flushDeadline
+	}
+	if !ba.reqDeadline.IsZero() && !ba.reqDeadline.After(ba.deadline) {
+		return flushMaxWait
+	}
+	if cfg.Policy != nil {
+		return flushPolicy
+	}
+	if limits.MaxWait > 0 && !ba.startTime.Add(jittered(limits.MaxWait, ba.jitter)).After(ba.deadline) {
+		return flushMaxWait
+	}
+	return flushMaxIdle
+}
+
+// dispatch sends ba if the in-flight limits allow, otherwise it is held until
+// an in-flight batch completes.
+func (s *shard) dispatch(ctx context.Context, ba *batch) {
+	s.batchSizeHint = nextBatchSizeHint(s.batchSizeHint, len(ba.reqs))
+	if !s.b.inFlight.tryAcquire(ba, s.ready) {
+		s.ready = append(s.ready, ba)
+		return
+	}
+	s.b.sendBatch(ctx, ba)
+}
+
+// nextBatchSizeHint folds a batch of n requests into the moving average hint.
+// Each step moves a quarter of the way towards n, rounded away from zero so
+// that the hint reaches a steady batch size. It never exceeds the size of the
+// largest batch folded in.
+func nextBatchSizeHint(hint, n int) int {
+	if n > hint {
+		return hint + (n-hint+3)/4
+	}
+	return hint - (hint-n+3)/4
+}
+
+// dispatchReady sends held batches until the in-flight limits are reached.
+func (s *shard) dispatchReady(ctx context.Context) {
+	for len(s.ready) > 0 {
+		i := s.b.inFlight.acquireReady(s.ready)
+		if i < 0 {
+			return
+		}
+		ba := s.ready[i]
+		copy(s.ready[i:], s.ready[i+1:])
+		s.ready[len(s.ready)-1] = nil
+		s.ready = s.ready[:len(s.ready)-1]
+		s.b.sendBatch(ctx, ba)
+	}
+}
+
+func (s *shard) cleanup(err error) {
+	b := s.b
+	s.queue.close()
+	s.failQueued(err)
+	for ba := s.batches.popFront(); ba != nil; ba = s.batches.popFront() {
+		b.failBatch(ba, err)
+	}
+	for _, ba := range s.ready {
+		b.failBatch(ba, err)
+	}
+	b.inFlight.releaseHeld(len(s.ready))
+	s.ready = nil
+}
+
+// addQueued adds the requests in the shard's queue to their batches.
+func (s *shard) addQueued(ctx context.Context) {
+	for req := s.queue.popAll(); req != nil; {
+		next := req.next
+		req.next = nil
+		s.add(ctx, req)
+		req = next
+	}
+}
+
+// add adds req, which was handed to the run loop by Send, to the batch for
+// its key and dispatches the batch if it is ready to be sent.
+func (s *shard) add(ctx context.Context, req *request) {
+	b := s.b
+	now := timeutil.Now()
+	// req must not be accessed once it has been dispatched.
+	rangeID := req.rangeID
+	// A request sent with SendGroup carries the requests of its group,
+	// which are added to the batch together.
+	single := [1]*request{req}
+	members := single[:]
+	if req.group != nil {
+		members, req.group = req.group, nil
+	}
+	ba, existsInQueue := s.batches.get(req.key())
+	if req.immediate {
+		// Immediate requests leave the pending batch for their key in the
+		// queue and are sent in a batch of their own.
+		existsInQueue = false
+	} else if existsInQueue {
+		for _, r := range members {
+			if reason, ok := flushBeforeAdding(&b.cfg, ba, r); ok {
+				s.batches.remove(ba)
+				ba.reason = reason
+				s.dispatch(ctx, ba)
+				existsInQueue = false
+				break
+			}
+		}
+	}
+	if !existsInQueue {
+		ba = b.pool.newBatch(now, s.batchSizeHint)
+		if b.cfg.RangeOverrides != nil {
+			ba.overrides = b.cfg.RangeOverrides(rangeID)
+		}
+		if b.cfg.FlushJitter > 0 {
+			ba.jitter = time.Duration(rand.Int63n(int64(b.cfg.FlushJitter)))
+		}
+		if b.prefetcher != nil {
+			b.prefetcher.maybePrefetch(req.req)
+		}
+	}
+	if b.cfg.AdaptiveMaxWait {
+		ba.adaptiveMaxWait = s.arrivals.observe(rangeID, now, b.batchLimits(ba.overrides).MaxWait)
+	}
+	limits := s.limits(ba)
+	var shouldSend bool
+	for _, r := range members {
+		shouldSend = addRequestToBatch(&b.cfg, limits, now, ba, r) || shouldSend
+	}
+	if req.immediate {
+		ba.reason = flushImmediate
+		shouldSend = true
+	}
+	if shouldSend {
+		if existsInQueue {
+			s.batches.remove(ba)
+		}
+		s.dispatch(ctx, ba)
+	} else {
+		s.batches.upsert(ba)
+	}
+	s.checkBackedUp(ctx, rangeID, now)
+}
+
+func (s *shard) run(ctx context.Context) {
+	b := s.b
+	// The timer is only armed while there are pending batches with a deadline.
+	// When there is nothing to send the loop blocks without any timer firing.
+	var deadline time.Time
+	timer := timeutil.NewTimer()
+	defer func() { timer.Stop() }()
+	maybeSetTimer := func() {
+		nextDeadline := s.batches.nextDeadline()
+		if !deadline.Equal(nextDeadline) || timer.Read {
+			deadline = nextDeadline
+			if !deadline.IsZero() {
+				timer.Reset(time.Until(deadline))
+			} else {
+				// Clear the current timer as the batch it was set for has already
+				// been sent.
+				timer.Stop()
+				timer = timeutil.NewTimer()
+			}
+		}
+	}
+	for {
+		select {
+		case <-s.queue.wake:
+			s.addQueued(ctx)
+			maybeSetTimer()
+		case <-timer.C:
+			timer.Read = true
+			now := timeutil.Now()
+			for ba := s.batches.popExpired(now); ba != nil; ba = s.batches.popExpired(now) {
+				ba.reason = timerFlushReason(&b.cfg, s.limits(ba), ba)
+				s.dispatch(ctx, ba)
+			}
+			maybeSetTimer()
+		case <-s.sendDone:
+			s.dispatchReady(ctx)
+			s.checkAllBackedUp(ctx, timeutil.Now())
+		case f := <-s.inspectChan:
+			// Requests queued before f was submitted must be observed by it.
+			s.addQueued(ctx)
+			f(ctx)
+			maybeSetTimer()
+		case <-b.cfg.Stopper.ShouldQuiesce():
+			s.cleanup(b.annotateError(ErrStopped))
+			return
+		case <-ctx.Done():
+			s.cleanup(ctx.Err())
+			return
+		}
+	}
+}
+
+type request struct {
+	ctx     context.Context
+	req     roachpb.Request
+	rangeID roachpb.RangeID
+	// done describes how the result of the request is delivered.
+	done completion
+
+	idempotent bool
+	// retries is the number of times the request has been requeued.
+	retries int
+	// failures is the number of consecutive failed batches after which the
+	// request has been queued again.
+	failures int
+	// isolated is set once the request reaches Config.MaxConsecutiveFailures
+	// and is sent in batches of its own.
+	isolated bool
+	// resumes is the number of times the remainder of the request's span has
+	// been queued after a response with a ResumeSpan.
+	resumes int
+	// partial is the combined response to the portions of the request's span
+	// which have been processed thus far, if the request has been resumed.
+	partial roachpb.Response
+	// next links the request to the one pushed after it once it has been
+	// taken from a shard's requestQueue, or before it while in the queue.
+	next *request
+	// group holds the requests, this one first, which were sent together
+	// with SendGroup. It is only set on the first request of a group until the
+	// group has been added to a batch.
+	group []*request
+	// caller is the Caller whose quota the request consumes, if any.
+	caller *Caller
+	// reservation is the Reservation from which the request consumed its
+	// queue capacity, if any.
+	reservation *Reservation
+	// maxWait is the request's SendOptions.MaxWait.
+	maxWait time.Duration
+	// priority is the request's SendOptions.Priority.
+	priority Priority
+	// userPriority is the request's SendOptions.UserPriority.
+	userPriority roachpb.UserPriority
+	// immediate is the request's SendOptions.Immediate.
+	immediate bool
+	// exclusive is the request's SendOptions.Exclusive.
+	exclusive bool
+	// union is the RequestUnion wrapping req if the request was sent with
+	// SendUnion.
+	union roachpb.RequestUnion
+	// dedupKey is set for requests sent with SendOptions.IdempotencyKey to
+	// which later requests with the same key may be attached.
+	dedupKey dedupKey
+	// target is the request's SendOptions.Target.
+	target roachpb.ReplicationTarget
+	// weight is the number of messages the request counts as toward
+	// MaxMsgsPerBatch, see SendOptions.Weight.
+	weight int
+	// readOnly is true if the request is read-only and is batched separately
+	// from writes, see Config.SeparateReadsAndWrites.
+	readOnly bool
+	// readConsistency is the consistency with which the request is evaluated.
+	readConsistency roachpb.ReadConsistencyType
+	// enqueueTime is the time at which the request was first added to a batch.
+	enqueueTime time.Time
+	// size is the size of req in bytes.
+	size int
+	// cost is the cost of req as estimated by Config.Cost.
+	cost int64
+	// keys is the number of keys req is estimated to touch, if
+	// Config.MaxKeysPerBatch is set.
+	keys int64
+	// fingerprint is the encoding of req at the time it was queued. It is only
+	// set in race builds for requests sent with SendOptions.NoCopy.
+	fingerprint []byte
+}
+
+type response struct {
+	resp roachpb.Response
+	err  error
+}
+
+type batch struct {
+	reqs []*request
+	size int // bytes
+	cost int64
+	keys int64
+	// weight is the total weight of the requests, see SendOptions.Weight.
+	weight int
+	// hasWrite is true if the batch contains a request which is not
+	// read-only. It is only maintained for use with Config.MaxCommandSize.
+	hasWrite bool
+	// span covers the keys of all of the requests in the batch. It is only
+	// maintained for use with Config.SpanTooWide and
+	// Config.OrderConflictingBatches.
+	span roachpb.Span
+
+	// numRetried is the number of requests at the front of reqs which are
+	// being retried.
+	numRetried int
+	// numHigh is the number of requests sent with PriorityHigh which follow
+	// the retried requests at the front of reqs.
+	numHigh int
+	// numLow is the number of requests in the batch sent with PriorityLow.
+	numLow int
+
+	// idx is the batch's index in the batchQueue.
+	idx int
+	// wheelTick is the tick at which the batch is scheduled on the timingWheel
+	// of its batchQueue, or 0 if it is not scheduled. wheelPrev and wheelNext
+	// link the batches scheduled in the same bucket.
+	wheelTick            int64
+	wheelPrev, wheelNext *batch
+
+	deadline    time.Time
+	startTime   time.Time
+	lastUpdated time.Time
+	// reqDeadline is the earliest of the deadlines imposed by the
+	// SendOptions.MaxWait of the requests in the batch, if any.
+	reqDeadline time.Time
+	// ctxDeadline is the earliest of the context deadlines of the requests in
+	// the batch less Config.FlushBeforeContextDeadline, if any.
+	ctxDeadline time.Time
+	// jitter is the amount by which Config.FlushJitter shortens the batch's
+	// MaxWait and MaxIdle.
+	jitter time.Duration
+	// adaptiveMaxWait is the batch's MaxWait as chosen by
+	// Config.AdaptiveMaxWait when its latest request was added.
+	adaptiveMaxWait time.Duration
+	// overrides are the Config.RangeOverrides for the batch's range at the
+	// time the batch was created.
+	overrides RangeOverrides
+
+	// reason is the reason the batch was sent. It is set by the run loop when
+	// the batch is dispatched.
+	reason flushReason
+	// flushed, if non-nil, is closed once the batch has been handed to the
+	// Sender or failed. It is created by FlushAll.
+	flushed chan struct{}
+}
+
+// batchKey identifies the batch to which a request is added.
+type batchKey struct {
+	rangeID         roachpb.RangeID
+	readConsistency roachpb.ReadConsistencyType
+	// target is set instead of rangeID for requests batched by node and
+	// store, see SendOptions.Target.
+	target roachpb.ReplicationTarget
+	// readOnly distinguishes batches of reads from batches of writes, see
+	// Config.SeparateReadsAndWrites.
+	readOnly bool
+	// userPriority is the SendOptions.UserPriority of the batch's requests.
+	userPriority roachpb.UserPriority
+}
+
+// readConsistencies are the values of batchKey.readConsistency.
+var readConsistencies = [...]roachpb.ReadConsistencyType{
+	roachpb.CONSISTENT, roachpb.READ_UNCOMMITTED, roachpb.INCONSISTENT,
+}
+
+func (r *request) key() batchKey {
+	return batchKey{
+		rangeID:         r.rangeID,
+		readConsistency: r.readConsistency,
+		target:          r.target,
+		readOnly:        r.readOnly,
+		userPriority:    r.userPriority,
+	}
+}
+
+func (b *batch) key() batchKey {
+	if len(b.reqs) == 0 {
+		panic("key cannot be called on an empty batch")
+	}
+	return b.reqs[0].key()
+}
+
+// flushedChan returns a channel which is closed once the batch has been handed
+// to the Sender or failed. It must be called by the owner of the batch.
+func (b *batch) flushedChan() chan struct{} {
+	if b.flushed == nil {
+		b.flushed = make(chan struct{})
+	}
+	return b.flushed
+}
+
+// markFlushed closes the batch's flushed channel, if any.
+func (b *batch) markFlushed() {
+	if b.flushed != nil {
+		close(b.flushed)
+		b.flushed = nil
+	}
+}
+
+func (b *batch) rangeID() roachpb.RangeID {
+	if len(b.reqs) == 0 {
+		panic("rangeID cannot be called on an empty batch")
+	}
+	return b.reqs[0].rangeID
+}
+
+// batchRequest assembles the BatchRequest for the batch using memory from a.
+// If ci is non-nil its requests are sent in place of those of the batch. The
+// returned BatchRequest must not be used after a is reset. It is called on
+// the goroutine which sends the batch rather than on the run loop.
+func (b *batch) batchRequest(a *batchArena, ci *coalescedBatch) roachpb.BatchRequest {
+	if cap(a.unions) < len(b.reqs) {
+		a.unions = make([]roachpb.RequestUnion, 0, len(b.reqs))
+	}
+	req := roachpb.BatchRequest{
+		Requests: a.unions[:0],
+	}
+	req.ReadConsistency = b.reqs[0].readConsistency
+	req.UserPriority = b.reqs[0].userPriority
+	if target := b.reqs[0].target; target != (roachpb.ReplicationTarget{}) {
+		req.Replica = roachpb.ReplicaDescriptor{NodeID: target.NodeID, StoreID: target.StoreID}
+	}
+	if ci != nil {
+		req.Add(ci.reqs...)
+	} else {
+		for _, r := range b.reqs {
+			if r.union.Value != nil {
+				req.Requests = append(req.Requests, r.union)
+			} else {
+				req.Add(r.req)
+			}
+		}
+	}
+	a.unions = req.Requests
+	return req
+}
+
+// batchArena holds the memory used to assemble the BatchRequest for a batch,
+// along with the batch's coalescedBatch if it was coalesced. Arenas are reused
+// across batches and reset once the batch's response has been demultiplexed,
+// at which point the Sender no longer references the BatchRequest.
+type batchArena struct {
+	unions    []roachpb.RequestUnion
+	coalesced coalescedBatch
+}
+
+func (a *batchArena) reset() {
+	for i := range a.unions {
+		a.unions[i] = roachpb.RequestUnion{}
+	}
+	a.unions = a.unions[:0]
+	a.coalesced.reset()
+}
+
+// pool stores object pools for the various commonly reused objects of the
+// batcher
+type pool struct {
+	responseChanPool sync.Pool
+	batchPool        sync.Pool
+	requestPool      sync.Pool
+	arenaPool        sync.Pool
+}
+
+func makePool() pool {
+	return pool{
+		responseChanPool: sync.Pool{
+			New: func() interface{} { return make(chan response, 1) },
+		},
+		batchPool: sync.Pool{
+			New: func() interface{} { return &batch{} },
+		},
+		requestPool: sync.Pool{
+			New: func() interface{} { return &request{} },
+		},
+		arenaPool: sync.Pool{
+			New: func() interface{} { return &batchArena{} },
+		},
+	}
+}
+
+func (p *pool) getResponseChan() chan response {
+	return p.responseChanPool.Get().(chan response)
+}
+
+func (p *pool) putResponseChan(r chan response) {
+	p.responseChanPool.Put(r)
+}
+
+func (p *pool) newRequest(
+	ctx context.Context,
+	rangeID roachpb.RangeID,
+	req roachpb.Request,
+	opts SendOptions,
+	responseChan chan<- response,
+) *request {
+	if !opts.NoCopy {
+		req = req.ShallowCopy()
+	}
+	r := p.requestPool.Get().(*request)
+	*r = request{
+		ctx:             ctx,
+		rangeID:         rangeID,
+		req:             req,
+		done:            completion{responseChan: responseChan},
+		idempotent:      opts.Idempotent,
+		size:            req.Size(),
+		readConsistency: opts.ReadConsistency,
+		maxWait:         opts.MaxWait,
+		priority:        opts.Priority,
+		userPriority:    opts.UserPriority,
+		immediate:       opts.Immediate,
+		exclusive:       opts.Exclusive,
+		union:           opts.union,
+		target:          opts.Target,
+		weight:          1,
+	}
+	if opts.Weight > 0 {
+		r.weight = opts.Weight
+	}
+	maybeFingerprint(r, opts.NoCopy)
+	return r
+}
+
+func (p *pool) putRequest(r *request) {
+	*r = request{}
+	p.requestPool.Put(r)
+}
+
+// newBatch returns an empty batch with room for at least sizeHint requests.
+func (p *pool) newBatch(now time.Time, sizeHint int) *batch {
+	ba := p.batchPool.Get().(*batch)
+	reqs := ba.reqs[:0]
+	if cap(reqs) < sizeHint {
+		reqs = make([]*request, 0, sizeHint)
+	}
+	*ba = batch{
+		reqs:      reqs,
+		startTime: now,
+		idx:       -1,
+	}
+	return ba
+}
+
+func (p *pool) putBatch(ba *batch) {
+	for i := range ba.reqs {
+		ba.reqs[i] = nil
+	}
+	*ba = batch{reqs: ba.reqs[:0]}
+	p.batchPool.Put(ba)
+}
+
+func (p *pool) getArena() *batchArena {
+	return p.arenaPool.Get().(*batchArena)
+}
+
+func (p *pool) putArena(a *batchArena) {
+	a.reset()
+	p.arenaPool.Put(a)
+}
+
+// batchQueue is a container for batch objects which offers O(1) get based on
+// batchKey as well as O(log(n)) upsert, removal, popFront and popExpired.
+// Batch structs are heap ordered inside of the batches slice based on their
+// deadline with the earliest deadline at the front and batches without a
+// deadline at the back. If the queue has a timingWheel then the batches slice
+// is unordered, the deadlines are held by the wheel and upsert, removal and
+// popFront are O(1).
+//
+// Note that the batch struct stores its index in the batches slice and is -1
+// when not part of the queue. The heap methods update the batch indices when
+// updating the heap. Take care not to ever put a batch in to multiple
+// batchQueues. Each shard of a RequestBatcher has its own batchQueue and a
+// range is only ever assigned to a single shard.
+type batchQueue struct {
+	batches []*batch
+	byKey   map[batchKey]*batch
+	// numUserPriority is the number of batches whose key has a non-zero
+	// userPriority.
+	numUserPriority int
+
+	// wheel, if non-nil, holds the deadlines of the batches; see
+	// Config.FlushTimerResolution.
+	wheel *timingWheel
+	// expired holds the batches which have been expired from the wheel and
+	// removed from the queue but not yet returned by popExpired.
+	expired []*batch
+}
+
+var _ heap.Interface = (*batchQueue)(nil)
+
+func makeBatchQueue(timerResolution time.Duration) batchQueue {
+	q := batchQueue{
+		byKey: map[batchKey]*batch{},
+	}
+	if timerResolution > 0 {
+		q.wheel = newTimingWheel(timerResolution, timeutil.Now())
+	}
+	return q
+}
+
+func (q *batchQueue) popFront() *batch {
+	if q.Len() == 0 {
+		return nil
+	}
+	if q.wheel != nil {
+		ba := q.batches[q.Len()-1]
+		q.remove(ba)
+		return ba
+	}
+	return heap.Pop(q).(*batch)
+}
+
+// nextDeadline returns the time at which popExpired should next be called, or
+// the zero time if no batch has a deadline.
+func (q *batchQueue) nextDeadline() time.Time {
+	if q.wheel != nil {
+		return q.wheel.nextTick()
+	}
+	// Batches without a deadline sort last, so the front only lacks a
+	// deadline if none of the batches has one.
+	if q.Len() == 0 {
+		return time.Time{}
+	}
+	return q.batches[0].deadline
+}
+
+// popExpired removes and returns a batch whose deadline is no later than now,
+// or returns nil if there is none.
+func (q *batchQueue) popExpired(now time.Time) *batch {
+	if q.wheel == nil {
+		if q.Len() == 0 {
+			return nil
+		}
+		if ba := q.batches[0]; ba.deadline.IsZero() || ba.deadline.After(now) {
+			return nil
+		}
+		return heap.Pop(q).(*batch)
+	}
+	if len(q.expired) == 0 {
+		q.expired = q.wheel.expire(now, q.expired)
+		for _, ba := range q.expired {
+			q.remove(ba)
+		}
+	}
+	n := len(q.expired)
+	if n == 0 {
+		return nil
+	}
+	ba := q.expired[n-1]
+	q.expired[n-1] = nil
+	q.expired = q.expired[:n-1]
+	return ba
+}
+
+func (q *batchQueue) get(key batchKey) (*batch, bool) {
+	b, exists := q.byKey[key]
+	return b, exists
+}
+
+// forRange calls fn for each of the batches to rangeID.
+func (q *batchQueue) forRange(rangeID roachpb.RangeID, fn func(*batch)) {
+	for _, rc := range readConsistencies {
+		for _, readOnly := range []bool{false, true} {
+			if ba, ok := q.get(batchKey{rangeID: rangeID, readConsistency: rc, readOnly: readOnly}); ok {
+				fn(ba)
+			}
+		}
+	}
+	if q.numUserPriority == 0 {
+		return
+	}
+	// The user priorities of batches cannot be enumerated, so batches with a
+	// user priority are found by scanning the queue.
+	for _, ba := range q.batches {
+		if key := ba.key(); key.userPriority != 0 && key.rangeID == rangeID &&
+			key.target == (roachpb.ReplicationTarget{}) {
+			fn(ba)
+		}
+	}
+}
+
+func (q *batchQueue) remove(ba *batch) {
+	if q.wheel != nil {
+		q.wheel.unschedule(ba)
+		if last := q.Len() - 1; ba.idx != last {
+			q.Swap(ba.idx, last)
+		}
+		q.Pop()
+		return
+	}
+	delete(q.byKey, ba.key())
+	heap.Remove(q, ba.idx)
+}
+
+func (q *batchQueue) upsert(ba *batch) {
+	if q.wheel != nil {
+		if ba.idx < 0 {
+			q.Push(ba)
+		}
+		q.wheel.unschedule(ba)
+		q.wheel.schedule(ba)
+		return
+	}
+	if ba.idx >= 0 {
+		heap.Fix(q, ba.idx)
+	} else {
+		heap.Push(q, ba)
+	}
+}
+
+func (q *batchQueue) Len() int {
+	return len(q.batches)
+}
+
+func (q *batchQueue) Swap(i, j int) {
+	q.batches[i], q.batches[j] = q.batches[j], q.batches[i]
+	q.batches[i].idx = i
+	q.batches[j].idx = j
+}
+
+// Less orders batches by deadline. Batches without a deadline sort after all
+// of those with one so that they never hide the earliest deadline from
+// nextDeadline and popExpired.
+func (q *batchQueue) Less(i, j int) bool {
+	di, dj := q.batches[i].deadline, q.batches[j].deadline
+	if di.IsZero() || dj.IsZero() {
+		return !di.IsZero()
+	}
+	return di.Before(dj)
+}
+
+func (q *batchQueue) Push(v interface{}) {
+	ba := v.(*batch)
+	ba.idx = len(q.batches)
+	key := ba.key()
+	q.byKey[key] = ba
+	if key.userPriority != 0 {
+		q.numUserPriority++
+	}
+	q.batches = append(q.batches, ba)
+}
+
+func (q *batchQueue) Pop() interface{} {
+	ba := q.batches[len(q.batches)-1]
+	q.batches = q.batches[:len(q.batches)-1]
+	key := ba.key()
+	delete(q.byKey, key)
+	if key.userPriority != 0 {
+		q.numUserPriority--
+	}
+	ba.idx = -1
+	return ba
+}
@@ -0,0 +1,3942 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
+)
+
+type batchResp struct {
+	br *roachpb.BatchResponse
+	pe *roachpb.Error
+}
+
+type batchSend struct {
+	ba       roachpb.BatchRequest
+	respChan chan<- batchResp
+}
+
+type chanSender chan batchSend
+
+func (c chanSender) Send(
+	ctx context.Context, ba roachpb.BatchRequest,
+) (*roachpb.BatchResponse, *roachpb.Error) {
+	respChan := make(chan batchResp)
+	select {
+	case c <- batchSend{ba: ba, respChan: respChan}:
+	case <-ctx.Done():
+		return nil, roachpb.NewError(ctx.Err())
+	}
+	resp := <-respChan
+	return resp.br, resp.pe
+}
+
+func TestBatcherSend(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxIdle:         50 * time.Millisecond,
+		MaxWait:         50 * time.Millisecond,
+		MaxMsgsPerBatch: 3,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func(rangeID roachpb.RangeID, request roachpb.Request) {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, request)
+			return err
+		})
+	}
+	// Send 3 requests to range 2 and 2 to range 1.
+	// The 3rd range 2 request will trigger immediate sending due to the
+	// MaxMsgsPerBatch configuration. The range 1 batch will be sent after the
+	// MaxWait timeout expires.
+	sendRequest(1, &roachpb.GetRequest{})
+	sendRequest(2, &roachpb.GetRequest{})
+	sendRequest(1, &roachpb.GetRequest{})
+	sendRequest(2, &roachpb.GetRequest{})
+	sendRequest(2, &roachpb.GetRequest{})
+	// Wait for the range 2 request and ensure it contains 3 requests.
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 3)
+	s.respChan <- batchResp{}
+	// Wait for the range 1 request and ensure it contains 2 requests.
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{}
+	// Make sure everything gets a response.
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+}
+
+func TestSendAfterStopped(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	sc := make(chanSender)
+	b := New(Config{
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	stopper.Stop(context.Background())
+	_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+	assert.Equal(t, err, ErrStopped)
+}
+
+func TestSendAfterCanceled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	sc := make(chanSender)
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	b := New(Config{
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := b.Send(ctx, 1, &roachpb.GetRequest{})
+	assert.Equal(t, err, ctx.Err())
+}
+
+func TestStopDuringSend(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	sc := make(chanSender, 1)
+	b := New(Config{
+		Sender:  sc,
+		Stopper: stopper,
+		MaxWait: 10 * time.Millisecond,
+		MaxIdle: 10 * time.Millisecond,
+	})
+	errChan := make(chan error)
+	go func() {
+		_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+		errChan <- err
+	}()
+	r := <-sc
+	go stopper.Stop(context.Background())
+	assert.Equal(t, <-errChan, ErrStopped)
+	r.respChan <- batchResp{}
+}
+
+func TestPanicWithNilStopper(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("failed to panic with a nil Stopper")
+		}
+	}()
+	New(Config{Sender: make(chanSender)})
+}
+
+func TestTimeoutDisabled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func(rangeID roachpb.RangeID, request roachpb.Request) {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, request)
+			return err
+		})
+	}
+	// Send 3 requests to range 2 and 2 to range 1.
+	// The 3rd range 2 request will trigger immediate sending due to the
+	// MaxMsgsPerBatch configuration. The range 1 batch will be sent after the
+	// MaxWait timeout expires.
+	sendRequest(1, &roachpb.GetRequest{})
+	select {
+	case <-sc:
+		t.Fatalf("RequestBatcher should not sent based on time")
+	case <-time.After(10 * time.Millisecond):
+	}
+	sendRequest(1, &roachpb.GetRequest{})
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{}
+	// Make sure everything gets a response.
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+}
+
+func TestPanicWithNilSender(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("failed to panic with a nil Sender")
+		}
+	}()
+	New(Config{Stopper: stop.NewStopper()})
+}
+
+func TestAmbiguousRetryIdempotent(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:     2,
+		MaxAmbiguousRetries: 1,
+		Sender:              sc,
+		Stopper:             stopper,
+	})
+	ambiguous := roachpb.NewError(roachpb.NewAmbiguousResultError("boom"))
+	send := func(rangeID roachpb.RangeID, idempotent bool) chan error {
+		errChan := make(chan error, 1)
+		go func() {
+			_, err := b.SendWithOptions(context.Background(), rangeID, &roachpb.GetRequest{},
+				SendOptions{Idempotent: idempotent})
+			errChan <- err
+		}()
+		return errChan
+	}
+	// A batch made up entirely of idempotent requests is retried.
+	idem1, idem2 := send(1, true), send(1, true)
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{pe: ambiguous}
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{}
+	assert.Nil(t, <-idem1)
+	assert.Nil(t, <-idem2)
+	// A batch which has exhausted its retries returns the ambiguous error.
+	idem1, idem2 = send(1, true), send(1, true)
+	for i := 0; i < 2; i++ {
+		s = <-sc
+		s.respChan <- batchResp{pe: ambiguous}
+	}
+	assert.IsType(t, &roachpb.AmbiguousResultError{}, <-idem1)
+	assert.IsType(t, &roachpb.AmbiguousResultError{}, <-idem2)
+	// A batch containing a non-idempotent request is not retried.
+	idem, nonIdem := send(2, true), send(2, false)
+	s = <-sc
+	s.respChan <- batchResp{pe: ambiguous}
+	assert.IsType(t, &roachpb.AmbiguousResultError{}, <-idem)
+	assert.IsType(t, &roachpb.AmbiguousResultError{}, <-nonIdem)
+}
+
+func TestAmbiguousPolicy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	ambiguous := roachpb.NewError(roachpb.NewAmbiguousResultError("boom"))
+	send := func(b *RequestBatcher, key string) *Future {
+		return b.SendFuture(context.Background(), 1, &roachpb.PutRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+		}, SendOptions{Idempotent: true})
+	}
+	// The error is surfaced even though the request is idempotent.
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:     1,
+		MaxAmbiguousRetries: 1,
+		AmbiguousPolicy:     AmbiguousSurface,
+		Sender:              sc,
+		Stopper:             stopper,
+	})
+	f := send(b, "a")
+	s := <-sc
+	s.respChan <- batchResp{pe: ambiguous}
+	_, err := f.Result()
+	assert.IsType(t, &roachpb.AmbiguousResultError{}, err)
+	// Each request is resolved individually.
+	b = New(Config{
+		MaxMsgsPerBatch: 3,
+		MaxWait:         100 * time.Millisecond,
+		AmbiguousPolicy: AmbiguousResolve,
+		ResolveAmbiguous: func(_ context.Context, req roachpb.Request) (bool, error) {
+			switch string(req.Header().Key) {
+			case "applied":
+				return true, nil
+			case "lost":
+				return false, nil
+			default:
+				return false, errors.New("unknown")
+			}
+		},
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	applied, lost, unknown := send(b, "applied"), send(b, "lost"), send(b, "unknown")
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 3)
+	s.respChan <- batchResp{pe: ambiguous}
+	resp, err := applied.Result()
+	assert.Nil(t, err)
+	assert.IsType(t, &roachpb.PutResponse{}, resp)
+	_, err = unknown.Result()
+	assert.Regexp(t, "unknown", err)
+	// The request which was not applied is sent again.
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 1)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	_, err = lost.Result()
+	assert.Nil(t, err)
+}
+
+func TestRetriedRequestsAtFront(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	cfg := Config{MaxWait: time.Second}
+	limits := Limits{MaxWait: cfg.MaxWait}
+	p := makePool()
+	start := time.Unix(10, 0)
+	ba := p.newBatch(start, 0)
+	newRequest := func(key string) *request {
+		return p.newRequest(context.Background(), 1, &roachpb.GetRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+		}, SendOptions{}, nil)
+	}
+	a, b, c := newRequest("a"), newRequest("b"), newRequest("c")
+	addRequestToBatch(&cfg, &limits, start, ba, a)
+	addRequestToBatch(&cfg, &limits, start, ba, b)
+	assert.Equal(t, start.Add(time.Second), ba.deadline)
+	// A retried request which was first enqueued before the batch started is
+	// placed at the front and the batch's MaxWait is measured from when the
+	// retried request was first enqueued.
+	c.retries = 1
+	c.enqueueTime = start.Add(-time.Second)
+	addRequestToBatch(&cfg, &limits, start.Add(time.Millisecond), ba, c)
+	assert.Equal(t, []*request{c, a, b}, ba.reqs)
+	assert.Equal(t, start, ba.deadline)
+}
+
+func TestMinMsgsPerBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	cfg := Config{MaxWait: time.Second, MaxIdle: time.Millisecond, MinMsgsPerBatch: 3}
+	limits := Limits{MaxWait: cfg.MaxWait, MaxIdle: cfg.MaxIdle}
+	p := makePool()
+	start := time.Unix(10, 0)
+	ba := p.newBatch(start, 0)
+	add := func(now time.Time) {
+		addRequestToBatch(&cfg, &limits, now, ba, p.newRequest(
+			context.Background(), 1, &roachpb.GetRequest{}, SendOptions{}, nil))
+	}
+	// Below MinMsgsPerBatch only MaxWait applies.
+	add(start)
+	add(start.Add(time.Millisecond))
+	assert.Equal(t, start.Add(time.Second), ba.deadline)
+	assert.Equal(t, flushMaxWait, timerFlushReason(&cfg, &limits, ba))
+	// Once MinMsgsPerBatch is reached MaxIdle applies as well.
+	add(start.Add(2 * time.Millisecond))
+	assert.Equal(t, start.Add(3*time.Millisecond), ba.deadline)
+	assert.Equal(t, flushMaxIdle, timerFlushReason(&cfg, &limits, ba))
+}
+
+// checkBatchWithoutDeadline queues a request to r1 whose batch has no
+// deadline followed by numRequests requests sent with opts to r2, on the same
+// shard, whose batch has one. The batch to r2 must be sent by its deadline
+// while the batch to r1 keeps waiting.
+func checkBatchWithoutDeadline(t *testing.T, cfg Config, numRequests int, opts SendOptions) {
+	t.Helper()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	cfg.Sender = sc
+	cfg.Stopper = stopper
+	b := New(cfg)
+	ctx := context.Background()
+	waiting := b.SendFuture(ctx, 1, &roachpb.GetRequest{}, SendOptions{})
+	var sent []*Future
+	for i := 0; i < numRequests; i++ {
+		sent = append(sent, b.SendFuture(ctx, 2, &roachpb.GetRequest{}, opts))
+	}
+	select {
+	case s := <-sc:
+		assert.Len(t, s.ba.Requests, numRequests)
+		s.respChan <- batchResp{br: s.ba.CreateReply()}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the batch with a deadline was not sent")
+	}
+	for _, f := range sent {
+		_, err := f.Result()
+		assert.Nil(t, err)
+	}
+	select {
+	case <-waiting.Done():
+		t.Fatal("the batch without a deadline was sent")
+	default:
+	}
+}
+
+func TestMinMsgsPerBatchWithoutMaxWait(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Below MinMsgsPerBatch a batch has no deadline without MaxWait.
+	checkBatchWithoutDeadline(t, Config{
+		MaxIdle:         time.Millisecond,
+		MinMsgsPerBatch: 2,
+	}, 2, SendOptions{})
+}
+
+func TestBatchQueueWithoutDeadlines(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := makePool()
+	q := makeBatchQueue(0)
+	start := time.Unix(10, 0)
+	newBatch := func(rangeID roachpb.RangeID, deadline time.Time) *batch {
+		ba := p.newBatch(start, 0)
+		ba.reqs = append(ba.reqs, p.newRequest(
+			context.Background(), rangeID, &roachpb.GetRequest{}, SendOptions{}, nil))
+		ba.deadline = deadline
+		q.upsert(ba)
+		return ba
+	}
+	newBatch(1, time.Time{})
+	second := newBatch(2, start.Add(2*time.Second))
+	first := newBatch(3, start.Add(time.Second))
+	newBatch(4, time.Time{})
+	assert.Equal(t, start.Add(time.Second), q.nextDeadline())
+	assert.Nil(t, q.popExpired(start))
+	assert.Equal(t, first, q.popExpired(start.Add(time.Second)))
+	assert.Equal(t, second.deadline, q.nextDeadline())
+	assert.Equal(t, second, q.popExpired(start.Add(time.Hour)))
+	// Only batches without a deadline remain.
+	assert.Equal(t, time.Time{}, q.nextDeadline())
+	assert.Nil(t, q.popExpired(start.Add(time.Hour)))
+	assert.Equal(t, 2, q.Len())
+}
+
+func TestSendOptionsPriority(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	cfg := Config{MaxWait: time.Second, MaxIdle: 10 * time.Millisecond, HighPriorityMaxWait: time.Millisecond}
+	limits := Limits{MaxWait: cfg.MaxWait, MaxIdle: cfg.MaxIdle}
+	p := makePool()
+	start := time.Unix(10, 0)
+	ba := p.newBatch(start, 0)
+	add := func(now time.Time, key string, priority Priority) {
+		addRequestToBatch(&cfg, &limits, now, ba, p.newRequest(context.Background(), 1,
+			&roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)}},
+			SendOptions{Priority: priority}, nil))
+	}
+	// A batch of low priority requests ignores MaxIdle.
+	add(start, "a", PriorityLow)
+	add(start.Add(time.Millisecond), "b", PriorityLow)
+	assert.Equal(t, start.Add(time.Second), ba.deadline)
+	assert.Equal(t, flushMaxWait, timerFlushReason(&cfg, &limits, ba))
+	// Normal priority requests make MaxIdle apply.
+	add(start.Add(2*time.Millisecond), "c", PriorityNormal)
+	assert.Equal(t, start.Add(12*time.Millisecond), ba.deadline)
+	// Low priority requests do not reset the idle timer.
+	add(start.Add(5*time.Millisecond), "d", PriorityLow)
+	assert.Equal(t, start.Add(12*time.Millisecond), ba.deadline)
+	assert.Equal(t, flushMaxIdle, timerFlushReason(&cfg, &limits, ba))
+	// High priority requests move to the front of the batch and bring its
+	// deadline forward.
+	add(start.Add(6*time.Millisecond), "e", PriorityHigh)
+	add(start.Add(7*time.Millisecond), "f", PriorityHigh)
+	assert.Equal(t, start.Add(7*time.Millisecond), ba.deadline)
+	assert.Equal(t, flushMaxWait, timerFlushReason(&cfg, &limits, ba))
+	var keys []string
+	for _, r := range ba.reqs {
+		keys = append(keys, string(r.req.Header().Key))
+	}
+	assert.Equal(t, []string{"e", "f", "a", "b", "c", "d"}, keys)
+}
+
+func TestFlushBeforeContextDeadline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	cfg := Config{MaxWait: time.Second, FlushBeforeContextDeadline: 10 * time.Millisecond}
+	limits := Limits{MaxWait: cfg.MaxWait}
+	p := makePool()
+	start := time.Unix(10, 0)
+	ba := p.newBatch(start, 0)
+	add := func(ctx context.Context) {
+		addRequestToBatch(&cfg, &limits, start, ba, p.newRequest(
+			ctx, 1, &roachpb.GetRequest{}, SendOptions{}, nil))
+	}
+	add(context.Background())
+	assert.Equal(t, start.Add(time.Second), ba.deadline)
+	// A request whose context expires before MaxWait moves the batch's
+	// deadline ahead of its own.
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(100*time.Millisecond))
+	defer cancel()
+	add(ctx)
+	assert.Equal(t, start.Add(90*time.Millisecond), ba.deadline)
+	assert.Equal(t, flushDeadline, timerFlushReason(&cfg, &limits, ba))
+}
+
+func TestFlushJitter(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	cfg := Config{MaxWait: time.Second, MaxIdle: 100 * time.Millisecond, FlushJitter: 500 * time.Millisecond}
+	limits := Limits{MaxWait: cfg.MaxWait, MaxIdle: cfg.MaxIdle}
+	p := makePool()
+	start := time.Unix(10, 0)
+	ba := p.newBatch(start, 0)
+	ba.jitter = 50 * time.Millisecond
+	add := func(now time.Time) {
+		addRequestToBatch(&cfg, &limits, now, ba, p.newRequest(
+			context.Background(), 1, &roachpb.GetRequest{}, SendOptions{}, nil))
+	}
+	// Both MaxIdle and MaxWait are shortened by the batch's jitter.
+	add(start)
+	assert.Equal(t, start.Add(50*time.Millisecond), ba.deadline)
+	assert.Equal(t, flushMaxIdle, timerFlushReason(&cfg, &limits, ba))
+	add(start.Add(900 * time.Millisecond))
+	assert.Equal(t, start.Add(950*time.Millisecond), ba.deadline)
+	assert.Equal(t, flushMaxWait, timerFlushReason(&cfg, &limits, ba))
+}
+
+func TestAdaptiveMaxWait(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	const maxWait = 100 * time.Millisecond
+	var a arrivalRates
+	now := time.Unix(10, 0)
+	// A range without a history waits the full MaxWait.
+	assert.Equal(t, maxWait, a.observe(1, now, maxWait))
+	// Sparse arrivals shorten it in proportion to the expected arrivals.
+	now = now.Add(time.Second)
+	assert.Equal(t, 2500*time.Microsecond, a.observe(1, now, maxWait))
+	// Dense arrivals lengthen it back to MaxWait.
+	var wait time.Duration
+	for i := 0; i < 30; i++ {
+		now = now.Add(time.Millisecond)
+		wait = a.observe(1, now, maxWait)
+	}
+	assert.Equal(t, maxWait, wait)
+	// Ranges which receive no requests are eventually forgotten.
+	now = now.Add(2 * arrivalStateTTL)
+	a.sweep(now)
+	assert.Len(t, a.ranges, 0)
+}
+
+// TestNoTimerAfterSizeFlush ensures that when the only pending batch is sent
+// due to its size the timer which was armed for it does not fire.
+func TestNoTimerAfterSizeFlush(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		MaxWait:         5 * time.Millisecond,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	var g errgroup.Group
+	for i := 0; i < 2; i++ {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+	select {
+	case s := <-sc:
+		t.Fatalf("unexpected batch sent with %d requests", len(s.ba.Requests))
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSaturation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:    4,
+		MaxPendingRequests: 2,
+		Sender:             sc,
+		Stopper:            stopper,
+	})
+	assert.Equal(t, 0.0, b.Saturation())
+	var g errgroup.Group
+	sendRequest := func() {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	sendRequest()
+	testutils.SucceedsSoon(t, func() error {
+		if s := b.Saturation(); s != 0.5 {
+			return errors.Errorf("expected saturation 0.5, got %v", s)
+		}
+		return nil
+	})
+	sendRequest()
+	testutils.SucceedsSoon(t, func() error {
+		if s := b.Saturation(); s != 1 {
+			return errors.Errorf("expected saturation 1, got %v", s)
+		}
+		return nil
+	})
+	// The queue is full so additional requests are rejected.
+	_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+	assert.Equal(t, ErrQueueFull, err)
+	// Disabling the timers means that the batch is only sent at shutdown.
+	stopper.Quiesce(context.Background())
+	if err := g.Wait(); err != ErrStopped {
+		t.Fatalf("expected %v, got %v", ErrStopped, err)
+	}
+	testutils.SucceedsSoon(t, func() error {
+		if s := b.Saturation(); s != 0 {
+			return errors.Errorf("expected saturation 0, got %v", s)
+		}
+		return nil
+	})
+}
+
+func TestLazyStart(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 1,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	assert.Equal(t, 0, stopper.NumTasks())
+	errChan := make(chan error)
+	go func() {
+		_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+		errChan <- err
+	}()
+	s := <-sc
+	assert.Equal(t, 1, stopper.NumTasks())
+	s.respChan <- batchResp{}
+	assert.Nil(t, <-errChan)
+}
+
+func TestBatcherSendSharded(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		NumShards:       4,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	var g errgroup.Group
+	const numRanges = 8
+	for i := 0; i < 2*numRanges; i++ {
+		rangeID := roachpb.RangeID(i%numRanges + 1)
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	for i := 0; i < numRanges; i++ {
+		s := <-sc
+		assert.Len(t, s.ba.Requests, 2)
+		s.respChan <- batchResp{}
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+	assert.Equal(t, 4, stopper.NumTasks())
+}
+
+func TestSendPoolScaling(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:       1,
+		MaxSendWorkers:        2,
+		SendWorkerIdleTimeout: time.Millisecond,
+		Sender:                sc,
+		Stopper:               stopper,
+	})
+	var g errgroup.Group
+	for i := 1; i <= 3; i++ {
+		rangeID := roachpb.RangeID(i)
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	// Only two batches may be in the Sender at a time.
+	s1, s2 := <-sc, <-sc
+	assert.Equal(t, 2, b.sendPool.numWorkers())
+	select {
+	case <-sc:
+		t.Fatalf("expected at most 2 concurrent sends")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s1.respChan <- batchResp{}
+	s3 := <-sc
+	s2.respChan <- batchResp{}
+	s3.respChan <- batchResp{}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+	// Once idle the pool shrinks back to a single worker.
+	testutils.SucceedsSoon(t, func() error {
+		if n := b.sendPool.numWorkers(); n != 1 {
+			return errors.Errorf("expected 1 worker, got %d", n)
+		}
+		return nil
+	})
+}
+
+// TestSendPoolQuiesce ensures that the batches in the backlog of the send
+// pool when the batcher stops are failed and no longer counted as in flight.
+func TestSendPoolQuiesce(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	started := make(chan struct{}, 1)
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-stopper.ShouldQuiesce()
+		return nil, roachpb.NewErrorf("quiescing")
+	})
+	b := New(Config{
+		MaxMsgsPerBatch: 1,
+		MaxSendWorkers:  1,
+		Sender:          sender,
+		Stopper:         stopper,
+	})
+	var futures []*Future
+	for i := 1; i <= 3; i++ {
+		futures = append(futures,
+			b.SendFuture(context.Background(), roachpb.RangeID(i), &roachpb.GetRequest{}, SendOptions{}))
+	}
+	// The first batch occupies the only worker and the others are backlogged.
+	<-started
+	testutils.SucceedsSoon(t, func() error {
+		if inFlight := b.InFlight(); inFlight.Batches != 3 {
+			return errors.Errorf("expected 3 batches in flight, got %+v", inFlight)
+		}
+		return nil
+	})
+	stopper.Stop(context.Background())
+	assert.Equal(t, InFlight{}, b.InFlight())
+	for _, f := range futures[1:] {
+		_, err := f.Result()
+		assert.Equal(t, ErrStopped, errors.Cause(err))
+	}
+}
+
+func TestSendPoolBacklogBounded(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	started := make(chan struct{}, 1)
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-stopper.ShouldQuiesce()
+		return nil, roachpb.NewErrorf("quiescing")
+	})
+	b := New(Config{
+		MaxMsgsPerBatch: 1,
+		MaxSendWorkers:  1,
+		Sender:          sender,
+		Stopper:         stopper,
+	})
+	maxBacklog := b.sendPool.maxBacklog
+	backlog := func() int {
+		b.sendPool.mu.Lock()
+		defer b.sendPool.mu.Unlock()
+		return len(b.sendPool.mu.backlog)
+	}
+	var futures []*Future
+	for i := 1; i <= maxBacklog+3; i++ {
+		futures = append(futures,
+			b.SendFuture(context.Background(), roachpb.RangeID(i), &roachpb.GetRequest{}, SendOptions{}))
+	}
+	// The first batch occupies the only worker and the backlog fills up, after
+	// which the run loop waits rather than growing it further.
+	<-started
+	testutils.SucceedsSoon(t, func() error {
+		if n := backlog(); n != maxBacklog {
+			return errors.Errorf("expected %d backlogged batches, got %d", maxBacklog, n)
+		}
+		return nil
+	})
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, maxBacklog, backlog())
+	// The batch waiting for room fails once the batcher stops.
+	stopper.Stop(context.Background())
+	assert.Equal(t, InFlight{}, b.InFlight())
+	for _, f := range futures[1:] {
+		_, err := f.Result()
+		assert.Equal(t, ErrStopped, errors.Cause(err))
+	}
+}
+
+// TestSlowRangeDoesNotBlockOthers ensures that batches to a range which has
+// reached its in-flight limit are held while batches to other ranges are sent.
+func TestSlowRangeDoesNotBlockOthers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:            1,
+		MaxInFlightBatchesPerRange: 1,
+		Sender:                     sc,
+		Stopper:                    stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func(rangeID roachpb.RangeID) {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	sendRequest(1)
+	slow := <-sc
+	sendRequest(1)
+	sendRequest(2)
+	// The range 2 batch is sent while the range 1 batch is outstanding.
+	s := <-sc
+	assert.Equal(t, 1, b.InFlightForRange(2))
+	s.respChan <- batchResp{}
+	select {
+	case <-sc:
+		t.Fatalf("expected the second range 1 batch to be held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	testutils.SucceedsSoon(t, func() error {
+		if inFlight := b.InFlight(); inFlight.Batches != 1 || inFlight.Requests != 1 || inFlight.Held != 1 {
+			return errors.Errorf("expected 1 batch in flight and 1 held, got %+v", inFlight)
+		}
+		return nil
+	})
+	// Raising the per-range limit sends the held batch.
+	b.SetLimits(Limits{MaxMsgsPerBatch: 1, MaxInFlightBatchesPerRange: 2})
+	s = <-sc
+	assert.Equal(t, 2, b.InFlightForRange(1))
+	s.respChan <- batchResp{}
+	slow.respChan <- batchResp{}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+}
+
+// TestOrderConflictingBatches ensures that a batch which overlaps a batch to
+// the same range which is in flight is held while non-conflicting batches to
+// the range are sent.
+func TestOrderConflictingBatches(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:         1,
+		OrderConflictingBatches: true,
+		Sender:                  sc,
+		Stopper:                 stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func(key string) {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), 1, &roachpb.PutRequest{
+				RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+			})
+			return err
+		})
+	}
+	key := func(s batchSend) string {
+		return string(s.ba.Requests[0].GetInner().Header().Key)
+	}
+	sendRequest("a")
+	first := <-sc
+	sendRequest("a")
+	testutils.SucceedsSoon(t, func() error {
+		if held := b.InFlight().Held; held != 1 {
+			return errors.Errorf("expected 1 held batch, got %d", held)
+		}
+		return nil
+	})
+	// A batch to other keys of the range is sent while the conflicting batch
+	// is held.
+	sendRequest("b")
+	s := <-sc
+	assert.Equal(t, "b", key(s))
+	assert.Equal(t, 2, b.InFlightForRange(1))
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	select {
+	case <-sc:
+		t.Fatalf("expected the conflicting batch to be held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	first.respChan <- batchResp{br: first.ba.CreateReply()}
+	s = <-sc
+	assert.Equal(t, "a", key(s))
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+}
+
+// TestInFlightLimitPrefersIdleRanges ensures that when the batcher-wide
+// in-flight limit is reached, held batches to ranges with fewer batches in
+// flight are sent first.
+func TestInFlightLimitPrefersIdleRanges(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:    1,
+		MaxInFlightBatches: 2,
+		Sender:             sc,
+		Stopper:            stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func(rangeID roachpb.RangeID) {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	sendRequest(1)
+	sendRequest(1)
+	s1, s2 := <-sc, <-sc
+	assert.Equal(t, 1.0, b.Saturation())
+	waitForHeld := func(exp int) {
+		testutils.SucceedsSoon(t, func() error {
+			if n := b.inFlight.numHeld(); n != exp {
+				return errors.Errorf("expected %d held batches, got %d", exp, n)
+			}
+			return nil
+		})
+	}
+	sendRequest(1)
+	waitForHeld(1)
+	sendRequest(2)
+	waitForHeld(2)
+	s1.respChan <- batchResp{}
+	s := <-sc
+	assert.Equal(t, 1, b.inFlight.numBatchesForRange(2))
+	s.respChan <- batchResp{}
+	s2.respChan <- batchResp{}
+	s = <-sc
+	s.respChan <- batchResp{}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+}
+
+func TestMaxInFlightRequests(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:     2,
+		MaxInFlightRequests: 3,
+		Sender:              sc,
+		Stopper:             stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func(rangeID roachpb.RangeID) {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	sendRequest(1)
+	sendRequest(1)
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	// The range 2 batch would put 4 requests in flight so it is held.
+	sendRequest(2)
+	sendRequest(2)
+	testutils.SucceedsSoon(t, func() error {
+		if n := b.inFlight.numHeld(); n != 1 {
+			return errors.Errorf("expected 1 held batch, got %d", n)
+		}
+		return nil
+	})
+	s.respChan <- batchResp{}
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:    3,
+		MaxPendingRequests: 3,
+		Sender:             sc,
+		Stopper:            stopper,
+	})
+	res, err := b.Reserve(2, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Release()
+	// Reservations are all or nothing.
+	if _, err := b.Reserve(2, 0, 0); err != ErrQueueFull {
+		t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+	}
+	var g errgroup.Group
+	sendRequest := func(opts SendOptions) {
+		g.Go(func() error {
+			_, err := b.SendWithOptions(context.Background(), 1, &roachpb.GetRequest{}, opts)
+			return err
+		})
+	}
+	sendRequest(SendOptions{})
+	testutils.SucceedsSoon(t, func() error {
+		if s := b.Saturation(); s != 1 {
+			return errors.Errorf("expected saturation 1, got %v", s)
+		}
+		return nil
+	})
+	// Unreserved capacity is exhausted but reserved capacity may be consumed.
+	if _, err := b.Send(context.Background(), 1, &roachpb.GetRequest{}); err != ErrQueueFull {
+		t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+	}
+	sendRequest(SendOptions{Reservation: res})
+	sendRequest(SendOptions{Reservation: res})
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 3)
+	s.respChan <- batchResp{}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+	// Releasing the consumed reservation returns nothing to the batcher.
+	res.Release()
+	assert.Equal(t, 0.0, b.Saturation())
+}
+
+func TestReservationRefundedOnAbandon(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:    1,
+		MaxPendingRequests: 1,
+		Sender:             sc,
+		Stopper:            stopper,
+	})
+	res, err := b.Reserve(1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Release()
+	// The first request of the group consumes the reservation while the
+	// second finds the queue full, so the first is abandoned.
+	_, err = b.SendGroup(context.Background(), 1, []roachpb.Request{
+		&roachpb.GetRequest{}, &roachpb.GetRequest{},
+	}, SendOptions{Reservation: res})
+	assert.Equal(t, ErrQueueFull, errors.Cause(err))
+	// The abandoned request's capacity is returned to the reservation rather
+	// than to the batcher.
+	if s := b.Saturation(); s != 1 {
+		t.Fatalf("expected saturation 1, got %v", s)
+	}
+	if _, err := b.Send(context.Background(), 1, &roachpb.GetRequest{}); err != ErrQueueFull {
+		t.Fatalf("expected %v, got %v", ErrQueueFull, err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := b.SendWithOptions(context.Background(), 1, &roachpb.GetRequest{},
+			SendOptions{Reservation: res})
+		errChan <- err
+	}()
+	s := <-sc
+	s.respChan <- batchResp{}
+	assert.Nil(t, <-errChan)
+}
+
+func TestReservationExpires(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	b := New(Config{
+		MaxPendingRequests: 2,
+		Sender:             make(chanSender),
+		Stopper:            stopper,
+	})
+	if _, err := b.Reserve(2, 0, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	testutils.SucceedsSoon(t, func() error {
+		if s := b.Saturation(); s != 0 {
+			return errors.Errorf("expected saturation 0, got %v", s)
+		}
+		return nil
+	})
+}
+
+func TestPrefetchRangeDescriptor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	prefetched := make(chan roachpb.RKey, 1)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		Sender:          sc,
+		Stopper:         stopper,
+		PrefetchRangeDescriptor: func(_ context.Context, key roachpb.RKey) error {
+			prefetched <- key
+			return nil
+		},
+	})
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a")},
+		})
+		errChan <- err
+	}()
+	// The key is looked up while the request waits in its batch.
+	assert.Equal(t, roachpb.RKey("a"), <-prefetched)
+	stopper.Quiesce(context.Background())
+	assert.Equal(t, ErrStopped, <-errChan)
+}
+
+func TestForEachPending(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 3,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	ctx := context.Background()
+	pendingKeys := func(rangeID roachpb.RangeID) (keys []string) {
+		if err := b.ForEachPending(ctx, rangeID, func(r PendingRequest) {
+			keys = append(keys, string(r.Request.Header().Key))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	assert.Len(t, pendingKeys(1), 0)
+	var g errgroup.Group
+	for _, key := range []string{"a", "b"} {
+		req := &roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)}}
+		g.Go(func() error {
+			_, err := b.Send(ctx, 1, req)
+			return err
+		})
+	}
+	testutils.SucceedsSoon(t, func() error {
+		if n := len(pendingKeys(1)); n != 2 {
+			return errors.Errorf("expected 2 pending requests, got %d", n)
+		}
+		return nil
+	})
+	assert.Len(t, pendingKeys(2), 0)
+	assert.ElementsMatch(t, []string{"a", "b"}, pendingKeys(1))
+	g.Go(func() error {
+		_, err := b.Send(ctx, 1, &roachpb.GetRequest{})
+		return err
+	})
+	s := <-sc
+	assert.Len(t, pendingKeys(1), 0)
+	s.respChan <- batchResp{}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected no errors, got %v", err)
+	}
+}
+
+func TestNoCopy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 1,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	for _, noCopy := range []bool{false, true} {
+		req := &roachpb.GetRequest{}
+		errChan := make(chan error, 1)
+		go func() {
+			_, err := b.SendWithOptions(context.Background(), 1, req, SendOptions{NoCopy: noCopy})
+			errChan <- err
+		}()
+		s := <-sc
+		// Requests are copied unless the batcher is allowed to take ownership.
+		assert.Equal(t, noCopy, s.ba.Requests[0].GetInner() == roachpb.Request(req))
+		s.respChan <- batchResp{}
+		assert.Nil(t, <-errChan)
+	}
+}
+
+func TestBatchArenaReuse(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := makePool()
+	a := p.getArena()
+	ba := p.newBatch(time.Time{}, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		ba.reqs = append(ba.reqs, p.newRequest(context.Background(), 1, &roachpb.GetRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+		}, SendOptions{}, nil))
+	}
+	br := ba.batchRequest(a, nil)
+	assert.Len(t, br.Requests, 3)
+	assert.Equal(t, roachpb.Key("c"), br.Requests[2].GetInner().Header().Key)
+	a.reset()
+	// Resetting the arena drops its references to the requests but retains
+	// the memory for the next batch.
+	assert.Nil(t, br.Requests[2].GetInner())
+	ba.reqs = ba.reqs[:1]
+	br = ba.batchRequest(a, nil)
+	assert.Len(t, br.Requests, 1)
+	assert.Equal(t, 3, cap(br.Requests))
+	assert.Equal(t, roachpb.Key("a"), br.Requests[0].GetInner().Header().Key)
+}
+
+func TestMetricsByFlushReason(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		MaxWait:         5 * time.Millisecond,
+		MaxIdle:         time.Hour,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	m := b.Metrics()
+	var g errgroup.Group
+	sendRequests := func(n int) {
+		for i := 0; i < n; i++ {
+			g.Go(func() error {
+				_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+				return err
+			})
+		}
+		s := <-sc
+		assert.Len(t, s.ba.Requests, n)
+		s.respChan <- batchResp{br: s.ba.CreateReply()}
+		assert.Nil(t, g.Wait())
+	}
+	// A full batch is sent because of its size.
+	sendRequests(2)
+	assert.Equal(t, int64(2), m.QueueWaitSize.TotalCount())
+	assert.Equal(t, int64(2), m.LatencySize.TotalCount())
+	// A lone request is sent once it has waited MaxWait.
+	sendRequests(1)
+	assert.Equal(t, int64(1), m.QueueWaitMaxWait.TotalCount())
+	assert.Equal(t, int64(1), m.LatencyMaxWait.TotalCount())
+	assert.Equal(t, int64(0), m.QueueWaitMaxIdle.TotalCount())
+	assert.Equal(t, int64(2), m.QueueWaitSize.TotalCount())
+}
+
+func TestFlushReasonTraced(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxIdle: 5 * time.Millisecond,
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	ctx, getRecording, cancel := tracing.ContextWithRecordingSpan(context.Background(), "test")
+	defer cancel()
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := b.Send(ctx, 1, &roachpb.GetRequest{})
+		errChan <- err
+	}()
+	s := <-sc
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, <-errChan)
+	if tracing.FindMsgInRecording(getRecording(), "flushed due to max_idle") == -1 {
+		t.Fatalf("expected flush reason in trace:\n%s", tracing.FormatRecordedSpans(getRecording()))
+	}
+}
+
+func TestErrorKeysNotTraced(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	b := New(Config{
+		QuarantineDuration: time.Minute,
+		Sender:             make(chanSender),
+		Stopper:            stopper,
+	})
+	// The range is quarantined after an error whose message contains a key.
+	ctx, getRecording, cancel := tracing.ContextWithRecordingSpan(context.Background(), "test")
+	defer cancel()
+	b.quarantine(ctx, 1, roachpb.NewError(&roachpb.WriteIntentError{
+		Intents: []roachpb.Intent{{Span: roachpb.Span{Key: roachpb.Key("secret")}}},
+	}))
+	rec := tracing.FormatRecordedSpans(getRecording())
+	assert.Contains(t, rec, "quarantining r1 for 1m0s after *roachpb.WriteIntentError")
+	assert.NotContains(t, rec, "secret")
+
+	// Errors which originate in the batcher are logged by their safe message,
+	// and the errors which accompany them by their type.
+	last := &lastError{
+		sentinel: ErrRetryBudgetExceeded,
+		last:     roachpb.NewError(&roachpb.WriteIntentError{}).GoError(),
+	}
+	for _, tc := range []struct {
+		err error
+		exp string
+	}{
+		{nil, "<nil>"},
+		{ErrStopped, "request batcher is stopped"},
+		{errors.Wrap(context.Canceled, "secret"), "context canceled"},
+		{errors.New("secret"), "*errors.fundamental"},
+		{last, "request batcher retry budget exceeded: *roachpb.WriteIntentError"},
+		{&batcherError{name: "test", cause: last}, "test: request batcher retry budget exceeded"},
+	} {
+		assert.Equal(t, tc.exp, fmt.Sprint(redactError(tc.err)))
+	}
+}
+
+func TestHistogramOptions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	b := New(Config{
+		Sender:  make(chanSender),
+		Stopper: stopper,
+		Histograms: HistogramOptions{
+			MaxLatency:       time.Millisecond,
+			MaxBatchRequests: 16,
+			SigFigs:          3,
+		},
+	})
+	m := b.Metrics()
+	// Values beyond the configured maximum are recorded as the maximum, to
+	// within the configured precision.
+	m.LatencySize.RecordValue(time.Second.Nanoseconds())
+	assert.InEpsilon(t, time.Millisecond.Nanoseconds(), m.LatencySize.Snapshot().Max(), 0.01)
+	m.BatchRequests.RecordValue(1 << 30)
+	assert.True(t, m.BatchRequests.Snapshot().Max() < 1<<20)
+	// Unset options use the defaults.
+	m.BatchBytes.RecordValue(1 << 20)
+	assert.InEpsilon(t, 1<<20, m.BatchBytes.Snapshot().Max(), 0.01)
+}
+
+func TestMetricRegistry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	registry := metric.NewRegistry()
+	b := New(Config{
+		Sender:       make(chanSender),
+		Stopper:      stopper,
+		Registry:     registry,
+		MetricPrefix: "test.batcher",
+	})
+	names := map[string]bool{}
+	registry.Each(func(name string, _ interface{}) {
+		names[name] = true
+	})
+	assert.True(t, names["test.batcher.latency.size"])
+	assert.True(t, names["test.batcher.batch.requests"])
+	assert.Equal(t, "test.batcher.queue_wait.max_idle", b.Metrics().QueueWaitMaxIdle.GetName())
+}
+
+func TestStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	assert.Equal(t, Stats{}, b.Stats())
+	var g *errgroup.Group
+	sendRequests := func(n int) {
+		g = &errgroup.Group{}
+		for i := 0; i < n; i++ {
+			g.Go(func() error {
+				_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+				return err
+			})
+		}
+	}
+	sendRequests(2)
+	s := <-sc
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+	assert.Equal(t, Stats{BatchesSent: 1, RequestsSent: 2}, b.Stats())
+	sendRequests(2)
+	s = <-sc
+	s.respChan <- batchResp{pe: roachpb.NewErrorf("boom")}
+	assert.NotNil(t, g.Wait())
+	assert.Equal(t, Stats{BatchesSent: 2, RequestsSent: 4, RequestsFailed: 2}, b.Stats())
+	// Requests which are never sent are failed when the batcher stops.
+	sendRequests(1)
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		if err := b.ForEachPending(context.Background(), 1, func(PendingRequest) {
+			n++
+		}); err != nil {
+			return err
+		}
+		if n != 1 {
+			return errors.Errorf("expected 1 pending request, got %d", n)
+		}
+		return nil
+	})
+	stopper.Quiesce(context.Background())
+	assert.Equal(t, ErrStopped, g.Wait())
+	// Send may return upon quiescence before the run loop fails the request.
+	testutils.SucceedsSoon(t, func() error {
+		if s, exp := b.Stats(), (Stats{BatchesSent: 2, RequestsSent: 4, RequestsFailed: 3}); s != exp {
+			return errors.Errorf("expected %+v, got %+v", exp, s)
+		}
+		return nil
+	})
+}
+
+func TestSetLimits(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:    2,
+		MaxInFlightBatches: 1,
+		Sender:             sc,
+		Stopper:            stopper,
+	})
+	assert.Equal(t, Limits{MaxMsgsPerBatch: 2, MaxInFlightBatches: 1}, b.Limits())
+	var g errgroup.Group
+	sendRequests := func(rangeID roachpb.RangeID, n int) {
+		for i := 0; i < n; i++ {
+			g.Go(func() error {
+				_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{})
+				return err
+			})
+		}
+	}
+	// Fill a batch for each of two ranges. Only one may be in flight.
+	sendRequests(1, 2)
+	first := <-sc
+	sendRequests(2, 2)
+	testutils.SucceedsSoon(t, func() error {
+		if held := b.inFlight.numHeld(); held != 1 {
+			return errors.Errorf("expected 1 held batch, got %d", held)
+		}
+		return nil
+	})
+	// Raising the in-flight limit sends the held batch.
+	b.SetLimits(Limits{MaxMsgsPerBatch: 3, MaxInFlightBatches: 2})
+	second := <-sc
+	assert.Len(t, second.ba.Requests, 2)
+	for _, s := range []batchSend{first, second} {
+		s.respChan <- batchResp{br: s.ba.CreateReply()}
+	}
+	// The new batch size limit applies to subsequent batches.
+	sendRequests(3, 3)
+	third := <-sc
+	assert.Len(t, third.ba.Requests, 3)
+	third.respChan <- batchResp{br: third.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+}
+
+func TestName(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	b := New(Config{
+		Name:               "test_batcher",
+		MaxPendingRequests: 1,
+		Sender:             make(chanSender),
+		Stopper:            stopper,
+	})
+	assert.Equal(t, "requestbatcher.test_batcher.latency.size", b.Metrics().LatencySize.GetName())
+	// Errors which originate in the batcher are annotated with its name.
+	_, err := b.Reserve(2, 0, 0)
+	assert.Equal(t, ErrQueueFull, errors.Cause(err))
+	assert.Equal(t, "test_batcher: request batcher queue is full", err.Error())
+}
+
+func TestErrorsAnnotatedWithName(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	b := New(Config{
+		Name:    "test_batcher",
+		Sender:  make(chanSender),
+		Stopper: stopper,
+	})
+	stopper.Stop(context.Background())
+	_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+	assert.Equal(t, ErrStopped, errors.Cause(err))
+	// The annotated error also supports the standard library's errors.Is.
+	assert.Equal(t, ErrStopped, err.(interface{ Unwrap() error }).Unwrap())
+	assert.Equal(t, "test_batcher: request batcher is stopped", err.Error())
+	// The annotated error is safe to include verbatim in crash reports.
+	assert.Equal(t, err.Error(), err.(log.SafeMessager).SafeMessage())
+}
+
+func TestUpdateRoutingInfo(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	infosChan := make(chan []roachpb.RangeInfo, 1)
+	type leaseHolder struct {
+		rangeID roachpb.RangeID
+		storeID roachpb.StoreID
+	}
+	leaseHolderChan := make(chan leaseHolder, 1)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		Sender:          sc,
+		Stopper:         stopper,
+		UpdateRangeInfos: func(_ context.Context, infos []roachpb.RangeInfo) {
+			infosChan <- infos
+		},
+		UpdateLeaseHolder: func(_ context.Context, rangeID roachpb.RangeID, storeID roachpb.StoreID) {
+			leaseHolderChan <- leaseHolder{rangeID, storeID}
+		},
+	})
+	var g *errgroup.Group
+	sendRequests := func() {
+		g = &errgroup.Group{}
+		for i := 0; i < 2; i++ {
+			g.Go(func() error {
+				_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+				return err
+			})
+		}
+	}
+	sendRequests()
+	s := <-sc
+	assert.True(t, s.ba.ReturnRangeInfo)
+	br := s.ba.CreateReply()
+	info := roachpb.RangeInfo{Desc: roachpb.RangeDescriptor{RangeID: 1}}
+	for _, ru := range br.Responses {
+		ru.GetInner().(*roachpb.GetResponse).RangeInfos = []roachpb.RangeInfo{info}
+	}
+	s.respChan <- batchResp{br: br}
+	assert.Nil(t, g.Wait())
+	// The RangeInfo shared by the responses is only reported once.
+	assert.Equal(t, []roachpb.RangeInfo{info}, <-infosChan)
+	sendRequests()
+	s = <-sc
+	s.respChan <- batchResp{pe: roachpb.NewError(&roachpb.NotLeaseHolderError{
+		RangeID:     1,
+		LeaseHolder: &roachpb.ReplicaDescriptor{StoreID: 3},
+	})}
+	assert.NotNil(t, g.Wait())
+	assert.Equal(t, leaseHolder{1, 3}, <-leaseHolderChan)
+}
+
+func TestUpdateClock(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	manual := hlc.NewManualClock(1)
+	clock := hlc.NewClock(manual.UnixNano, time.Hour)
+	b := New(Config{
+		Sender:  sc,
+		Stopper: stopper,
+		MaxIdle: time.Millisecond,
+		Clock:   clock,
+	})
+	send := func(resp batchResp) {
+		errChan := make(chan error, 1)
+		go func() {
+			_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+			errChan <- err
+		}()
+		s := <-sc
+		if resp.br == nil && resp.pe == nil {
+			resp.br = s.ba.CreateReply()
+		}
+		if resp.br != nil {
+			resp.br.Now = hlc.Timestamp{WallTime: 10}
+		}
+		s.respChan <- resp
+		<-errChan
+	}
+	send(batchResp{})
+	assert.Equal(t, int64(10), clock.Now().WallTime)
+	pErr := roachpb.NewErrorf("boom")
+	pErr.Now = hlc.Timestamp{WallTime: 20}
+	send(batchResp{pe: pErr})
+	assert.Equal(t, int64(20), clock.Now().WallTime)
+}
+
+func TestHedgeReadOnlyBatches(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc, hc := make(chanSender), make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 1,
+		Sender:          sc,
+		HedgeDelay:      time.Millisecond,
+		HedgeSender:     hc,
+		Stopper:         stopper,
+	})
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+		errChan <- err
+	}()
+	// The primary send does not respond so the batch is hedged and the hedged
+	// response is returned.
+	primary := <-sc
+	hedged := <-hc
+	hedged.respChan <- batchResp{br: hedged.ba.CreateReply()}
+	assert.Nil(t, <-errChan)
+	primary.respChan <- batchResp{pe: roachpb.NewErrorf("canceled")}
+	assert.Equal(t, int64(1), b.Stats().BatchesHedged)
+	// Batches which are not read-only are never hedged.
+	go func() {
+		_, err := b.Send(context.Background(), 1, &roachpb.PutRequest{})
+		errChan <- err
+	}()
+	s := <-sc
+	time.Sleep(5 * time.Millisecond)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, <-errChan)
+	assert.Equal(t, int64(1), b.Stats().BatchesHedged)
+}
+
+func TestCoalesceIncrements(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := makePool()
+	newRequest := func(req roachpb.Request) *request {
+		return p.newRequest(context.Background(), 1, req, SendOptions{}, nil)
+	}
+	inc := func(key string, delta int64) *request {
+		return newRequest(&roachpb.IncrementRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+			Increment:     delta,
+		})
+	}
+	reqs := []*request{
+		inc("a", 1),
+		inc("b", 5),
+		newRequest(&roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a")}}),
+		inc("a", 2),
+		inc("a", 3),
+	}
+	a := &batchArena{}
+	ci := coalesce(reqs, true /* increments */, false /* rangeStats */, a)
+	if !assert.NotNil(t, ci) {
+		return
+	}
+	assert.Len(t, ci.reqs, 3)
+	assert.Equal(t, int64(6), ci.reqs[0].(*roachpb.IncrementRequest).Increment)
+	assert.Equal(t, int64(5), ci.reqs[1].(*roachpb.IncrementRequest).Increment)
+	// The callers' requests are not modified.
+	assert.Equal(t, int64(1), reqs[0].req.(*roachpb.IncrementRequest).Increment)
+
+	var br roachpb.BatchResponse
+	br.Add(&roachpb.IncrementResponse{NewValue: 16})
+	br.Add(&roachpb.IncrementResponse{NewValue: 5})
+	br.Add(&roachpb.GetResponse{})
+	newValue := func(i int) int64 {
+		return ci.response(i, &br).(*roachpb.IncrementResponse).NewValue
+	}
+	assert.Equal(t, int64(11), newValue(0))
+	assert.Equal(t, int64(5), newValue(1))
+	assert.IsType(t, &roachpb.GetResponse{}, ci.response(2, &br))
+	assert.Equal(t, int64(13), newValue(3))
+	assert.Equal(t, int64(16), newValue(4))
+
+	// The arena's memory is reused once it is reset.
+	respIdx := append([]int(nil), ci.respIdx...)
+	a.reset()
+	assert.Len(t, ci.reqs, 0)
+	assert.True(t, ci == coalesce(reqs, true /* increments */, false /* rangeStats */, a))
+	assert.Equal(t, respIdx, ci.respIdx)
+	assert.Equal(t, int64(11), newValue(0))
+	assert.Equal(t, int64(16), newValue(4))
+
+	// Batches without repeated keys are sent unmodified.
+	assert.Nil(t, coalesce(reqs[:3], true /* increments */, false /* rangeStats */, &batchArena{}))
+}
+
+func TestCoalesceRangeStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := makePool()
+	newRequest := func(req roachpb.Request) *request {
+		return p.newRequest(context.Background(), 1, req, SendOptions{}, nil)
+	}
+	rangeStats := func(key string) *request {
+		return newRequest(&roachpb.RangeStatsRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+		})
+	}
+	reqs := []*request{
+		rangeStats("a"),
+		newRequest(&roachpb.IncrementRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a")},
+			Increment:     1,
+		}),
+		rangeStats("b"),
+		rangeStats("c"),
+	}
+	// Increments are left alone unless they are also coalesced.
+	ci := coalesce(reqs, false /* increments */, true /* rangeStats */, &batchArena{})
+	if !assert.NotNil(t, ci) {
+		return
+	}
+	assert.Len(t, ci.reqs, 2)
+	assert.Equal(t, []int{0, 1, 0, 0}, ci.respIdx)
+
+	var br roachpb.BatchResponse
+	br.Add(&roachpb.RangeStatsResponse{MVCCStats: enginepb.MVCCStats{KeyCount: 7}})
+	br.Add(&roachpb.IncrementResponse{NewValue: 1})
+	first := ci.response(0, &br).(*roachpb.RangeStatsResponse)
+	shared := ci.response(3, &br).(*roachpb.RangeStatsResponse)
+	assert.Equal(t, int64(7), shared.MVCCStats.KeyCount)
+	// Each caller receives its own response.
+	assert.False(t, first == shared)
+	assert.Equal(t, int64(1), ci.response(1, &br).(*roachpb.IncrementResponse).NewValue)
+
+	// A single RangeStatsRequest is sent unmodified.
+	assert.Nil(t, coalesce(reqs[:2], false /* increments */, true /* rangeStats */, &batchArena{}))
+}
+
+func TestDryRun(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		Stopper:         stopper,
+		DryRun:          true,
+	})
+	var g errgroup.Group
+	for i := 0; i < 2; i++ {
+		g.Go(func() error {
+			resp, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+			if err != nil {
+				return err
+			}
+			if _, ok := resp.(*roachpb.GetResponse); !ok {
+				return errors.Errorf("expected GetResponse, got %T", resp)
+			}
+			return nil
+		})
+	}
+	assert.Nil(t, g.Wait())
+	assert.Equal(t, int64(1), b.Stats().BatchesSent)
+	assert.Equal(t, int64(2), b.Stats().RequestsSent)
+
+	boom := errors.New("boom")
+	b = New(Config{
+		MaxMsgsPerBatch: 1,
+		Stopper:         stopper,
+		DryRun:          true,
+		DryRunError:     boom,
+	})
+	_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+	assert.EqualError(t, err, boom.Error())
+}
+
+func TestShadowSender(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:   1,
+		Stopper:           stopper,
+		DryRun:            true,
+		ShadowSender:      sc,
+		MaxShadowInFlight: 1,
+	})
+	get := &roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a")}}
+	// The primary send path does not wait for the shadow send.
+	_, err := b.Send(context.Background(), 1, get)
+	assert.Nil(t, err)
+	s := <-sc
+	if assert.Len(t, s.ba.Requests, 1) {
+		assert.Equal(t, get.Key, s.ba.Requests[0].GetInner().Header().Key)
+	}
+	// The copy of the second batch is dropped as the first is still in flight.
+	_, err = b.Send(context.Background(), 1, get)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), b.Stats().ShadowBatchesDropped)
+
+	s.respChan <- batchResp{pe: roachpb.NewErrorf("boom")}
+	testutils.SucceedsSoon(t, func() error {
+		if stats := b.Stats(); stats.ShadowBatchesFailed != 1 {
+			return errors.Errorf("expected 1 failed shadow batch, got %d", stats.ShadowBatchesFailed)
+		}
+		return nil
+	})
+	_, err = b.Send(context.Background(), 1, get)
+	assert.Nil(t, err)
+	s = <-sc
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	testutils.SucceedsSoon(t, func() error {
+		if stats := b.Stats(); stats.ShadowBatchesSent != 1 {
+			return errors.Errorf("expected 1 shadow batch sent, got %d", stats.ShadowBatchesSent)
+		}
+		return nil
+	})
+}
+
+func TestMaxCostPerBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxWait:         time.Hour,
+		MaxCostPerBatch: 10,
+		Cost: func(req roachpb.Request) int64 {
+			if _, ok := req.(*roachpb.ScanRequest); ok {
+				return 10
+			}
+			return 4
+		},
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func(request roachpb.Request) {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), 1, request)
+			return err
+		})
+	}
+	// The third Get brings the cost of the batch to 12.
+	for i := 0; i < 3; i++ {
+		sendRequest(&roachpb.GetRequest{})
+	}
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 3)
+	s.respChan <- batchResp{}
+	// A Scan reaches the limit on its own.
+	sendRequest(&roachpb.ScanRequest{})
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 1)
+	s.respChan <- batchResp{}
+	assert.Nil(t, g.Wait())
+}
+
+func TestMaxKeysPerBatch(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxWait:         time.Hour,
+		MaxKeysPerBatch: 3,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	errChan := make(chan error, 3)
+	send := func(req roachpb.Request) {
+		go func() {
+			_, err := b.Send(context.Background(), 1, req)
+			errChan <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		send(&roachpb.GetRequest{})
+	}
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		if err := b.ForEachPending(context.Background(), 1, func(PendingRequest) { n++ }); err != nil {
+			return err
+		}
+		if n != 2 {
+			return errors.Errorf("expected 2 pending requests, got %d", n)
+		}
+		return nil
+	})
+	// A ranged request is estimated to fill a batch on its own so the pending
+	// batch is sent without it and it is then sent alone. The two batches are
+	// sent concurrently.
+	send(&roachpb.ResolveIntentRangeRequest{
+		RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")},
+	})
+	sizes := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		s := <-sc
+		sizes[len(s.ba.Requests)] = true
+		s.respChan <- batchResp{}
+	}
+	assert.Equal(t, map[int]bool{1: true, 2: true}, sizes)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, <-errChan)
+	}
+}
+
+func TestAdaptiveBatchSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	b := New(Config{
+		MaxMsgsPerBatch:    20,
+		TargetBatchLatency: 10 * time.Millisecond,
+		MinMsgsPerBatch:    4,
+		Sender:             make(chanSender),
+		Stopper:            stopper,
+	})
+	a := b.adaptive
+	assert.Equal(t, 20, b.EffectiveMaxMsgsPerBatch())
+	// Slow batches shrink the limit down to MinMsgsPerBatch.
+	a.observe(20, 20*time.Millisecond, 20)
+	assert.Equal(t, 15, b.EffectiveMaxMsgsPerBatch())
+	for i := 0; i < 10; i++ {
+		a.observe(15, 20*time.Millisecond, 20)
+	}
+	assert.Equal(t, 4, b.EffectiveMaxMsgsPerBatch())
+	// Fast batches which were not limited by the current size do not grow it.
+	a.observe(2, time.Millisecond, 20)
+	assert.Equal(t, 4, b.EffectiveMaxMsgsPerBatch())
+	// Fast full batches grow the limit up to MaxMsgsPerBatch.
+	a.observe(4, time.Millisecond, 20)
+	assert.Equal(t, 5, b.EffectiveMaxMsgsPerBatch())
+	for i := 0; i < 20; i++ {
+		a.observe(b.EffectiveMaxMsgsPerBatch(), time.Millisecond, 20)
+	}
+	assert.Equal(t, 20, b.EffectiveMaxMsgsPerBatch())
+	// Lowering MaxMsgsPerBatch caps the effective limit.
+	limits := b.Limits()
+	limits.MaxMsgsPerBatch = 8
+	b.SetLimits(limits)
+	assert.Equal(t, 8, b.EffectiveMaxMsgsPerBatch())
+	a.observe(8, 20*time.Millisecond, 8)
+	assert.Equal(t, 6, b.EffectiveMaxMsgsPerBatch())
+}
+
+func TestSendOptionsMaxWaitWithoutBatcherTimers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Without MaxWait and MaxIdle only requests sent with a MaxWait give their
+	// batch a deadline.
+	checkBatchWithoutDeadline(t, Config{}, 1, SendOptions{MaxWait: time.Millisecond})
+}
+
+func TestSendOptionsMaxWait(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxWait: time.Hour,
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	errChan := make(chan error, 2)
+	send := func(opts SendOptions) {
+		go func() {
+			_, err := b.SendWithOptions(context.Background(), 1, &roachpb.GetRequest{}, opts)
+			errChan <- err
+		}()
+	}
+	send(SendOptions{})
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		if err := b.ForEachPending(context.Background(), 1, func(PendingRequest) { n++ }); err != nil {
+			return err
+		}
+		if n != 1 {
+			return errors.Errorf("expected 1 pending request, got %d", n)
+		}
+		return nil
+	})
+	// The request's MaxWait shortens the deadline of the batch it joins.
+	send(SendOptions{MaxWait: time.Millisecond})
+	select {
+	case s := <-sc:
+		assert.Len(t, s.ba.Requests, 2)
+		s.respChan <- batchResp{}
+	case <-time.After(10 * time.Second):
+		t.Fatal("batch was not sent at the request's deadline")
+	}
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, <-errChan)
+	}
+}
+
+func TestRangeOverrides(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 100,
+		MaxWait:         time.Hour,
+		RangeOverrides: func(rangeID roachpb.RangeID) RangeOverrides {
+			switch rangeID {
+			case 1:
+				return RangeOverrides{MaxMsgsPerBatch: 2}
+			case 2:
+				return RangeOverrides{MaxWait: time.Millisecond}
+			}
+			return RangeOverrides{}
+		},
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	errChan := make(chan error, 3)
+	send := func(rangeID roachpb.RangeID) {
+		go func() {
+			_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{})
+			errChan <- err
+		}()
+	}
+	// Range 1 is sent once it has two requests, range 2 after a millisecond.
+	for _, rangeID := range []roachpb.RangeID{1, 1, 2} {
+		send(rangeID)
+	}
+	sizes := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-sc:
+			sizes[len(s.ba.Requests)] = true
+			s.respChan <- batchResp{}
+		case <-time.After(10 * time.Second):
+			t.Fatal("batches were not sent according to their range's overrides")
+		}
+	}
+	assert.Equal(t, map[int]bool{1: true, 2: true}, sizes)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, <-errChan)
+	}
+}
+
+// writeFlushPolicy sends batches as soon as they contain a write. Batches
+// whose first request is to the key "fast" are otherwise sent after a
+// millisecond and all others after an hour.
+type writeFlushPolicy struct{}
+
+func (p writeFlushPolicy) ShouldFlush(state BatchState) bool {
+	for i := 0; i < state.Len(); i++ {
+		if !roachpb.IsReadOnly(state.Request(i)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p writeFlushPolicy) NextFlushTime(state BatchState) time.Time {
+	if state.Request(0).Header().Key.Equal(roachpb.Key("fast")) {
+		return state.StartTime().Add(time.Millisecond)
+	}
+	return state.StartTime().Add(time.Hour)
+}
+
+// rangeFlushPolicy sends batches to r2 after a millisecond and leaves all
+// others without a deadline.
+type rangeFlushPolicy struct{}
+
+func (p rangeFlushPolicy) ShouldFlush(state BatchState) bool {
+	return false
+}
+
+func (p rangeFlushPolicy) NextFlushTime(state BatchState) time.Time {
+	if state.RangeID() == 2 {
+		return state.StartTime().Add(time.Millisecond)
+	}
+	return time.Time{}
+}
+
+func TestBatchPolicyWithoutDeadline(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	checkBatchWithoutDeadline(t, Config{Policy: rangeFlushPolicy{}}, 1, SendOptions{})
+}
+
+func TestBatchPolicy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		// The policy replaces MaxMsgsPerBatch.
+		MaxMsgsPerBatch: 1,
+		Policy:          writeFlushPolicy{},
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	errChan := make(chan error, 3)
+	send := func(req roachpb.Request) {
+		go func() {
+			_, err := b.Send(context.Background(), 1, req)
+			errChan <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		send(&roachpb.GetRequest{})
+	}
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		if err := b.ForEachPending(context.Background(), 1, func(PendingRequest) { n++ }); err != nil {
+			return err
+		}
+		if n != 2 {
+			return errors.Errorf("expected 2 pending requests, got %d", n)
+		}
+		return nil
+	})
+	send(&roachpb.PutRequest{})
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 3)
+	s.respChan <- batchResp{}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, <-errChan)
+	}
+	// Batches of reads are sent at the time chosen by the policy.
+	send(&roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("fast")}})
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 1)
+	s.respChan <- batchResp{}
+	assert.Nil(t, <-errChan)
+}
+
+func TestGlobalBatching(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 3,
+		MaxWait:         time.Hour,
+		NumShards:       4,
+		GlobalBatching:  true,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	var g errgroup.Group
+	for i := 1; i <= 3; i++ {
+		rangeID := roachpb.RangeID(i)
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	// Requests to different ranges are sent in the same batch.
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 3)
+	s.respChan <- batchResp{}
+	assert.Nil(t, g.Wait())
+}
+
+func TestGlobalBatchingInFlightPerRange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:            1,
+		MaxInFlightBatchesPerRange: 1,
+		RangeOverloaded:            func(roachpb.RangeID) bool { return true },
+		GlobalBatching:             true,
+		Sender:                     sc,
+		Stopper:                    stopper,
+	})
+	var g errgroup.Group
+	for i := 1; i <= 2; i++ {
+		rangeID := roachpb.RangeID(i)
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	// The batches are not addressed to a single range and so are sent
+	// concurrently despite the per-range limits.
+	s1, s2 := <-sc, <-sc
+	assert.Equal(t, 2, b.InFlight().Batches)
+	assert.Equal(t, 0, b.InFlightForRange(0))
+	s1.respChan <- batchResp{}
+	s2.respChan <- batchResp{}
+	assert.Nil(t, g.Wait())
+}
+
+func TestSendOptionsTarget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		MaxWait:         time.Hour,
+		NumShards:       4,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	var g errgroup.Group
+	send := func(rangeID roachpb.RangeID, target roachpb.ReplicationTarget) {
+		g.Go(func() error {
+			_, err := b.SendWithOptions(context.Background(), rangeID, &roachpb.GetRequest{},
+				SendOptions{Target: target})
+			return err
+		})
+	}
+	// Requests to different ranges on the same store are sent together,
+	// addressed to the store.
+	target := roachpb.ReplicationTarget{NodeID: 2, StoreID: 3}
+	send(1, target)
+	send(2, target)
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	assert.Equal(t, roachpb.ReplicaDescriptor{NodeID: 2, StoreID: 3}, s.ba.Replica)
+	s.respChan <- batchResp{}
+	assert.Nil(t, g.Wait())
+}
+
+func TestSeparateReadsAndWrites(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:        2,
+		MaxWait:                time.Hour,
+		SeparateReadsAndWrites: true,
+		Sender:                 sc,
+		Stopper:                stopper,
+	})
+	var g errgroup.Group
+	for _, req := range []roachpb.Request{
+		&roachpb.GetRequest{}, &roachpb.PutRequest{}, &roachpb.ScanRequest{}, &roachpb.PutRequest{},
+	} {
+		req := req
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), 1, req)
+			return err
+		})
+	}
+	for i := 0; i < 2; i++ {
+		s := <-sc
+		assert.Len(t, s.ba.Requests, 2)
+		assert.Equal(t, roachpb.IsReadOnly(s.ba.Requests[0].GetInner()),
+			roachpb.IsReadOnly(s.ba.Requests[1].GetInner()))
+		s.respChan <- batchResp{}
+	}
+	assert.Nil(t, g.Wait())
+}
+
+func TestSendOptionsUserPriority(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		MaxWait:         time.Hour,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	ctx := context.Background()
+	var g errgroup.Group
+	send := func(priority roachpb.UserPriority) {
+		g.Go(func() error {
+			_, err := b.SendWithOptions(ctx, 1, &roachpb.GetRequest{
+				RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(fmt.Sprint(priority))},
+			}, SendOptions{UserPriority: priority})
+			return err
+		})
+	}
+	// Requests with a user priority are visible to ForEachPending.
+	send(5)
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		if err := b.ForEachPending(ctx, 1, func(PendingRequest) { n++ }); err != nil {
+			return err
+		}
+		if n != 1 {
+			return errors.Errorf("expected 1 pending request, got %d", n)
+		}
+		return nil
+	})
+	send(0)
+	send(5)
+	send(0)
+	for i := 0; i < 2; i++ {
+		s := <-sc
+		assert.Len(t, s.ba.Requests, 2)
+		for _, ru := range s.ba.Requests {
+			assert.Equal(t, fmt.Sprint(s.ba.UserPriority), string(ru.GetInner().Header().Key))
+		}
+		s.respChan <- batchResp{}
+	}
+	assert.Nil(t, g.Wait())
+}
+
+func TestCompatibilityRules(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := makePool()
+	newBatch := func(reqs ...roachpb.Request) *batch {
+		ba := p.newBatch(time.Time{}, 0)
+		for _, req := range reqs {
+			ba.reqs = append(ba.reqs, p.newRequest(context.Background(), 1, req, SendOptions{}, nil))
+		}
+		return ba
+	}
+	newRequest := func(req roachpb.Request) *request {
+		return p.newRequest(context.Background(), 1, req, SendOptions{}, nil)
+	}
+	cfg := &Config{CompatibilityRules: []CompatibilityRule{
+		NeverBatch(roachpb.EndTransaction),
+		DontMix(roachpb.ResolveIntent, roachpb.GC),
+	}}
+	for _, tc := range []struct {
+		batch      *batch
+		req        *request
+		compatible bool
+	}{
+		{newBatch(&roachpb.GetRequest{}), newRequest(&roachpb.PutRequest{}), true},
+		{newBatch(&roachpb.GetRequest{}), newRequest(&roachpb.EndTransactionRequest{}), false},
+		{newBatch(&roachpb.EndTransactionRequest{}), newRequest(&roachpb.GetRequest{}), false},
+		{newBatch(&roachpb.ResolveIntentRequest{}), newRequest(&roachpb.ResolveIntentRequest{}), true},
+		{newBatch(&roachpb.GetRequest{}, &roachpb.GCRequest{}), newRequest(&roachpb.ResolveIntentRequest{}), false},
+	} {
+		_, flush := flushBeforeAdding(cfg, tc.batch, tc.req)
+		assert.Equal(t, !tc.compatible, flush,
+			"adding %s to %s", tc.req.req.Method(), tc.batch.reqs[0].req.Method())
+	}
+}
+
+func TestMaxCommandSize(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := makePool()
+	newRequest := func(req roachpb.Request) *request {
+		return p.newRequest(context.Background(), 1, req, SendOptions{}, nil)
+	}
+	put := func(valueSize int) *request {
+		return newRequest(&roachpb.PutRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a")},
+			Value:         roachpb.MakeValueFromBytes(make([]byte, valueSize)),
+		})
+	}
+	get := func() *request {
+		return newRequest(&roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a")}})
+	}
+	first := put(100)
+	cfg := &Config{MaxCommandSize: 2*first.size + 10}
+	limits := &Limits{}
+	ba := p.newBatch(time.Time{}, 0)
+	addRequestToBatch(cfg, limits, time.Time{}, ba, first)
+	_, flush := flushBeforeAdding(cfg, ba, put(100))
+	assert.False(t, flush)
+	// A write which would take the batch over the limit starts a new batch.
+	_, flush = flushBeforeAdding(cfg, ba, put(200))
+	assert.True(t, flush)
+	// Batches of reads are not limited.
+	reads := p.newBatch(time.Time{}, 0)
+	for i := 0; i < 100; i++ {
+		addRequestToBatch(cfg, limits, time.Time{}, reads, get())
+	}
+	_, flush = flushBeforeAdding(cfg, reads, get())
+	assert.False(t, flush)
+	_, flush = flushBeforeAdding(cfg, reads, put(0))
+	assert.True(t, flush)
+}
+
+func TestBatchSizeHint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// The hint converges on a steady batch size without exceeding it.
+	var hint int
+	for i := 0; i < 20; i++ {
+		hint = nextBatchSizeHint(hint, 10)
+		assert.True(t, hint <= 10, "hint %d exceeds the batch size", hint)
+	}
+	assert.Equal(t, 10, hint)
+	for i := 0; i < 20; i++ {
+		hint = nextBatchSizeHint(hint, 1)
+	}
+	assert.Equal(t, 1, hint)
+
+	// New batches are preallocated to the hint.
+	p := makePool()
+	ba := p.newBatch(time.Time{}, 8)
+	assert.Len(t, ba.reqs, 0)
+	assert.True(t, cap(ba.reqs) >= 8)
+}
+
+func TestSendOptionsWeight(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 4,
+		MaxWait:         time.Hour,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	var g errgroup.Group
+	send := func(weight int) {
+		g.Go(func() error {
+			_, err := b.SendWithOptions(context.Background(), 1,
+				&roachpb.ResolveIntentRangeRequest{}, SendOptions{Weight: weight})
+			return err
+		})
+	}
+	// A heavyweight request fills a batch by itself.
+	send(4)
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 1)
+	s.respChan <- batchResp{}
+	// Unweighted requests count as one message.
+	send(2)
+	send(0)
+	send(0)
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 3)
+	s.respChan <- batchResp{}
+	assert.Nil(t, g.Wait())
+}
+
+func TestSendAsync(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:    2,
+		MaxWait:            time.Hour,
+		MaxPendingRequests: 2,
+		Sender:             sc,
+		Stopper:            stopper,
+	})
+	type result struct {
+		resp roachpb.Response
+		pErr *roachpb.Error
+	}
+	results := make(chan result, 3)
+	send := func() {
+		b.SendAsync(context.Background(), 1, &roachpb.GetRequest{}, SendOptions{},
+			func(resp roachpb.Response, pErr *roachpb.Error) {
+				results <- result{resp: resp, pErr: pErr}
+			})
+	}
+	send()
+	send()
+	// The queue is full so the third request fails before SendAsync returns.
+	send()
+	select {
+	case res := <-results:
+		assert.Regexp(t, "queue is full", res.pErr.String())
+	default:
+		t.Fatal("expected the third request to fail synchronously")
+	}
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	for i := 0; i < 2; i++ {
+		res := <-results
+		assert.Nil(t, res.pErr)
+		assert.IsType(t, &roachpb.GetResponse{}, res.resp)
+	}
+}
+
+func TestSendWithChan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 1,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	// A single channel receives the results of requests to several ranges.
+	results := make(chan Result, 2)
+	for i, key := range []string{"ok", "fail"} {
+		get := &roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)}}
+		assert.Nil(t, b.SendWithChan(context.Background(), roachpb.RangeID(i+1), get,
+			SendOptions{}, results, key))
+	}
+	for i := 0; i < 2; i++ {
+		s := <-sc
+		if s.ba.Requests[0].GetInner().Header().Key.Equal(roachpb.Key("fail")) {
+			s.respChan <- batchResp{pe: roachpb.NewErrorf("boom")}
+		} else {
+			s.respChan <- batchResp{br: s.ba.CreateReply()}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		res := <-results
+		switch res.Token {
+		case "ok":
+			assert.Nil(t, res.Err)
+			assert.IsType(t, &roachpb.GetResponse{}, res.Response)
+		case "fail":
+			assert.Regexp(t, "boom", res.Err)
+		default:
+			t.Fatalf("unexpected token %v", res.Token)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxWait: time.Hour,
+		MaxIdle: time.Hour,
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	ctx := context.Background()
+	// Flushing a batcher which has not started is a no-op.
+	assert.Nil(t, b.Flush(ctx, 1))
+	var g errgroup.Group
+	send := func(rangeID roachpb.RangeID) {
+		g.Go(func() error {
+			_, err := b.Send(ctx, rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	send(1)
+	send(1)
+	send(2)
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		for _, rangeID := range []roachpb.RangeID{1, 2} {
+			if err := b.ForEachPending(ctx, rangeID, func(PendingRequest) { n++ }); err != nil {
+				return err
+			}
+		}
+		if n != 3 {
+			return errors.Errorf("expected 3 pending requests, got %d", n)
+		}
+		return nil
+	})
+	assert.Nil(t, b.Flush(ctx, 1))
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, b.Flush(ctx, 2))
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 1)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+	assert.Equal(t, int64(3), b.Metrics().QueueWaitExplicit.TotalCount())
+}
+
+func TestFlushAll(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxWait:            time.Hour,
+		MaxInFlightBatches: 1,
+		Sender:             sc,
+		Stopper:            stopper,
+	})
+	ctx := context.Background()
+	var g errgroup.Group
+	for _, rangeID := range []roachpb.RangeID{1, 2} {
+		rangeID := rangeID
+		g.Go(func() error {
+			_, err := b.Send(ctx, rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		for _, rangeID := range []roachpb.RangeID{1, 2} {
+			if err := b.ForEachPending(ctx, rangeID, func(PendingRequest) { n++ }); err != nil {
+				return err
+			}
+		}
+		if n != 2 {
+			return errors.Errorf("expected 2 pending requests, got %d", n)
+		}
+		return nil
+	})
+	flushed := make(chan error, 1)
+	go func() { flushed <- b.FlushAll(ctx) }()
+	// FlushAll waits for the batch held by MaxInFlightBatches to be sent.
+	s := <-sc
+	select {
+	case err := <-flushed:
+		t.Fatalf("FlushAll returned before all batches were sent: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	s = <-sc
+	assert.Nil(t, <-flushed)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+}
+
+func TestFlushAllWaitsForSendBacklog(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch:    1,
+		MaxInFlightBatches: 1,
+		MaxSendWorkers:     1,
+		Sender:             sc,
+		Stopper:            stopper,
+	})
+	ctx := context.Background()
+	var g errgroup.Group
+	for _, rangeID := range []roachpb.RangeID{1, 2} {
+		rangeID := rangeID
+		g.Go(func() error {
+			_, err := b.Send(ctx, rangeID, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	// The sender blocks on the first batch, occupying the only send worker,
+	// while the second is held by MaxInFlightBatches. Raising the limit
+	// dispatches the second batch to the send workers' backlog.
+	s := <-sc
+	limits := b.Limits()
+	limits.MaxInFlightBatches = 2
+	b.SetLimits(limits)
+	testutils.SucceedsSoon(t, func() error {
+		b.sendPool.mu.Lock()
+		defer b.sendPool.mu.Unlock()
+		if n := len(b.sendPool.mu.backlog); n != 1 {
+			return errors.Errorf("expected 1 batch in the backlog, got %d", n)
+		}
+		return nil
+	})
+	flushed := make(chan error, 1)
+	go func() { flushed <- b.FlushAll(ctx) }()
+	select {
+	case err := <-flushed:
+		t.Errorf("FlushAll returned before the backlog was sent: %v", err)
+		flushed <- err
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	s = <-sc
+	assert.Nil(t, <-flushed)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+}
+
+func TestSendImmediate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxWait: time.Hour,
+		MaxIdle: time.Hour,
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	ctx := context.Background()
+	var g errgroup.Group
+	g.Go(func() error {
+		_, err := b.Send(ctx, 1, &roachpb.GetRequest{})
+		return err
+	})
+	numPending := func() (n int) {
+		assert.Nil(t, b.ForEachPending(ctx, 1, func(PendingRequest) { n++ }))
+		return n
+	}
+	testutils.SucceedsSoon(t, func() error {
+		if n := numPending(); n != 1 {
+			return errors.Errorf("expected 1 pending request, got %d", n)
+		}
+		return nil
+	})
+	// The immediate request is sent by itself without waiting and the pending
+	// batch stays queued.
+	g.Go(func() error {
+		_, err := b.SendImmediate(ctx, 1, &roachpb.PutRequest{})
+		return err
+	})
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 1)
+	assert.IsType(t, &roachpb.PutRequest{}, s.ba.Requests[0].GetInner())
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Equal(t, 1, numPending())
+	assert.Equal(t, int64(1), b.Metrics().QueueWaitExplicit.TotalCount())
+	assert.Nil(t, b.Flush(ctx, 1))
+	s = <-sc
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+}
+
+func TestSendOptionsExclusive(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxWait: time.Hour,
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	ctx := context.Background()
+	var g errgroup.Group
+	send := func(req roachpb.Request, opts SendOptions) {
+		g.Go(func() error {
+			_, err := b.SendWithOptions(ctx, 1, req, opts)
+			return err
+		})
+	}
+	for i := 0; i < 2; i++ {
+		send(&roachpb.GetRequest{}, SendOptions{})
+	}
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		if err := b.ForEachPending(ctx, 1, func(PendingRequest) { n++ }); err != nil {
+			return err
+		}
+		if n != 2 {
+			return errors.Errorf("expected 2 pending requests, got %d", n)
+		}
+		return nil
+	})
+	// The pending batch is sent ahead of the exclusive request, which is sent
+	// by itself.
+	send(&roachpb.AddSSTableRequest{}, SendOptions{Exclusive: true})
+	sizes := make(map[roachpb.Method]int)
+	for i := 0; i < 2; i++ {
+		s := <-sc
+		sizes[s.ba.Requests[0].GetInner().Method()] = len(s.ba.Requests)
+		s.respChan <- batchResp{br: s.ba.CreateReply()}
+	}
+	assert.Equal(t, map[roachpb.Method]int{roachpb.Get: 2, roachpb.AddSSTable: 1}, sizes)
+	assert.Nil(t, g.Wait())
+}
+
+func TestSendFuture(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	ctx := context.Background()
+	f1 := b.SendFuture(ctx, 1, &roachpb.GetRequest{}, SendOptions{})
+	f2 := b.SendFuture(ctx, 1, &roachpb.PutRequest{}, SendOptions{})
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	select {
+	case <-f1.Done():
+		t.Fatal("future completed before its batch")
+	default:
+	}
+	// The response to a canceled future is discarded.
+	f2.Cancel()
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	<-f1.Done()
+	resp, err := f1.Result()
+	assert.Nil(t, err)
+	assert.IsType(t, &roachpb.GetResponse{}, resp)
+	resp, err = f2.Result()
+	assert.Nil(t, resp)
+	assert.Equal(t, context.Canceled, err)
+	// A request which cannot be queued completes its future immediately.
+	_, err = b.SendFuture(ctx, 1, &roachpb.PutRequest{}, SendOptions{
+		ReadConsistency: roachpb.INCONSISTENT,
+	}).Result()
+	assert.Regexp(t, "may not be sent with INCONSISTENT read consistency", err)
+}
+
+func TestSendOptionsIdempotencyKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxWait: time.Hour,
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	ctx := context.Background()
+	send := func(key string) *Future {
+		return b.SendFuture(ctx, 1, &roachpb.ResolveIntentRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+		}, SendOptions{IdempotencyKey: key})
+	}
+	futures := []*Future{send("a"), send("a"), send("b"), send("a")}
+	assert.Nil(t, b.Flush(ctx, 1))
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	resps := make(map[roachpb.Response]struct{})
+	for _, f := range futures {
+		resp, err := f.Result()
+		assert.Nil(t, err)
+		assert.IsType(t, &roachpb.ResolveIntentResponse{}, resp)
+		resps[resp] = struct{}{}
+	}
+	// Each caller owns its own response.
+	assert.Len(t, resps, len(futures))
+	assert.Equal(t, int64(2), b.Stats().RequestsDeduplicated)
+	// The key is released once the request completes and errors are shared.
+	futures = []*Future{send("a"), send("a")}
+	assert.Nil(t, b.Flush(ctx, 1))
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 1)
+	s.respChan <- batchResp{pe: roachpb.NewErrorf("boom")}
+	for _, f := range futures {
+		_, err := f.Result()
+		assert.Regexp(t, "boom", err)
+	}
+}
+
+func TestSendUnion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	ctx := context.Background()
+	var ru roachpb.RequestUnion
+	ru.MustSetInner(&roachpb.ResolveIntentRequest{})
+	var g errgroup.Group
+	g.Go(func() error {
+		resp, err := b.SendUnion(ctx, 1, ru, SendOptions{})
+		assert.IsType(t, &roachpb.ResolveIntentResponse{}, resp)
+		return err
+	})
+	g.Go(func() error {
+		_, err := b.Send(ctx, 1, &roachpb.GetRequest{})
+		return err
+	})
+	s := <-sc
+	// The union is sent as is rather than being rebuilt.
+	var found bool
+	for _, sent := range s.ba.Requests {
+		found = found || sent.Value == ru.Value
+	}
+	assert.True(t, found)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+	_, err := b.SendUnion(ctx, 1, roachpb.RequestUnion{}, SendOptions{})
+	assert.Regexp(t, "empty RequestUnion", err)
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	// failures and errToReturn are set before each request is sent.
+	var failures int32
+	var errToReturn error
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return nil, roachpb.NewError(errToReturn)
+		}
+		return ba.CreateReply(), nil
+	})
+	b := New(Config{
+		MaxMsgsPerBatch:      1,
+		RetryTransientErrors: true,
+		RetryOptions:         retry.Options{InitialBackoff: time.Millisecond, MaxRetries: 2},
+		Sender:               sender,
+		Stopper:              stopper,
+	})
+	send := func(numFailures int32, err error) error {
+		atomic.StoreInt32(&failures, numFailures)
+		errToReturn = err
+		_, err = b.Send(context.Background(), 1, &roachpb.GetRequest{})
+		return err
+	}
+	// Retryable errors are retried up to MaxRetries times.
+	assert.Nil(t, send(2, roachpb.NewSendError("unavailable")))
+	assert.Equal(t, int64(2), b.Stats().BatchesRetried)
+	// Each attempt is passed to the Sender.
+	assert.Equal(t, int64(3), b.Stats().BatchesSent)
+	assert.Equal(t, int64(3), b.Stats().RequestsSent)
+	assert.Regexp(t, "unavailable", send(3, roachpb.NewSendError("unavailable")))
+	assert.Equal(t, int64(4), b.Stats().BatchesRetried)
+	// Other errors are returned as is.
+	assert.Regexp(t, "boom", send(1, errors.New("boom")))
+	assert.Equal(t, int64(4), b.Stats().BatchesRetried)
+
+	// Retries stop once they exceed the retry budget.
+	b = New(Config{
+		Name:                 "test",
+		MaxMsgsPerBatch:      1,
+		RetryTransientErrors: true,
+		RetryOptions:         retry.Options{InitialBackoff: time.Millisecond},
+		MaxRetryAttempts:     1,
+		Sender:               sender,
+		Stopper:              stopper,
+	})
+	err := send(5, roachpb.NewSendError("unavailable"))
+	assert.Equal(t, ErrRetryBudgetExceeded, errors.Cause(err))
+	assert.Regexp(t, "test: request batcher retry budget exceeded: .*unavailable", err)
+	assert.Equal(t, int64(1), b.Stats().BatchesRetried)
+}
+
+func TestRetryStopsWithoutWaiters(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	var calls int32
+	var cancel func()
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		if atomic.AddInt32(&calls, 1) == 2 && cancel != nil {
+			cancel()
+		}
+		return nil, roachpb.NewError(roachpb.NewSendError("unavailable"))
+	})
+	b := New(Config{
+		MaxMsgsPerBatch:      1,
+		RetryTransientErrors: true,
+		RetryOptions:         retry.Options{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		Sender:               sender,
+		Stopper:              stopper,
+	})
+	// Without MaxRetries a batch is retried a bounded number of times.
+	_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+	assert.Regexp(t, "unavailable", err)
+	assert.Equal(t, int32(defaultRetryMaxRetries+1), atomic.LoadInt32(&calls))
+
+	// Retries stop once the contexts of all of the batch's requests are done.
+	atomic.StoreInt32(&calls, 0)
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	_, err = b.Send(ctx, 1, &roachpb.GetRequest{})
+	assert.Equal(t, context.Canceled, err)
+	testutils.SucceedsSoon(t, func() error {
+		if n := b.InFlight().Batches; n != 0 {
+			return errors.Errorf("expected no batches in flight, got %d", n)
+		}
+		return nil
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestMaxRangeMismatchRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	// The first batch fails as though r1 had split at "m" into r1 and r2.
+	var calls int32
+	rerouted := make(chan []string, 2)
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, roachpb.NewError(&roachpb.RangeKeyMismatchError{
+				MismatchedRange: &roachpb.RangeDescriptor{
+					RangeID: 1, StartKey: roachpb.RKey("a"), EndKey: roachpb.RKey("m"),
+				},
+				SuggestedRange: &roachpb.RangeDescriptor{
+					RangeID: 2, StartKey: roachpb.RKey("m"), EndKey: roachpb.RKey("z"),
+				},
+			})
+		}
+		var keys []string
+		for _, ru := range ba.Requests {
+			keys = append(keys, string(ru.GetInner().Header().Key))
+		}
+		rerouted <- keys
+		return ba.CreateReply(), nil
+	})
+	b := New(Config{
+		MaxMsgsPerBatch:         3,
+		MaxWait:                 time.Millisecond,
+		MaxRangeMismatchRetries: 1,
+		Sender:                  sender,
+		Stopper:                 stopper,
+	})
+	get := func(key string) roachpb.Request {
+		return &roachpb.GetRequest{RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)}}
+	}
+	// The scan spans both ranges so it cannot be rerouted.
+	_, err := b.SendGroup(context.Background(), 1, []roachpb.Request{
+		get("b"), get("n"), &roachpb.ScanRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("l"), EndKey: roachpb.Key("o")},
+		},
+	}, SendOptions{})
+	assert.IsType(t, &roachpb.RangeKeyMismatchError{}, err)
+	// The gets are sent to their new ranges in separate batches.
+	var keys []string
+	for i := 0; i < 2; i++ {
+		batchKeys := <-rerouted
+		assert.Len(t, batchKeys, 1)
+		keys = append(keys, batchKeys...)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"b", "n"}, keys)
+	assert.Equal(t, int64(1), b.Stats().RequestsFailed)
+}
+
+func TestAttributeErrors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	// The sender fails batches which contain the key "bad" at its index.
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		for i, ru := range ba.Requests {
+			if string(ru.GetInner().Header().Key) == "bad" {
+				pErr := roachpb.NewErrorf("bad request")
+				pErr.SetErrorIndex(int32(i))
+				return nil, pErr
+			}
+		}
+		return ba.CreateReply(), nil
+	})
+	b := New(Config{
+		MaxMsgsPerBatch: 3,
+		MaxWait:         time.Millisecond,
+		AttributeErrors: true,
+		Sender:          sender,
+		Stopper:         stopper,
+	})
+	send := func(key string) *Future {
+		return b.SendFuture(context.Background(), 1, &roachpb.GetRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+		}, SendOptions{})
+	}
+	futures := []*Future{send("a"), send("bad"), send("c")}
+	for i, f := range futures {
+		_, err := f.Result()
+		if i == 1 {
+			assert.Regexp(t, "bad request", err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+	assert.Equal(t, int64(1), b.Stats().RequestsFailed)
+}
+
+func TestClassifyError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	// The sender fails batches containing the key "bad" at its index, fails
+	// the first batch containing the key "flaky" and fails every batch
+	// containing the key "sick".
+	var flaked int32
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		for i, ru := range ba.Requests {
+			switch string(ru.GetInner().Header().Key) {
+			case "bad":
+				pErr := roachpb.NewErrorf("bad")
+				pErr.SetErrorIndex(int32(i))
+				return nil, pErr
+			case "flaky":
+				if atomic.AddInt32(&flaked, 1) == 1 {
+					return nil, roachpb.NewErrorf("flaky")
+				}
+			case "sick":
+				return nil, roachpb.NewErrorf("sick")
+			}
+		}
+		return ba.CreateReply(), nil
+	})
+	b := New(Config{
+		Name:            "test",
+		MaxMsgsPerBatch: 3,
+		MaxWait:         time.Millisecond,
+		RetryOptions:    retry.Options{InitialBackoff: time.Millisecond},
+		ClassifyError: func(pErr *roachpb.Error) ErrorDisposition {
+			switch msg := pErr.Message; {
+			case strings.HasSuffix(msg, "bad"):
+				return DispositionFailRequest
+			case strings.HasSuffix(msg, "flaky"):
+				return DispositionRetry
+			case strings.HasSuffix(msg, "sick"):
+				return DispositionQuarantine
+			default:
+				return DispositionFailBatch
+			}
+		},
+		Sender:  sender,
+		Stopper: stopper,
+	})
+	send := func(rangeID roachpb.RangeID, key string) *Future {
+		return b.SendFuture(context.Background(), rangeID, &roachpb.GetRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+		}, SendOptions{})
+	}
+	// Only the request identified by the error fails.
+	futures := []*Future{send(1, "a"), send(1, "bad"), send(1, "c")}
+	for i, f := range futures {
+		_, err := f.Result()
+		if i == 1 {
+			assert.Regexp(t, "bad", err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+	// The batch is retried even though RetryTransientErrors is not set.
+	_, err := send(1, "flaky").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), b.Stats().BatchesRetried)
+	// The range is quarantined after the batch fails.
+	_, err = send(2, "sick").Result()
+	assert.Regexp(t, "sick", err)
+	_, err = send(2, "a").Result()
+	assert.Equal(t, ErrRangeQuarantined, errors.Cause(err))
+	assert.Regexp(t, "test: ", err)
+	_, err = send(1, "a").Result()
+	assert.Nil(t, err)
+}
+
+func TestMaxConsecutiveFailures(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	// The sender fails every batch containing the key "poison" with an
+	// ambiguous error, which does not identify the request which caused it.
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		for _, ru := range ba.Requests {
+			if string(ru.GetInner().Header().Key) == "poison" {
+				return nil, roachpb.NewError(roachpb.NewAmbiguousResultError("poison"))
+			}
+		}
+		return ba.CreateReply(), nil
+	})
+	for _, isolate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("isolate=%t", isolate), func(t *testing.T) {
+			b := New(Config{
+				MaxMsgsPerBatch:        2,
+				MaxWait:                time.Second,
+				MaxAmbiguousRetries:    10,
+				MaxConsecutiveFailures: 2,
+				IsolateFailingRequests: isolate,
+				Sender:                 sender,
+				Stopper:                stopper,
+			})
+			send := func(key string) *Future {
+				return b.SendFuture(context.Background(), 1, &roachpb.GetRequest{
+					RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+				}, SendOptions{Idempotent: true})
+			}
+			healthy, poison := send("a"), send("poison")
+			_, err := poison.Result()
+			assert.Equal(t, ErrTooManyFailures, errors.Cause(err))
+			assert.Regexp(t, "poison", err)
+			// The healthy request succeeds once it is isolated from the
+			// poison request.
+			_, err = healthy.Result()
+			if isolate {
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, ErrTooManyFailures, errors.Cause(err))
+			}
+		})
+	}
+}
+
+func TestErrorPropagation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	// The sender fails every batch containing the key "bad" with an error
+	// which does not identify the request which caused it.
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		for _, ru := range ba.Requests {
+			if string(ru.GetInner().Header().Key) == "bad" {
+				return nil, roachpb.NewErrorf("bad request")
+			}
+		}
+		return ba.CreateReply(), nil
+	})
+	for _, mode := range []ErrorPropagation{ErrorPropagationFailFast, ErrorPropagationPerRequest} {
+		t.Run(fmt.Sprintf("mode=%d", mode), func(t *testing.T) {
+			b := New(Config{
+				MaxMsgsPerBatch:  3,
+				MaxWait:          time.Second,
+				ErrorPropagation: mode,
+				Sender:           sender,
+				Stopper:          stopper,
+			})
+			send := func(key string) *Future {
+				return b.SendFuture(context.Background(), 1, &roachpb.GetRequest{
+					RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(key)},
+				}, SendOptions{})
+			}
+			futures := []*Future{send("a"), send("bad"), send("c")}
+			for i, f := range futures {
+				_, err := f.Result()
+				if i == 1 || mode == ErrorPropagationFailFast {
+					assert.Regexp(t, "bad request", err)
+				} else {
+					assert.Nil(t, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxNotLeaseHolderRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	leaseHolderChan := make(chan roachpb.StoreID, 2)
+	b := New(Config{
+		MaxMsgsPerBatch:          2,
+		MaxNotLeaseHolderRetries: 1,
+		Sender:                   sc,
+		Stopper:                  stopper,
+		UpdateLeaseHolder: func(_ context.Context, _ roachpb.RangeID, storeID roachpb.StoreID) {
+			leaseHolderChan <- storeID
+		},
+	})
+	nlhe := roachpb.NewError(&roachpb.NotLeaseHolderError{
+		RangeID:     1,
+		LeaseHolder: &roachpb.ReplicaDescriptor{StoreID: 3},
+	})
+	var g *errgroup.Group
+	sendRequests := func() {
+		g = &errgroup.Group{}
+		for i := 0; i < 2; i++ {
+			g.Go(func() error {
+				_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+				return err
+			})
+		}
+	}
+	// The batch is sent again after the lease hint is reported.
+	sendRequests()
+	s := <-sc
+	s.respChan <- batchResp{pe: nlhe}
+	assert.Equal(t, roachpb.StoreID(3), <-leaseHolderChan)
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+	assert.Equal(t, int64(1), b.Stats().BatchesRedispatched)
+	// The error is returned once the retries are exhausted.
+	sendRequests()
+	for i := 0; i < 2; i++ {
+		s = <-sc
+		s.respChan <- batchResp{pe: nlhe}
+		<-leaseHolderChan
+	}
+	assert.IsType(t, &roachpb.NotLeaseHolderError{}, errors.Cause(g.Wait()))
+	assert.Equal(t, int64(2), b.Stats().BatchesRedispatched)
+}
+
+func TestRedispatchBackoff(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	for _, tc := range []struct {
+		opts     retry.Options
+		retries  int
+		min, max time.Duration
+	}{
+		{retry.Options{}, 0, 8500 * time.Microsecond, 11500 * time.Microsecond},
+		{retry.Options{}, 20, 850 * time.Millisecond, 1150 * time.Millisecond},
+		{retry.Options{
+			InitialBackoff:      100 * time.Millisecond,
+			MaxBackoff:          300 * time.Millisecond,
+			Multiplier:          2,
+			RandomizationFactor: 0.1,
+		}, 1, 180 * time.Millisecond, 220 * time.Millisecond},
+		{retry.Options{
+			InitialBackoff:      100 * time.Millisecond,
+			MaxBackoff:          300 * time.Millisecond,
+			Multiplier:          2,
+			RandomizationFactor: 0.1,
+		}, 5, 270 * time.Millisecond, 330 * time.Millisecond},
+	} {
+		b := New(Config{
+			RedispatchBackoff: tc.opts,
+			Sender:            sc,
+			Stopper:           stopper,
+		})
+		for i := 0; i < 10; i++ {
+			backoff := b.redispatchBackoff(tc.retries)
+			if backoff < tc.min || backoff > tc.max {
+				t.Fatalf("backoff %s after %d retries not in [%s, %s]", backoff, tc.retries, tc.min, tc.max)
+			}
+		}
+	}
+}
+
+func TestOnWriteIntentError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	type handOff struct {
+		intents  []roachpb.Intent
+		resolved chan bool
+	}
+	handOffChan := make(chan handOff)
+	b := New(Config{
+		MaxMsgsPerBatch: 1,
+		Sender:          sc,
+		Stopper:         stopper,
+		OnWriteIntentError: func(_ context.Context, intents []roachpb.Intent) bool {
+			h := handOff{intents: intents, resolved: make(chan bool)}
+			handOffChan <- h
+			return <-h.resolved
+		},
+	})
+	intents := []roachpb.Intent{{Span: roachpb.Span{Key: roachpb.Key("a")}}}
+	wiErr := roachpb.NewError(&roachpb.WriteIntentError{Intents: intents})
+	errChan := make(chan error, 1)
+	send := func() {
+		go func() {
+			_, err := b.Send(context.Background(), 1, &roachpb.PutRequest{})
+			errChan <- err
+		}()
+	}
+	// The request is sent again once the intents are resolved.
+	send()
+	s := <-sc
+	s.respChan <- batchResp{pe: wiErr}
+	h := <-handOffChan
+	assert.Equal(t, intents, h.intents)
+	h.resolved <- true
+	s = <-sc
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, <-errChan)
+	// The error is returned if they are not.
+	send()
+	s = <-sc
+	s.respChan <- batchResp{pe: wiErr}
+	h = <-handOffChan
+	h.resolved <- false
+	assert.IsType(t, &roachpb.WriteIntentError{}, <-errChan)
+}
+
+func TestRequestQueue(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	q := makeRequestQueue()
+	const producers, perProducer = 8, 1000
+	var g errgroup.Group
+	for p := 0; p < producers; p++ {
+		p := p
+		g.Go(func() error {
+			for i := 0; i < perProducer; i++ {
+				if !q.push(&request{rangeID: roachpb.RangeID(p), retries: i}) {
+					return errors.New("queue closed")
+				}
+			}
+			return nil
+		})
+	}
+	// Each producer's requests are popped in the order in which they were
+	// pushed.
+	next := make([]int, producers)
+	var popped int
+	for popped < producers*perProducer {
+		<-q.wake
+		for r := q.popAll(); r != nil; r = r.next {
+			if p := int(r.rangeID); r.retries != next[p] {
+				t.Fatalf("expected request %d from producer %d, got %d", next[p], p, r.retries)
+			}
+			next[r.rangeID]++
+			popped++
+		}
+	}
+	assert.Nil(t, g.Wait())
+	q.close()
+	assert.False(t, q.push(&request{}))
+	assert.NotNil(t, q.popAll())
+	assert.Nil(t, q.popAll())
+}
+
+func TestTimingWheel(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	start := timeutil.Unix(0, int64(time.Hour))
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	w := newTimingWheel(time.Millisecond, start)
+	newBatch := func(deadline time.Time) *batch {
+		ba := &batch{idx: -1, deadline: deadline}
+		w.schedule(ba)
+		return ba
+	}
+	a := newBatch(at(time.Millisecond))
+	b := newBatch(at(1500 * time.Microsecond))
+	c := newBatch(at(3 * time.Millisecond))
+	// far shares a bucket with the tick 2ms after start.
+	far := newBatch(at((wheelSlots + 2) * time.Millisecond))
+	newBatch(time.Time{})
+	assert.Equal(t, 4, w.len)
+	w.unschedule(c)
+	w.unschedule(c)
+	assert.Equal(t, 3, w.len)
+	assert.Equal(t, at(time.Millisecond), w.nextTick())
+
+	assert.Equal(t, []*batch{a}, w.expire(at(1900*time.Microsecond), nil))
+	assert.Equal(t, []*batch{b}, w.expire(at(2*time.Millisecond), nil))
+	assert.Len(t, w.expire(at(3*time.Millisecond), nil), 0)
+	assert.Equal(t, at(4*time.Millisecond), w.nextTick())
+	// A deadline which has passed is expired on the next tick.
+	late := newBatch(at(time.Millisecond))
+	assert.Equal(t, []*batch{late}, w.expire(at(4*time.Millisecond), nil))
+	assert.Equal(t, []*batch{far}, w.expire(at(time.Hour), nil))
+	assert.Equal(t, 0, w.len)
+	assert.Equal(t, time.Time{}, w.nextTick())
+}
+
+func TestFlushTimerResolution(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		return ba.CreateReply(), nil
+	})
+	const maxIdle = 10 * time.Millisecond
+	b := New(Config{
+		MaxIdle:              maxIdle,
+		FlushTimerResolution: time.Millisecond,
+		Sender:               sender,
+		Stopper:              stopper,
+	})
+	// Two requests are sent to each range so that the deadline of each batch
+	// is moved once.
+	const numRanges = 100
+	var g errgroup.Group
+	for i := 0; i < 2*numRanges; i++ {
+		rangeID := roachpb.RangeID(i%numRanges + 1)
+		g.Go(func() error {
+			start := timeutil.Now()
+			if _, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{}); err != nil {
+				return err
+			}
+			if took := timeutil.Since(start); took < maxIdle {
+				return errors.Errorf("request to r%d sent after %s, before MaxIdle", rangeID, took)
+			}
+			return nil
+		})
+	}
+	assert.Nil(t, g.Wait())
+	assert.Equal(t, int64(2*numRanges), b.Stats().RequestsSent)
+}
+
+func TestSendNoReply(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 1,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	errChan := make(chan error, 1)
+	onError := func(err error) { errChan <- err }
+	assert.Nil(t, b.SendNoReply(context.Background(), 1, &roachpb.PutRequest{}, SendOptions{}, onError))
+	s := <-sc
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	// Errors are passed to the sink.
+	assert.Nil(t, b.SendNoReply(context.Background(), 1, &roachpb.PutRequest{}, SendOptions{}, onError))
+	s = <-sc
+	s.respChan <- batchResp{pe: roachpb.NewErrorf("boom")}
+	assert.Regexp(t, "boom", <-errChan)
+	// The sink is optional.
+	assert.Nil(t, b.SendNoReply(context.Background(), 1, &roachpb.PutRequest{}, SendOptions{}, nil))
+	s = <-sc
+	s.respChan <- batchResp{pe: roachpb.NewErrorf("boom")}
+	testutils.SucceedsSoon(t, func() error {
+		if failed := b.Stats().RequestsFailed; failed != 2 {
+			return errors.Errorf("expected 2 failed requests, got %d", failed)
+		}
+		return nil
+	})
+	select {
+	case err := <-errChan:
+		t.Fatalf("unexpected error %v", err)
+	default:
+	}
+}
+
+func TestSendGroup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	ctx := context.Background()
+	var g errgroup.Group
+	g.Go(func() error {
+		_, err := b.Send(ctx, 1, &roachpb.GetRequest{})
+		return err
+	})
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		if err := b.ForEachPending(ctx, 1, func(PendingRequest) {
+			n++
+		}); err != nil {
+			return err
+		}
+		if n != 1 {
+			return errors.Errorf("expected 1 pending request, got %d", n)
+		}
+		return nil
+	})
+	// The group is kept together in the pending batch even though it exceeds
+	// MaxMsgsPerBatch.
+	var resps []roachpb.Response
+	g.Go(func() (err error) {
+		resps, err = b.SendGroup(ctx, 1, []roachpb.Request{
+			&roachpb.QueryIntentRequest{}, &roachpb.ResolveIntentRequest{}, &roachpb.GetRequest{},
+		}, SendOptions{})
+		return err
+	})
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 4)
+	s.respChan <- batchResp{br: s.ba.CreateReply()}
+	assert.Nil(t, g.Wait())
+	assert.Len(t, resps, 3)
+	assert.IsType(t, &roachpb.QueryIntentResponse{}, resps[0])
+	assert.IsType(t, &roachpb.ResolveIntentResponse{}, resps[1])
+	assert.IsType(t, &roachpb.GetResponse{}, resps[2])
+	// An error for any of the requests is returned.
+	g.Go(func() error {
+		_, err := b.SendGroup(ctx, 1, []roachpb.Request{
+			&roachpb.GetRequest{}, &roachpb.GetRequest{},
+		}, SendOptions{})
+		return err
+	})
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{pe: roachpb.NewErrorf("boom")}
+	assert.Regexp(t, "boom", g.Wait())
+	_, err := b.SendGroup(ctx, 1, []roachpb.Request{&roachpb.GetRequest{}}, SendOptions{Idempotent: true})
+	assert.Regexp(t, "may not be retried", err)
+}
+
+func TestSpanTooWide(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxIdle: 100 * time.Millisecond,
+		SpanTooWide: func(sp roachpb.Span) bool {
+			return sp.EndKey.Compare(roachpb.Key("m")) > 0
+		},
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	errChan := make(chan error, 3)
+	send := func(key, endKey string) {
+		go func() {
+			_, err := b.Send(context.Background(), 1, &roachpb.ScanRequest{
+				RequestHeader: roachpb.RequestHeader{
+					Key: roachpb.Key(key), EndKey: roachpb.Key(endKey),
+				},
+			})
+			errChan <- err
+		}()
+	}
+	send("a", "c")
+	send("b", "e")
+	// Adding a request which extends the batch's span beyond "m" causes the
+	// batch to be sent without it.
+	testutils.SucceedsSoon(t, func() error {
+		var n int
+		if err := b.ForEachPending(context.Background(), 1, func(PendingRequest) { n++ }); err != nil {
+			return err
+		}
+		if n != 2 {
+			return errors.Errorf("expected 2 pending requests, got %d", n)
+		}
+		return nil
+	})
+	send("d", "z")
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	s.respChan <- batchResp{}
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 1)
+	s.respChan <- batchResp{}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, <-errChan)
+	}
+}
+
+func TestRangeOverloaded(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	var b *RequestBatcher
+	b = New(Config{
+		MaxMsgsPerBatch: 1,
+		// The callback may call back into the batcher.
+		RangeOverloaded: func(rangeID roachpb.RangeID) bool {
+			_ = b.InFlight()
+			return rangeID == 1
+		},
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func(rangeID roachpb.RangeID) {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), rangeID, &roachpb.GetRequest{
+				RequestHeader: roachpb.RequestHeader{Key: roachpb.Key(rangeID.String())},
+			})
+			return err
+		})
+	}
+	rangeKey := func(s batchSend) string {
+		return string(s.ba.Requests[0].GetInner().Header().Key)
+	}
+	sendRequest(1)
+	s1 := <-sc
+	// The second batch to the overloaded range is held while the first is in
+	// flight.
+	sendRequest(1)
+	testutils.SucceedsSoon(t, func() error {
+		if held := b.inFlight.numHeld(); held != 1 {
+			return errors.Errorf("expected 1 held batch, got %d", held)
+		}
+		return nil
+	})
+	// Batches to other ranges are unaffected.
+	sendRequest(2)
+	s2 := <-sc
+	assert.Equal(t, "2", rangeKey(s2))
+	s2.respChan <- batchResp{}
+	s1.respChan <- batchResp{}
+	s := <-sc
+	assert.Equal(t, "1", rangeKey(s))
+	s.respChan <- batchResp{}
+	assert.Nil(t, g.Wait())
+}
+
+func TestSendHints(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	hints := client.BatchHints{MaxConcurrency: 1}
+	b := New(Config{
+		MaxMsgsPerBatch: 1,
+		SendHints:       hints,
+		Sender: client.SenderFunc(func(
+			ctx context.Context, ba roachpb.BatchRequest,
+		) (*roachpb.BatchResponse, *roachpb.Error) {
+			if got := client.BatchHintsFromContext(ctx); got != hints {
+				return nil, roachpb.NewErrorf("expected hints %+v, got %+v", hints, got)
+			}
+			return ba.CreateReply(), nil
+		}),
+		Stopper: stopper,
+	})
+	_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+	assert.Nil(t, err)
+}
+
+func TestResumeSpans(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	// The sender returns one row per batch and the remainder of the span as the
+	// ResumeSpan.
+	sender := client.SenderFunc(func(
+		ctx context.Context, ba roachpb.BatchRequest,
+	) (*roachpb.BatchResponse, *roachpb.Error) {
+		if ba.MaxSpanRequestKeys != 1 {
+			return nil, roachpb.NewErrorf("unexpected MaxSpanRequestKeys %d", ba.MaxSpanRequestKeys)
+		}
+		br := ba.CreateReply()
+		for i, ru := range ba.Requests {
+			span := ru.GetInner().Header().Span()
+			resp := br.Responses[i].GetInner().(*roachpb.ScanResponse)
+			resp.Rows = []roachpb.KeyValue{{Key: span.Key}}
+			resp.NumKeys = 1
+			if next := span.Key.PrefixEnd(); next.Compare(span.EndKey) < 0 {
+				resp.ResumeSpan = &roachpb.Span{Key: next, EndKey: span.EndKey}
+				resp.ResumeReason = roachpb.RESUME_KEY_LIMIT
+			}
+		}
+		return br, nil
+	})
+	scan := func(b *RequestBatcher) *roachpb.ScanResponse {
+		resp, err := b.Send(context.Background(), 1, &roachpb.ScanRequest{
+			RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a"), EndKey: roachpb.Key("d")},
+		})
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		return resp.(*roachpb.ScanResponse)
+	}
+	b := New(Config{
+		MaxMsgsPerBatch:      1,
+		MaxSpanRequestKeys:   1,
+		MaxResumesPerRequest: 5,
+		Sender:               sender,
+		Stopper:              stopper,
+	})
+	resp := scan(b)
+	assert.Len(t, resp.Rows, 3)
+	assert.Equal(t, int64(3), resp.NumKeys)
+	assert.Nil(t, resp.ResumeSpan)
+	assert.Equal(t, int64(3), b.Stats().BatchesSent)
+
+	// Once the limit is reached the remaining ResumeSpan is returned.
+	b = New(Config{
+		MaxMsgsPerBatch:      1,
+		MaxSpanRequestKeys:   1,
+		MaxResumesPerRequest: 1,
+		Sender:               sender,
+		Stopper:              stopper,
+	})
+	resp = scan(b)
+	assert.Len(t, resp.Rows, 2)
+	assert.Equal(t, &roachpb.Span{Key: roachpb.Key("c"), EndKey: roachpb.Key("d")}, resp.ResumeSpan)
+
+	// Streamed requests deliver each page and are resumed until complete
+	// regardless of MaxResumesPerRequest.
+	stream, err := b.SendStream(context.Background(), 1, &roachpb.ScanRequest{
+		RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a"), EndKey: roachpb.Key("d")},
+	}, SendOptions{})
+	assert.Nil(t, err)
+	var keys []string
+	for res := range stream {
+		assert.Nil(t, res.Err)
+		for _, kv := range res.Response.(*roachpb.ScanResponse).Rows {
+			keys = append(keys, string(kv.Key))
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+}
+
+func TestCallerQuotas(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		Name:               "test",
+		MaxMsgsPerBatch:    1,
+		MaxPendingRequests: 10,
+		Sender:             sc,
+		Stopper:            stopper,
+	})
+	cleanup := b.RegisterCaller("cleanup", 1, 0)
+	assert.Equal(t, cleanup, b.RegisterCaller("cleanup", 5, 0))
+	other := b.RegisterCaller("other", 0, 0)
+	send := func(c *Caller) <-chan error {
+		errChan := make(chan error, 1)
+		go func() {
+			_, err := b.SendWithOptions(context.Background(), 1, &roachpb.GetRequest{},
+				SendOptions{Caller: c})
+			errChan <- err
+		}()
+		return errChan
+	}
+	errChan := send(cleanup)
+	s := <-sc
+	// The cleanup caller's quota is consumed until its request completes while
+	// other callers are unaffected.
+	err := <-send(cleanup)
+	assert.Equal(t, ErrQuotaExceeded, errors.Cause(err))
+	assert.EqualError(t, err, "test: cleanup: "+ErrQuotaExceeded.Error())
+	otherErrChan := send(other)
+	s.respChan <- batchResp{}
+	assert.Nil(t, <-errChan)
+	s = <-sc
+	s.respChan <- batchResp{}
+	assert.Nil(t, <-otherErrChan)
+	errChan = send(cleanup)
+	s = <-sc
+	s.respChan <- batchResp{}
+	assert.Nil(t, <-errChan)
+}
+
+func TestBackedUpRanges(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	events := make(chan BackedUpEvent, 1)
+	b := New(Config{
+		MaxMsgsPerBatch:    1,
+		MaxInFlightBatches: 1,
+		BackedUpThreshold:  2,
+		OnBackedUp: func(_ context.Context, ev BackedUpEvent) {
+			events <- ev
+		},
+		Sender:  sc,
+		Stopper: stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func() {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	sendRequest()
+	s := <-sc
+	// The range is considered backed up once two batches are held and is
+	// reported when it remains so upon the next check.
+	for i := 0; i < 3; i++ {
+		sendRequest()
+	}
+	ev := <-events
+	assert.Equal(t, roachpb.RangeID(1), ev.RangeID)
+	assert.Equal(t, 3, ev.QueuedRequests)
+	assert.Equal(t, int64(1), b.Metrics().BackedUpRanges.Count())
+	for i := 0; i < 4; i++ {
+		s.respChan <- batchResp{}
+		if i < 3 {
+			s = <-sc
+		}
+	}
+	assert.Nil(t, g.Wait())
+	assert.Equal(t, int64(1), b.Metrics().BackedUpRanges.Count())
+}
+
+func TestReadConsistency(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	sc := make(chanSender)
+	b := New(Config{
+		MaxMsgsPerBatch: 2,
+		Sender:          sc,
+		Stopper:         stopper,
+	})
+	var g errgroup.Group
+	sendRequest := func(rc roachpb.ReadConsistencyType) {
+		g.Go(func() error {
+			_, err := b.SendWithOptions(context.Background(), 1, &roachpb.GetRequest{},
+				SendOptions{ReadConsistency: rc})
+			return err
+		})
+	}
+	// Requests with different consistencies are not batched together.
+	sendRequest(roachpb.CONSISTENT)
+	sendRequest(roachpb.INCONSISTENT)
+	sendRequest(roachpb.INCONSISTENT)
+	s := <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	assert.Equal(t, roachpb.INCONSISTENT, s.ba.ReadConsistency)
+	s.respChan <- batchResp{}
+	sendRequest(roachpb.CONSISTENT)
+	s = <-sc
+	assert.Len(t, s.ba.Requests, 2)
+	assert.Equal(t, roachpb.CONSISTENT, s.ba.ReadConsistency)
+	s.respChan <- batchResp{}
+	assert.Nil(t, g.Wait())
+
+	_, err := b.SendWithOptions(context.Background(), 1, &roachpb.PutRequest{},
+		SendOptions{ReadConsistency: roachpb.INCONSISTENT})
+	assert.EqualError(t, err, "Put request may not be sent with INCONSISTENT read consistency")
+}
+
+func TestTelemetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	b := New(Config{
+		MaxMsgsPerBatch:    2,
+		MaxPendingRequests: 2,
+		Sender: client.SenderFunc(func(
+			_ context.Context, ba roachpb.BatchRequest,
+		) (*roachpb.BatchResponse, *roachpb.Error) {
+			return ba.CreateReply(), nil
+		}),
+		Stopper: stopper,
+	})
+	before := telemetry.GetFeatureCounts()
+	var g errgroup.Group
+	for i := 0; i < 2; i++ {
+		g.Go(func() error {
+			_, err := b.Send(context.Background(), 1, &roachpb.GetRequest{})
+			return err
+		})
+	}
+	assert.Nil(t, g.Wait())
+	_, err := b.Reserve(3, 0, 0)
+	assert.Equal(t, ErrQueueFull, errors.Cause(err))
+	after := telemetry.GetFeatureCounts()
+	for _, feature := range []string{
+		"requestbatcher.batch-size.2",
+		"requestbatcher.flush.size",
+		"requestbatcher.backpressure.queue-full",
+	} {
+		assert.Equal(t, before[feature]+1, after[feature], feature)
+	}
+}
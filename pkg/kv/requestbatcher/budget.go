@@ -0,0 +1,190 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// pendingBudget tracks the requests which have been accepted by Send but have
+// not yet been handed to the Sender. All methods are safe for concurrent use.
+type pendingBudget struct {
+	maxRequests int64
+	maxBytes    int64
+
+	requests int64 // accessed atomically
+	bytes    int64 // accessed atomically
+}
+
+func makePendingBudget(cfg *Config) pendingBudget {
+	return pendingBudget{
+		maxRequests: int64(cfg.MaxPendingRequests),
+		maxBytes:    int64(cfg.MaxPendingBytes),
+	}
+}
+
+// tryAcquire accounts for r if doing so does not exceed the budget's limits.
+// A request which is larger than maxBytes on its own is admitted when nothing
+// else is pending so that it can still make progress.
+func (pb *pendingBudget) tryAcquire(r *request) error {
+	reqs := atomic.AddInt64(&pb.requests, 1)
+	bytes := atomic.AddInt64(&pb.bytes, int64(r.size))
+	if (pb.maxRequests > 0 && reqs > pb.maxRequests) ||
+		(pb.maxBytes > 0 && bytes > pb.maxBytes && reqs > 1) {
+		pb.release(r)
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// tryReserve atomically accounts for numRequests requests totaling numBytes
+// bytes if doing so does not exceed the budget's limits.
+func (pb *pendingBudget) tryReserve(numRequests, numBytes int64) error {
+	reqs := atomic.AddInt64(&pb.requests, numRequests)
+	bytes := atomic.AddInt64(&pb.bytes, numBytes)
+	if (pb.maxRequests > 0 && reqs > pb.maxRequests) ||
+		(pb.maxBytes > 0 && bytes > pb.maxBytes) {
+		pb.unreserve(numRequests, numBytes)
+		return ErrQueueFull
+	}
+	return nil
+}
+
+func (pb *pendingBudget) unreserve(numRequests, numBytes int64) {
+	atomic.AddInt64(&pb.requests, -numRequests)
+	atomic.AddInt64(&pb.bytes, -numBytes)
+}
+
+// acquire accounts for r regardless of the budget's limits. It is used for
+// requests which were previously accepted and are being requeued.
+func (pb *pendingBudget) acquire(r *request) {
+	atomic.AddInt64(&pb.requests, 1)
+	atomic.AddInt64(&pb.bytes, int64(r.size))
+}
+
+func (pb *pendingBudget) release(r *request) {
+	atomic.AddInt64(&pb.requests, -1)
+	atomic.AddInt64(&pb.bytes, -int64(r.size))
+}
+
+// saturation returns the largest fraction of any configured limit which is
+// currently consumed.
+func (pb *pendingBudget) saturation() float64 {
+	var s float64
+	if pb.maxRequests > 0 {
+		s = maxFloat(s, float64(atomic.LoadInt64(&pb.requests))/float64(pb.maxRequests))
+	}
+	if pb.maxBytes > 0 {
+		s = maxFloat(s, float64(atomic.LoadInt64(&pb.bytes))/float64(pb.maxBytes))
+	}
+	return s
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Reservation is capacity in a RequestBatcher's queue which has been set aside
+// by Reserve. Requests sent with SendOptions.Reservation consume the reserved
+// capacity rather than competing for the batcher's remaining capacity and so
+// are never rejected with a queue full error while the reservation has
+// capacity remaining.
+type Reservation struct {
+	b *RequestBatcher
+
+	mu struct {
+		syncutil.Mutex
+		timer    *time.Timer
+		requests int64
+		bytes    int64
+		released bool
+	}
+}
+
+// Reserve atomically reserves capacity in the batcher's queue, as limited by
+// MaxPendingRequests and MaxPendingBytes, for numRequests requests totaling at
+// most numBytes bytes. Either all of the capacity is reserved or an error is
+// returned. Capacity which has not been consumed by the end of window, if
+// window is positive, is returned to the batcher. Callers should call Release
+// once they no longer need the reservation.
+func (b *RequestBatcher) Reserve(
+	numRequests, numBytes int, window time.Duration,
+) (*Reservation, error) {
+	if err := b.pending.tryReserve(int64(numRequests), int64(numBytes)); err != nil {
+		telemetry.Inc(queueFullCounter)
+		return nil, b.annotateError(err)
+	}
+	res := &Reservation{b: b}
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	res.mu.requests = int64(numRequests)
+	res.mu.bytes = int64(numBytes)
+	if window > 0 {
+		res.mu.timer = time.AfterFunc(window, res.Release)
+	}
+	return res, nil
+}
+
+// tryConsume consumes capacity for r from the reservation. It returns false
+// if the reservation does not have sufficient capacity remaining. Bytes are
+// only required to have been reserved if the batcher limits pending bytes.
+func (res *Reservation) tryConsume(r *request) bool {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if res.mu.released || res.mu.requests < 1 ||
+		(res.b.pending.maxBytes > 0 && res.mu.bytes < int64(r.size)) {
+		return false
+	}
+	res.mu.requests--
+	res.mu.bytes -= int64(r.size)
+	return true
+}
+
+// refund returns the capacity consumed by r, which was not queued, to the
+// reservation. It returns false if the reservation has been released, in which
+// case the capacity must be returned to the batcher instead.
+func (res *Reservation) refund(r *request) bool {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if res.mu.released {
+		return false
+	}
+	res.mu.requests++
+	res.mu.bytes += int64(r.size)
+	return true
+}
+
+// Release returns any unconsumed capacity to the batcher. It is safe to call
+// Release more than once.
+func (res *Reservation) Release() {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if res.mu.released {
+		return
+	}
+	res.mu.released = true
+	if res.mu.timer != nil {
+		res.mu.timer.Stop()
+	}
+	res.b.pending.unreserve(res.mu.requests, res.mu.bytes)
+	res.mu.requests, res.mu.bytes = 0, 0
+}
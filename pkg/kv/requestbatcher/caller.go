@@ -0,0 +1,75 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import "github.com/cockroachdb/cockroach/pkg/server/telemetry"
+
+// Caller is a named subsystem sharing a RequestBatcher which is subject to its
+// own quota on the requests it may have outstanding, so that a single
+// misbehaving subsystem cannot consume all of the capacity of a batcher used
+// by others. Requests are attributed to a Caller with SendOptions.Caller. A
+// request consumes its caller's quota from the time it is accepted by Send
+// until its response is available, and requests within their caller's quota
+// still compete for the batcher's own MaxPendingRequests and MaxPendingBytes.
+type Caller struct {
+	name   string
+	budget pendingBudget
+}
+
+// RegisterCaller returns the Caller with the given name, registering it with a
+// quota of at most maxRequests requests totaling at most maxBytes bytes if it
+// has not already been registered. A quota of <= 0 is not enforced. A request
+// which is larger than maxBytes on its own is admitted when the caller has
+// nothing else outstanding.
+func (b *RequestBatcher) RegisterCaller(name string, maxRequests, maxBytes int) *Caller {
+	b.callers.Lock()
+	defer b.callers.Unlock()
+	if c, ok := b.callers.m[name]; ok {
+		return c
+	}
+	c := &Caller{
+		name: name,
+		budget: pendingBudget{
+			maxRequests: int64(maxRequests),
+			maxBytes:    int64(maxBytes),
+		},
+	}
+	if b.callers.m == nil {
+		b.callers.m = map[string]*Caller{}
+	}
+	b.callers.m[name] = c
+	return c
+}
+
+// Name returns the name with which the caller was registered.
+func (c *Caller) Name() string {
+	return c.name
+}
+
+// tryAcquire accounts for r against the caller's quota.
+func (c *Caller) tryAcquire(r *request) error {
+	if err := c.budget.tryAcquire(r); err != nil {
+		telemetry.Inc(quotaCounter)
+		return &batcherError{name: c.name, cause: ErrQuotaExceeded}
+	}
+	return nil
+}
+
+// releaseCaller returns the quota consumed by r to its caller, if any.
+func releaseCaller(r *request) {
+	if r.caller != nil {
+		r.caller.budget.release(r)
+	}
+}
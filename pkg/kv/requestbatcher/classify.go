@@ -0,0 +1,98 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// defaultQuarantineDuration is the default value of Config.QuarantineDuration.
+const defaultQuarantineDuration = 10 * time.Second
+
+// ErrorDisposition is the way in which a failed batch is handled, as decided
+// by Config.ClassifyError.
+type ErrorDisposition int
+
+const (
+	// DispositionDefault handles the error as though Config.ClassifyError
+	// were not set.
+	DispositionDefault ErrorDisposition = iota
+	// DispositionRetry sends the batch again with backoff according to
+	// Config.RetryOptions, as is done for retryable errors when
+	// Config.RetryTransientErrors is set, whether or not it is.
+	DispositionRetry
+	// DispositionFailRequest fails only the request identified by the index
+	// of the error and queues the batch's other requests again, as is done
+	// when Config.AttributeErrors is set. If the error does not identify a
+	// request, every request fails.
+	DispositionFailRequest
+	// DispositionFailBatch fails every request in the batch with the error,
+	// without any of the retries which would otherwise apply.
+	DispositionFailBatch
+	// DispositionQuarantine fails every request in the batch like
+	// DispositionFailBatch and additionally rejects requests for the batch's
+	// range with ErrRangeQuarantined for Config.QuarantineDuration.
+	DispositionQuarantine
+)
+
+// classifyError returns the disposition of a batch which failed with pErr.
+func (b *RequestBatcher) classifyError(pErr *roachpb.Error) ErrorDisposition {
+	if b.cfg.ClassifyError == nil {
+		return DispositionDefault
+	}
+	return b.cfg.ClassifyError(pErr)
+}
+
+// quarantineSet tracks the ranges which were quarantined by
+// DispositionQuarantine and the time at which each quarantine ends.
+type quarantineSet struct {
+	syncutil.Mutex
+	m map[roachpb.RangeID]time.Time
+}
+
+// quarantine rejects requests for rangeID until Config.QuarantineDuration from
+// now.
+func (b *RequestBatcher) quarantine(ctx context.Context, rangeID roachpb.RangeID, pErr *roachpb.Error) {
+	log.Eventf(ctx, "quarantining r%d for %s after %s", rangeID, b.cfg.QuarantineDuration, redactPErr(pErr))
+	q := &b.quarantined
+	q.Lock()
+	defer q.Unlock()
+	if q.m == nil {
+		q.m = make(map[roachpb.RangeID]time.Time)
+	}
+	q.m[rangeID] = timeutil.Now().Add(b.cfg.QuarantineDuration)
+}
+
+// checkQuarantine returns ErrRangeQuarantined if rangeID is quarantined.
+func (b *RequestBatcher) checkQuarantine(rangeID roachpb.RangeID) error {
+	q := &b.quarantined
+	q.Lock()
+	defer q.Unlock()
+	until, ok := q.m[rangeID]
+	if !ok {
+		return nil
+	}
+	if timeutil.Now().Before(until) {
+		return b.annotateError(ErrRangeQuarantined)
+	}
+	delete(q.m, rangeID)
+	return nil
+}
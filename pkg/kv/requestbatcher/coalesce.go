@@ -0,0 +1,195 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// coalescedBatch describes a batch in which the IncrementRequests to the same
+// key have been merged into a single IncrementRequest and in which repeated
+// RangeStatsRequests have been collapsed into one.
+type coalescedBatch struct {
+	// reqs are the requests to send.
+	reqs []roachpb.Request
+	// respIdx maps the index of each request in the batch to the index in
+	// reqs of the request which carries it.
+	respIdx []int
+	// later is, for each request in the batch which was merged, the sum of the
+	// increments of the requests merged after it. It is used to derive the
+	// value the request would have observed had it been sent on its own.
+	later []int64
+	// merged is true for each request in the batch which was merged.
+	merged []bool
+	// shared is true for each RangeStatsRequest in the batch which is carried
+	// by an earlier RangeStatsRequest. Such requests receive a copy of its
+	// response.
+	shared []bool
+}
+
+// coalesce merges the IncrementRequests in reqs which share a key if
+// increments is true and collapses the RangeStatsRequests in reqs if
+// rangeStats is true. Every request in a batch is addressed to the same range
+// so its RangeStatsRequests all return the same statistics. It returns nil if
+// there is nothing to coalesce. The returned coalescedBatch is allocated from
+// a and is only valid until a is reset.
+func coalesce(reqs []*request, increments, rangeStats bool, a *batchArena) *coalescedBatch {
+	var byKey map[string][]int
+	var numRangeStats int
+	for i, r := range reqs {
+		switch req := r.req.(type) {
+		case *roachpb.IncrementRequest:
+			if increments && len(req.EndKey) == 0 {
+				if byKey == nil {
+					byKey = map[string][]int{}
+				}
+				byKey[string(req.Key)] = append(byKey[string(req.Key)], i)
+			}
+		case *roachpb.RangeStatsRequest:
+			if rangeStats {
+				numRangeStats++
+			}
+		}
+	}
+	mergeable := numRangeStats > 1
+	for _, idxs := range byKey {
+		if len(idxs) > 1 {
+			mergeable = true
+			break
+		}
+	}
+	if !mergeable {
+		return nil
+	}
+	ci := a.coalescedBatch(len(reqs))
+	// group is the index in ci.reqs of the merged request for each key.
+	group := map[string]int{}
+	// rangeStatsIdx is the index in ci.reqs of the first RangeStatsRequest.
+	rangeStatsIdx := -1
+	for i, r := range reqs {
+		if _, ok := r.req.(*roachpb.RangeStatsRequest); ok && numRangeStats > 1 {
+			if rangeStatsIdx >= 0 {
+				ci.respIdx[i] = rangeStatsIdx
+				ci.shared[i] = true
+				continue
+			}
+			rangeStatsIdx = len(ci.reqs)
+		}
+		inc, ok := r.req.(*roachpb.IncrementRequest)
+		if !ok || len(inc.EndKey) != 0 || len(byKey[string(inc.Key)]) <= 1 {
+			ci.respIdx[i] = len(ci.reqs)
+			ci.reqs = append(ci.reqs, r.req)
+			continue
+		}
+		key := string(inc.Key)
+		j, ok := group[key]
+		if ok {
+			prev := ci.reqs[j].(*roachpb.IncrementRequest)
+			if sum, overflow := addInt64(prev.Increment, inc.Increment); !overflow {
+				prev.Increment = sum
+				ci.respIdx[i] = j
+				ci.merged[i] = true
+				continue
+			}
+		}
+		// Start a new merged request for the key. The caller's request is
+		// copied as its increment is modified as later requests are merged.
+		group[key] = len(ci.reqs)
+		ci.respIdx[i] = len(ci.reqs)
+		ci.merged[i] = true
+		ci.reqs = append(ci.reqs, &roachpb.IncrementRequest{
+			RequestHeader: inc.RequestHeader,
+			Increment:     inc.Increment,
+		})
+	}
+	// Accumulate the increments which follow each merged request.
+	sums := make(map[int]int64, len(group))
+	for i := len(reqs) - 1; i >= 0; i-- {
+		if !ci.merged[i] {
+			continue
+		}
+		j := ci.respIdx[i]
+		ci.later[i] = sums[j]
+		sums[j] += reqs[i].req.(*roachpb.IncrementRequest).Increment
+	}
+	return ci
+}
+
+// response returns the response for the request at index i in the batch
+// given the response to the coalesced batch.
+func (ci *coalescedBatch) response(i int, br *roachpb.BatchResponse) roachpb.Response {
+	j := ci.respIdx[i]
+	if j >= len(br.Responses) {
+		return nil
+	}
+	resp := br.Responses[j].GetInner()
+	if ci.shared[i] {
+		// Each caller owns its response so the shared one is copied.
+		if rs, ok := resp.(*roachpb.RangeStatsResponse); ok {
+			rsCopy := *rs
+			return &rsCopy
+		}
+		return resp
+	}
+	if !ci.merged[i] {
+		return resp
+	}
+	inc, ok := resp.(*roachpb.IncrementResponse)
+	if !ok {
+		return resp
+	}
+	return &roachpb.IncrementResponse{
+		ResponseHeader: inc.ResponseHeader,
+		NewValue:       inc.NewValue - ci.later[i],
+	}
+}
+
+// addInt64 returns a+b and whether the addition overflowed.
+func addInt64(a, b int64) (int64, bool) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, true
+	}
+	return a + b, false
+}
+
+// coalescedBatch returns the arena's coalescedBatch, reset for a batch of n
+// requests, so that its slices are reused across batches.
+func (a *batchArena) coalescedBatch(n int) *coalescedBatch {
+	ci := &a.coalesced
+	if cap(ci.respIdx) < n {
+		ci.respIdx = make([]int, n)
+		ci.later = make([]int64, n)
+		ci.merged = make([]bool, n)
+		ci.shared = make([]bool, n)
+	} else {
+		ci.respIdx, ci.later = ci.respIdx[:n], ci.later[:n]
+		ci.merged, ci.shared = ci.merged[:n], ci.shared[:n]
+		for i := 0; i < n; i++ {
+			ci.respIdx[i], ci.later[i], ci.merged[i], ci.shared[i] = 0, 0, false, false
+		}
+	}
+	return ci
+}
+
+// reset drops the references held by the coalescedBatch while retaining its
+// slices for reuse.
+func (ci *coalescedBatch) reset() {
+	for i := range ci.reqs {
+		ci.reqs[i] = nil
+	}
+	ci.reqs = ci.reqs[:0]
+}
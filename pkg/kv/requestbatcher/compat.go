@@ -0,0 +1,52 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import "github.com/cockroachdb/cockroach/pkg/roachpb"
+
+// CompatibilityRule reports whether two requests to the same range may be
+// sent in the same batch, see Config.CompatibilityRules. Rules must be
+// symmetric.
+type CompatibilityRule func(a, b roachpb.Request) bool
+
+// NeverBatch returns a CompatibilityRule which sends requests of the given
+// method in batches of their own.
+func NeverBatch(method roachpb.Method) CompatibilityRule {
+	return func(a, b roachpb.Request) bool {
+		return a.Method() != method && b.Method() != method
+	}
+}
+
+// DontMix returns a CompatibilityRule which never sends requests of methods m1
+// and m2 in the same batch. Requests of the same method may still be batched
+// together.
+func DontMix(m1, m2 roachpb.Method) CompatibilityRule {
+	return func(a, b roachpb.Request) bool {
+		am, bm := a.Method(), b.Method()
+		return !(am == m1 && bm == m2) && !(am == m2 && bm == m1)
+	}
+}
+
+// compatible returns true if r may be added to ba according to rules.
+func compatible(rules []CompatibilityRule, ba *batch, r *request) bool {
+	for _, other := range ba.reqs {
+		for _, rule := range rules {
+			if !rule(other.req, r.req) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// dedupKey identifies the requests which are deduplicated with one another,
+// see SendOptions.IdempotencyKey.
+type dedupKey struct {
+	rangeID roachpb.RangeID
+	key     string
+}
+
+// follower is a request which was attached to a pending or in-flight request
+// with the same idempotency key rather than queued itself.
+type follower struct {
+	ctx  context.Context
+	done completion
+}
+
+// dedupRegistry tracks the requests with an idempotency key which are
+// pending or in flight along with the requests attached to them.
+type dedupRegistry struct {
+	syncutil.Mutex
+	m map[dedupKey]*dedupEntry
+}
+
+type dedupEntry struct {
+	followers []follower
+}
+
+// maybeAttach attaches done to the request queued with key if there is one
+// and returns true. Otherwise it registers key such that later requests are
+// attached to the caller's request, which must call releaseDedup once it
+// completes, and returns false.
+func (d *dedupRegistry) maybeAttach(ctx context.Context, key dedupKey, done completion) bool {
+	d.Lock()
+	defer d.Unlock()
+	if e, ok := d.m[key]; ok {
+		e.followers = append(e.followers, follower{ctx: ctx, done: done})
+		return true
+	}
+	if d.m == nil {
+		d.m = make(map[dedupKey]*dedupEntry)
+	}
+	d.m[key] = &dedupEntry{}
+	return false
+}
+
+// release unregisters key and returns the requests attached to it.
+func (d *dedupRegistry) release(key dedupKey) []follower {
+	d.Lock()
+	defer d.Unlock()
+	e := d.m[key]
+	delete(d.m, key)
+	return e.followers
+}
+
+// respondToFollowers delivers resp to each of the followers of a request,
+// each with its own copy of the response.
+func (b *RequestBatcher) respondToFollowers(followers []follower, resp response) {
+	for _, f := range followers {
+		res := resp
+		if res.resp != nil {
+			res.resp, res.err = copyResponse(res.resp)
+		}
+		b.deliver(f.ctx, f.done, res)
+	}
+}
+
+// copyResponse returns a deep copy of resp. Responses may not be cloned with
+// protoutil.Clone, as they may contain a transaction, so they are copied by
+// round-tripping them through their encoding.
+func copyResponse(resp roachpb.Response) (roachpb.Response, error) {
+	var ru roachpb.ResponseUnion
+	ru.MustSetInner(resp)
+	data, err := protoutil.Marshal(&ru)
+	if err != nil {
+		return nil, err
+	}
+	var ruCopy roachpb.ResponseUnion
+	if err := protoutil.Unmarshal(data, &ruCopy); err != nil {
+		return nil, err
+	}
+	return ruCopy.GetInner(), nil
+}
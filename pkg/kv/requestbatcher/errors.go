@@ -0,0 +1,172 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+// The errors which originate in the batcher rather than in the Sender. They
+// are returned annotated with the batcher's name; use errors.Cause to compare
+// against them.
+var (
+	// ErrQueueFull is returned when accepting a request or reservation would
+	// exceed the batcher's configured MaxPendingRequests or MaxPendingBytes.
+	ErrQueueFull = errors.New("request batcher queue is full")
+
+	// ErrStopped is returned for requests which could not be sent because the
+	// batcher's Stopper is quiescing.
+	ErrStopped = errors.New("request batcher is stopped")
+
+	// ErrQuotaExceeded is returned when accepting a request would exceed the
+	// quota of the Caller to which it is attributed. It is additionally
+	// annotated with the caller's name.
+	ErrQuotaExceeded = errors.New("request batcher caller quota exceeded")
+
+	// ErrRetryBudgetExceeded is returned for requests which would be retried
+	// beyond the limits set by Config.MaxRetryAttempts and
+	// Config.MaxRetryDuration. The error with which the request last failed
+	// is included in the message.
+	ErrRetryBudgetExceeded = errors.New("request batcher retry budget exceeded")
+
+	// ErrRangeQuarantined is returned for requests to a range which was
+	// quarantined because a batch sent to it failed with an error classified
+	// as DispositionQuarantine by Config.ClassifyError.
+	ErrRangeQuarantined = errors.New("request batcher range is quarantined")
+
+	// ErrTooManyFailures is returned for requests which were part of
+	// Config.MaxConsecutiveFailures consecutive failed batches. The error with
+	// which the request last failed is included in the message.
+	ErrTooManyFailures = errors.New("request batcher request failed too many batches")
+)
+
+// batcherError annotates an error which originated in the batcher with the
+// batcher's name. It implements both Cause, for errors.Cause, and Unwrap, for
+// the errors.Is function of the standard library.
+type batcherError struct {
+	name  string
+	cause error
+}
+
+func (e *batcherError) Error() string {
+	return e.name + ": " + e.cause.Error()
+}
+
+// Cause returns the unannotated error.
+func (e *batcherError) Cause() error {
+	return e.cause
+}
+
+// Unwrap returns the unannotated error.
+func (e *batcherError) Unwrap() error {
+	return e.cause
+}
+
+// SafeMessage implements log.SafeMessager. The batcher's name and the
+// sentinel errors it annotates never contain user data, unlike the errors
+// which may accompany them.
+func (e *batcherError) SafeMessage() string {
+	return e.name + ": " + errors.Cause(e.cause).Error()
+}
+
+var _ log.SafeMessager = (*batcherError)(nil)
+
+// lastError is the error with which a request fails once it may no longer be
+// retried, such as when its retries exceed the retry budget. Its cause is
+// the sentinel error describing why.
+type lastError struct {
+	sentinel error
+	// last is the error with which the request last failed.
+	last error
+}
+
+func (e *lastError) Error() string {
+	return e.sentinel.Error() + ": " + e.last.Error()
+}
+
+// Cause returns the sentinel error.
+func (e *lastError) Cause() error {
+	return e.sentinel
+}
+
+// Unwrap returns the sentinel error.
+func (e *lastError) Unwrap() error {
+	return e.sentinel
+}
+
+// SafeMessage implements log.SafeMessager. The error with which the request
+// last failed is described by its type alone.
+func (e *lastError) SafeMessage() string {
+	return e.sentinel.Error() + ": " + redactError(e.last).SafeMessage()
+}
+
+var _ log.SafeMessager = (*lastError)(nil)
+
+// redactedError describes an error in logs and traces without the user data,
+// such as keys, which the messages of errors returned by the Sender may
+// contain. Errors which originate in the batcher are described by their safe
+// message and any other error by its type.
+type redactedError struct {
+	err error
+}
+
+// redactError returns the value to log in place of err.
+func redactError(err error) redactedError {
+	return redactedError{err: err}
+}
+
+// redactPErr returns the value to log in place of pErr.
+func redactPErr(pErr *roachpb.Error) redactedError {
+	return redactedError{err: pErr.GoError()}
+}
+
+// SafeMessage implements log.SafeMessager.
+func (e redactedError) SafeMessage() string {
+	if e.err == nil {
+		return "<nil>"
+	}
+	if sm, ok := e.err.(log.SafeMessager); ok {
+		return sm.SafeMessage()
+	}
+	cause := errors.Cause(e.err)
+	switch cause {
+	case ErrQueueFull, ErrStopped, ErrQuotaExceeded, ErrRetryBudgetExceeded,
+		ErrRangeQuarantined, ErrTooManyFailures, context.Canceled, context.DeadlineExceeded:
+		return cause.Error()
+	}
+	return fmt.Sprintf("%T", cause)
+}
+
+// String implements fmt.Stringer, so that a redactedError may be passed
+// directly to log.Eventf.
+func (e redactedError) String() string {
+	return e.SafeMessage()
+}
+
+var _ log.SafeMessager = redactedError{}
+
+// annotateError annotates err, which originated in the batcher rather than
+// the Sender, with the batcher's name.
+func (b *RequestBatcher) annotateError(err error) error {
+	if b.cfg.Name == "" {
+		return err
+	}
+	return &batcherError{name: b.cfg.Name, cause: err}
+}
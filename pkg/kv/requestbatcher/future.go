@@ -0,0 +1,83 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// Future is a handle to the result of a request sent with SendFuture. It lets
+// callers with many outstanding requests wait for them, for example in a
+// single select loop, without dedicating a goroutine to each.
+type Future struct {
+	done chan struct{}
+	mu   struct {
+		syncutil.Mutex
+		completed bool
+	}
+	// resp and err are written before done is closed and are immutable
+	// thereafter.
+	resp roachpb.Response
+	err  error
+}
+
+// SendFuture queues req like SendWithOptions and returns a Future for its
+// result without waiting for it. If the request cannot be queued the returned
+// Future is already completed with the error. Once the request has been
+// queued, canceling ctx does not prevent it from being sent.
+func (b *RequestBatcher) SendFuture(
+	ctx context.Context, rangeID roachpb.RangeID, req roachpb.Request, opts SendOptions,
+) *Future {
+	f := &Future{done: make(chan struct{})}
+	if err := b.enqueue(ctx, rangeID, req, opts, completion{future: f}); err != nil {
+		f.complete(nil, err)
+	}
+	return f
+}
+
+// Done returns a channel which is closed once the Future's result is
+// available.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result waits for and returns the result of the request. The response is
+// owned by the caller.
+func (f *Future) Result() (roachpb.Response, error) {
+	<-f.done
+	return f.resp, f.err
+}
+
+// Cancel completes the Future with context.Canceled if it has not already
+// completed. The request may still be sent if it has already been queued but
+// its response is discarded.
+func (f *Future) Cancel() {
+	f.complete(nil, context.Canceled)
+}
+
+// complete sets the result of the Future unless it has already been set.
+func (f *Future) complete(resp roachpb.Response, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mu.completed {
+		return
+	}
+	f.mu.completed = true
+	f.resp, f.err = resp, err
+	close(f.done)
+}
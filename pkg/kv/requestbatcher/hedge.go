@@ -0,0 +1,85 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+type sendResult struct {
+	resp *roachpb.BatchResponse
+	pErr *roachpb.Error
+}
+
+// sendHedged sends br. If br is read-only and no response has arrived after
+// Config.HedgeDelay, br is also sent with Config.HedgeSender and whichever
+// response arrives first is returned while the other send is canceled. The
+// returned function blocks until the canceled send has returned and must be
+// called before the memory backing br is reused.
+func (b *RequestBatcher) sendHedged(
+	ctx context.Context, br roachpb.BatchRequest,
+) (*roachpb.BatchResponse, *roachpb.Error, func()) {
+	if b.cfg.HedgeDelay <= 0 || !br.IsReadOnly() {
+		resp, pErr := b.cfg.Sender.Send(ctx, br)
+		return resp, pErr, func() {}
+	}
+	results := make(chan sendResult, 2)
+	var cancels []context.CancelFunc
+	start := func(s client.Sender) bool {
+		sendCtx, cancel := context.WithCancel(ctx)
+		if err := b.cfg.Stopper.RunAsyncTask(sendCtx, b.cfg.Name, func(ctx context.Context) {
+			resp, pErr := s.Send(ctx, br)
+			results <- sendResult{resp: resp, pErr: pErr}
+		}); err != nil {
+			cancel()
+			return false
+		}
+		cancels = append(cancels, cancel)
+		return true
+	}
+	if !start(b.cfg.Sender) {
+		resp, pErr := b.cfg.Sender.Send(ctx, br)
+		return resp, pErr, func() {}
+	}
+	timer := timeutil.NewTimer()
+	defer timer.Stop()
+	timer.Reset(b.cfg.HedgeDelay)
+	var res sendResult
+	select {
+	case res = <-results:
+	case <-timer.C:
+		timer.Read = true
+		hedgeSender := b.cfg.HedgeSender
+		if hedgeSender == nil {
+			hedgeSender = b.cfg.Sender
+		}
+		if start(hedgeSender) {
+			b.stats.recordHedged()
+		}
+		res = <-results
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return res.resp, res.pErr, func() {
+		for i := 1; i < len(cancels); i++ {
+			<-results
+		}
+	}
+}
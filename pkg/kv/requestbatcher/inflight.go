@@ -0,0 +1,299 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// inFlightLimiter tracks the batches which have been dispatched to be sent but
+// have not yet completed. It is shared by all of the shards of a
+// RequestBatcher.
+//
+// Batches of requests sent with SendOptions.Target or Config.GlobalBatching
+// have range 0 but are not addressed to a single range, so they are excluded
+// from the per-range limits and from RangeOverloaded; lumping them together
+// would let unrelated traffic throttle itself as though it were a single slow
+// range. Their spans are still tracked for OrderConflictingBatches, under range
+// 0, as their keys may conflict with one another regardless of range.
+type inFlightLimiter struct {
+	maxBatches         int
+	maxBatchesPerRange int
+	maxRequests        int
+	maxBytes           int
+	rangeOverloaded    func(roachpb.RangeID) bool
+	orderConflicting   bool
+
+	mu struct {
+		syncutil.Mutex
+		batches  int
+		requests int
+		bytes    int
+		// byRange holds the number of batches in flight to each range other
+		// than range 0.
+		byRange map[roachpb.RangeID]int
+		// spans holds the spans of the batches in flight to each range. It is
+		// only maintained if orderConflicting is set.
+		spans map[roachpb.RangeID][]roachpb.Span
+		// held is the number of batches which are ready to be sent but are being
+		// held back by the limits.
+		held int
+	}
+}
+
+func (l *inFlightLimiter) init(cfg *Config) {
+	l.maxBatches = cfg.MaxInFlightBatches
+	l.maxBatchesPerRange = cfg.MaxInFlightBatchesPerRange
+	l.maxRequests = cfg.MaxInFlightRequests
+	l.maxBytes = cfg.MaxInFlightBytes
+	l.rangeOverloaded = cfg.RangeOverloaded
+	l.orderConflicting = cfg.OrderConflictingBatches
+	l.mu.byRange = map[roachpb.RangeID]int{}
+	l.mu.spans = map[roachpb.RangeID][]roachpb.Span{}
+}
+
+// setMaxBatches updates the limits on the number of batches in flight, in
+// total and to a single range.
+func (l *inFlightLimiter) setMaxBatches(maxBatches, maxBatchesPerRange int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxBatches = maxBatches
+	l.maxBatchesPerRange = maxBatchesPerRange
+}
+
+// overloadedRanges returns the ranges of batches which Config.RangeOverloaded
+// reports as overloaded. The callback is invoked without l.mu held so that it
+// may call back into the batcher.
+func (l *inFlightLimiter) overloadedRanges(batches []*batch) map[roachpb.RangeID]bool {
+	if l.rangeOverloaded == nil {
+		return nil
+	}
+	overloaded := make(map[roachpb.RangeID]bool, len(batches))
+	for _, ba := range batches {
+		rangeID := ba.rangeID()
+		if _, ok := overloaded[rangeID]; !ok && rangeID != 0 {
+			overloaded[rangeID] = l.rangeOverloaded(rangeID)
+		}
+	}
+	return overloaded
+}
+
+// canAcquireLocked returns true if ba may be sent without exceeding the
+// limiter's limits. A batch which exceeds the request or byte limits on its own
+// may be sent when nothing else is in flight so that it can make progress.
+// overloaded holds the ranges reported as overloaded, see overloadedRanges.
+func (l *inFlightLimiter) canAcquireLocked(ba *batch, overloaded map[roachpb.RangeID]bool) bool {
+	if l.maxBatches > 0 && l.mu.batches >= l.maxBatches {
+		return false
+	}
+	if ba.rangeID() != 0 {
+		if l.maxBatchesPerRange > 0 && l.mu.byRange[ba.rangeID()] >= l.maxBatchesPerRange {
+			return false
+		}
+		if overloaded[ba.rangeID()] && l.mu.byRange[ba.rangeID()] > 0 {
+			return false
+		}
+	}
+	if l.orderConflicting {
+		for _, span := range l.mu.spans[ba.rangeID()] {
+			if span.Overlaps(ba.span) {
+				return false
+			}
+		}
+	}
+	if l.mu.batches == 0 {
+		return true
+	}
+	return (l.maxRequests <= 0 || l.mu.requests+len(ba.reqs) <= l.maxRequests) &&
+		(l.maxBytes <= 0 || l.mu.bytes+ba.size <= l.maxBytes)
+}
+
+func (l *inFlightLimiter) acquireLocked(ba *batch) {
+	l.mu.batches++
+	l.mu.requests += len(ba.reqs)
+	l.mu.bytes += ba.size
+	if ba.rangeID() != 0 {
+		l.mu.byRange[ba.rangeID()]++
+	}
+	if l.orderConflicting {
+		l.mu.spans[ba.rangeID()] = append(l.mu.spans[ba.rangeID()], ba.span)
+	}
+}
+
+// conflictsWithHeld returns true if l.orderConflicting is set and the span of
+// ba overlaps that of any of held, the batches held before it, to the same
+// range.
+func (l *inFlightLimiter) conflictsWithHeld(held []*batch, ba *batch) bool {
+	if !l.orderConflicting {
+		return false
+	}
+	for _, h := range held {
+		if h.rangeID() == ba.rangeID() && h.span.Overlaps(ba.span) {
+			return true
+		}
+	}
+	return false
+}
+
+// tryAcquire accounts for ba if doing so does not exceed the limiter's limits
+// and ba does not conflict with any of the held batches. If it returns false
+// the batch is considered held until it is acquired by acquireReady or
+// dropped with releaseHeld.
+func (l *inFlightLimiter) tryAcquire(ba *batch, held []*batch) bool {
+	overloaded := l.overloadedRanges([]*batch{ba})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conflictsWithHeld(held, ba) || !l.canAcquireLocked(ba, overloaded) {
+		l.mu.held++
+		return false
+	}
+	l.acquireLocked(ba)
+	return true
+}
+
+// acquireReady chooses a batch from ready which may be sent without exceeding
+// the limiter's limits, accounts for it, and returns its index. Batches to the
+// ranges with the fewest batches already in flight are preferred so that
+// slow ranges, which accumulate in-flight batches, are throttled before
+// others. Among batches to equally loaded ranges the earliest is chosen. A
+// batch which conflicts with an earlier ready batch is not chosen. If no
+// batch may be sent -1 is returned.
+func (l *inFlightLimiter) acquireReady(ready []*batch) int {
+	overloaded := l.overloadedRanges(ready)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	best := -1
+	for i, ba := range ready {
+		if l.conflictsWithHeld(ready[:i], ba) || !l.canAcquireLocked(ba, overloaded) {
+			continue
+		}
+		if best == -1 || l.mu.byRange[ba.rangeID()] < l.mu.byRange[ready[best].rangeID()] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		l.mu.held--
+		l.acquireLocked(ready[best])
+	}
+	return best
+}
+
+// releaseHeld drops the accounting for n held batches which will not be sent.
+func (l *inFlightLimiter) releaseHeld(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mu.held -= n
+}
+
+// release drops the accounting for a batch of numRequests requests and size
+// bytes covering span to rangeID which has completed.
+func (l *inFlightLimiter) release(
+	rangeID roachpb.RangeID, numRequests, size int, span roachpb.Span,
+) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mu.batches--
+	l.mu.requests -= numRequests
+	l.mu.bytes -= size
+	if rangeID != 0 {
+		if l.mu.byRange[rangeID]--; l.mu.byRange[rangeID] == 0 {
+			delete(l.mu.byRange, rangeID)
+		}
+	}
+	if l.orderConflicting {
+		spans := l.mu.spans[rangeID]
+		for i := range spans {
+			if spans[i].EqualValue(span) {
+				spans[i] = spans[len(spans)-1]
+				spans = spans[:len(spans)-1]
+				break
+			}
+		}
+		if len(spans) == 0 {
+			delete(l.mu.spans, rangeID)
+		} else {
+			l.mu.spans[rangeID] = spans
+		}
+	}
+}
+
+// saturation returns the largest fraction of any configured limit which is
+// currently consumed.
+func (l *inFlightLimiter) saturation() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var s float64
+	if l.maxBatches > 0 {
+		s = maxFloat(s, float64(l.mu.batches)/float64(l.maxBatches))
+	}
+	if l.maxRequests > 0 {
+		s = maxFloat(s, float64(l.mu.requests)/float64(l.maxRequests))
+	}
+	if l.maxBytes > 0 {
+		s = maxFloat(s, float64(l.mu.bytes)/float64(l.maxBytes))
+	}
+	return s
+}
+
+func (l *inFlightLimiter) numHeld() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.mu.held
+}
+
+func (l *inFlightLimiter) numBatchesForRange(rangeID roachpb.RangeID) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.mu.byRange[rangeID]
+}
+
+// InFlight describes the batches which have been dispatched to be sent but
+// have not yet completed, see RequestBatcher.InFlight.
+type InFlight struct {
+	// Batches is the number of batches in flight.
+	Batches int
+	// Requests is the total number of requests in the batches in flight.
+	Requests int
+	// Bytes is the total size of the requests in the batches in flight.
+	Bytes int
+	// Held is the number of batches which are ready to be sent but are being
+	// held back by the in-flight limits.
+	Held int
+}
+
+func (l *inFlightLimiter) snapshot() InFlight {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return InFlight{
+		Batches:  l.mu.batches,
+		Requests: l.mu.requests,
+		Bytes:    l.mu.bytes,
+		Held:     l.mu.held,
+	}
+}
+
+// InFlight returns the batches currently in flight. Consumers may use it
+// alongside the MaxInFlight limits to size them for their Sender.
+func (b *RequestBatcher) InFlight() InFlight {
+	return b.inFlight.snapshot()
+}
+
+// InFlightForRange returns the number of batches to rangeID currently in
+// flight. Batches which are not addressed to a single range, see
+// Config.MaxInFlightBatchesPerRange, are not counted against range 0.
+func (b *RequestBatcher) InFlightForRange(rangeID roachpb.RangeID) int {
+	return b.inFlight.numBatchesForRange(rangeID)
+}
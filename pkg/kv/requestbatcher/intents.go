@@ -0,0 +1,46 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// maybeHandOffIntents is called when ba fails with pErr. If pErr is a
+// WriteIntentError and Config.OnWriteIntentError is set, the intents are
+// passed to it. If it reports that they were resolved, the requests are
+// queued again, subject to the retry budget, and true is returned. If false
+// is returned the caller is responsible for responding to the requests.
+func (b *RequestBatcher) maybeHandOffIntents(
+	ctx context.Context, ba *batch, pErr *roachpb.Error,
+) bool {
+	if b.cfg.OnWriteIntentError == nil {
+		return false
+	}
+	wiErr, ok := pErr.GetDetail().(*roachpb.WriteIntentError)
+	if !ok {
+		return false
+	}
+	log.Eventf(ctx, "handing off %d intents encountered by batch to r%d",
+		len(wiErr.Intents), ba.rangeID())
+	if !b.cfg.OnWriteIntentError(ctx, wiErr.Intents) {
+		return false
+	}
+	b.requeue(ctx, ba, pErr.GoError())
+	return true
+}
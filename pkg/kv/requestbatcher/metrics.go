@@ -0,0 +1,399 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
+
+// flushReason is the reason a batch was sent.
+type flushReason int
+
+const (
+	// flushSize indicates that the batch reached MaxMsgsPerBatch.
+	flushSize flushReason = iota
+	// flushBytes indicates that the batch reached MaxSizePerBatch.
+	flushBytes
+	// flushCost indicates that the batch reached MaxCostPerBatch.
+	flushCost
+	// flushKeys indicates that the batch reached MaxKeysPerBatch or that
+	// adding a request would have caused it to exceed MaxKeysPerBatch.
+	flushKeys
+	// flushSpan indicates that adding a request would have caused the batch
+	// to exceed the span limit imposed by SpanTooWide.
+	flushSpan
+	// flushIncompatible indicates that a request which could not be sent with
+	// the batch's requests according to CompatibilityRules was queued.
+	flushIncompatible
+	// flushMaxWait indicates that the batch's first request waited MaxWait.
+	flushMaxWait
+	// flushDeadline indicates that the batch was sent ahead of the context
+	// deadline of one of its requests, see FlushBeforeContextDeadline.
+	flushDeadline
+	// flushMaxIdle indicates that no request was added to the batch for
+	// MaxIdle.
+	flushMaxIdle
+	// flushPolicy indicates that the batch was sent as decided by the
+	// configured BatchPolicy.
+	flushPolicy
+	// flushImmediate indicates that the batch contained a request sent with
+	// SendOptions.Immediate.
+	flushImmediate
+	// flushExplicit indicates that the caller asked for the batch to be sent.
+	flushExplicit
+	// flushShutdown indicates that the batch was failed without being sent
+	// because the batcher is stopping.
+	flushShutdown
+
+	numFlushReasons
+)
+
+var flushReasonNames = [numFlushReasons]string{
+	flushSize:         "size",
+	flushBytes:        "bytes",
+	flushCost:         "cost",
+	flushKeys:         "keys",
+	flushSpan:         "span",
+	flushIncompatible: "incompatible",
+	flushMaxWait:      "max_wait",
+	flushDeadline:     "deadline",
+	flushMaxIdle:      "max_idle",
+	flushPolicy:       "policy",
+	flushImmediate:    "immediate",
+	flushExplicit:     "explicit",
+	flushShutdown:     "shutdown",
+}
+
+func (r flushReason) String() string {
+	return flushReasonNames[r]
+}
+
+// SafeMessage implements log.SafeMessager.
+func (r flushReason) SafeMessage() string {
+	return r.String()
+}
+
+// defaultHistogramWindow is the default value of Config.HistogramWindow.
+const defaultHistogramWindow = time.Minute
+
+// defaultMetricPrefix is the default value of Config.MetricPrefix.
+const defaultMetricPrefix = "requestbatcher"
+
+// HistogramOptions configures the range and precision of the histograms in a
+// batcher's Metrics. The histograms do not have fixed bucket boundaries;
+// instead the buckets are derived from the maximum tracked value and the
+// number of significant figures. Values above the maximum are recorded as the
+// maximum. Batchers operating at very different scales should size these so
+// that their typical values are neither truncated nor lost in coarse buckets.
+type HistogramOptions struct {
+	// MaxLatency is the maximum value tracked by the latency histograms. If
+	// MaxLatency <= 0 then metric.MaxLatency is used.
+	MaxLatency time.Duration
+
+	// MaxBatchRequests is the maximum value tracked by the histogram of the
+	// number of requests per batch. If MaxBatchRequests <= 0 then a default of
+	// 4096 is used.
+	MaxBatchRequests int64
+
+	// MaxBatchBytes is the maximum value tracked by the histogram of the size
+	// of batches. If MaxBatchBytes <= 0 then a default of 64MiB is used.
+	MaxBatchBytes int64
+
+	// SigFigs is the number of significant figures with which values are
+	// recorded, between 1 and 5. If SigFigs <= 0 then 1 is used.
+	SigFigs int
+}
+
+const (
+	defaultMaxBatchRequests = 4096
+	defaultMaxBatchBytes    = 64 << 20
+)
+
+func (o *HistogramOptions) setDefaults() {
+	if o.MaxLatency <= 0 {
+		o.MaxLatency = metric.MaxLatency
+	}
+	if o.MaxBatchRequests <= 0 {
+		o.MaxBatchRequests = defaultMaxBatchRequests
+	}
+	if o.MaxBatchBytes <= 0 {
+		o.MaxBatchBytes = defaultMaxBatchBytes
+	}
+	if o.SigFigs <= 0 {
+		o.SigFigs = 1
+	} else if o.SigFigs > 5 {
+		o.SigFigs = 5
+	}
+}
+
+var (
+	metaQueueWaitSize = metric.Metadata{
+		Name:        "queue_wait.size",
+		Help:        "Time requests spent queued in batches which were sent upon reaching a size limit",
+		Measurement: "Latency",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaQueueWaitMaxWait = metric.Metadata{
+		Name:        "queue_wait.max_wait",
+		Help:        "Time requests spent queued in batches which were sent upon reaching MaxWait",
+		Measurement: "Latency",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaQueueWaitMaxIdle = metric.Metadata{
+		Name:        "queue_wait.max_idle",
+		Help:        "Time requests spent queued in batches which were sent upon reaching MaxIdle",
+		Measurement: "Latency",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaQueueWaitExplicit = metric.Metadata{
+		Name:        "queue_wait.explicit",
+		Help:        "Time requests spent queued in batches which were flushed explicitly",
+		Measurement: "Latency",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaLatencySize = metric.Metadata{
+		Name:        "latency.size",
+		Help:        "Time from queuing to response for requests in batches which were sent upon reaching a size limit",
+		Measurement: "Latency",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaLatencyMaxWait = metric.Metadata{
+		Name:        "latency.max_wait",
+		Help:        "Time from queuing to response for requests in batches which were sent upon reaching MaxWait",
+		Measurement: "Latency",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaLatencyMaxIdle = metric.Metadata{
+		Name:        "latency.max_idle",
+		Help:        "Time from queuing to response for requests in batches which were sent upon reaching MaxIdle",
+		Measurement: "Latency",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaLatencyExplicit = metric.Metadata{
+		Name:        "latency.explicit",
+		Help:        "Time from queuing to response for requests in batches which were flushed explicitly",
+		Measurement: "Latency",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaBatchRequests = metric.Metadata{
+		Name:        "batch.requests",
+		Help:        "Number of requests in each batch sent",
+		Measurement: "Requests",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaBatchBytes = metric.Metadata{
+		Name:        "batch.bytes",
+		Help:        "Total size of the requests in each batch sent",
+		Measurement: "Storage",
+		Unit:        metric.Unit_BYTES,
+	}
+	metaBackedUpRanges = metric.Metadata{
+		Name:        "queue.backed_up",
+		Help:        "Number of times a range's queue was reported to have remained backed up",
+		Measurement: "Ranges",
+		Unit:        metric.Unit_COUNT,
+	}
+)
+
+// Metrics contains the metrics for a RequestBatcher. The latencies are broken
+// down by the reason the batch containing the request was sent; batches sent
+// upon reaching MaxMsgsPerBatch, MaxSizePerBatch, MaxCostPerBatch,
+// MaxKeysPerBatch, the limit imposed by SpanTooWide or CompatibilityRules,
+// and those sent by a BatchPolicy, are recorded as size-triggered.
+type Metrics struct {
+	// QueueWait* record the time from when a request is queued until the batch
+	// containing it is sent.
+	QueueWaitSize     *metric.Histogram
+	QueueWaitMaxWait  *metric.Histogram
+	QueueWaitMaxIdle  *metric.Histogram
+	QueueWaitExplicit *metric.Histogram
+
+	// Latency* record the time from when a request is queued until the
+	// response to the batch containing it is received.
+	LatencySize     *metric.Histogram
+	LatencyMaxWait  *metric.Histogram
+	LatencyMaxIdle  *metric.Histogram
+	LatencyExplicit *metric.Histogram
+
+	// BatchRequests and BatchBytes record the number and total size of the
+	// requests in each batch sent.
+	BatchRequests *metric.Histogram
+	BatchBytes    *metric.Histogram
+
+	// BackedUpRanges counts the ranges reported to have backed up queues, see
+	// Config.BackedUpThreshold.
+	BackedUpRanges *metric.Counter
+}
+
+// MetricStruct implements the metric.Struct interface.
+func (*Metrics) MetricStruct() {}
+
+var _ metric.Struct = (*Metrics)(nil)
+
+// makeMetrics creates the metrics for a batcher. The name of each metric is
+// prefixed by prefix.
+func makeMetrics(prefix string, histogramWindow time.Duration, opts HistogramOptions) Metrics {
+	prefixed := func(meta metric.Metadata) metric.Metadata {
+		meta.Name = prefix + "." + meta.Name
+		return meta
+	}
+	latency := func(meta metric.Metadata) *metric.Histogram {
+		return metric.NewHistogram(
+			prefixed(meta), histogramWindow, opts.MaxLatency.Nanoseconds(), opts.SigFigs,
+		)
+	}
+	return Metrics{
+		QueueWaitSize:     latency(metaQueueWaitSize),
+		QueueWaitMaxWait:  latency(metaQueueWaitMaxWait),
+		QueueWaitMaxIdle:  latency(metaQueueWaitMaxIdle),
+		QueueWaitExplicit: latency(metaQueueWaitExplicit),
+		LatencySize:       latency(metaLatencySize),
+		LatencyMaxWait:    latency(metaLatencyMaxWait),
+		LatencyMaxIdle:    latency(metaLatencyMaxIdle),
+		LatencyExplicit:   latency(metaLatencyExplicit),
+		BatchRequests: metric.NewHistogram(
+			prefixed(metaBatchRequests), histogramWindow, opts.MaxBatchRequests, opts.SigFigs,
+		),
+		BatchBytes: metric.NewHistogram(
+			prefixed(metaBatchBytes), histogramWindow, opts.MaxBatchBytes, opts.SigFigs,
+		),
+		BackedUpRanges: metric.NewCounter(prefixed(metaBackedUpRanges)),
+	}
+}
+
+// histograms returns the queue wait and latency histograms for reason.
+func (m *Metrics) histograms(reason flushReason) (queueWait, latency *metric.Histogram) {
+	switch reason {
+	case flushSize, flushBytes, flushCost, flushKeys, flushSpan, flushIncompatible, flushPolicy:
+		return m.QueueWaitSize, m.LatencySize
+	case flushMaxWait, flushDeadline:
+		return m.QueueWaitMaxWait, m.LatencyMaxWait
+	case flushMaxIdle:
+		return m.QueueWaitMaxIdle, m.LatencyMaxIdle
+	default:
+		return m.QueueWaitExplicit, m.LatencyExplicit
+	}
+}
+
+// Stats are counters of the work done by a batcher. Unlike Metrics they are
+// cheap to read and are intended for use in tests.
+type Stats struct {
+	// BatchesSent is the number of batches passed to the Sender, including
+	// batches of requests being retried.
+	BatchesSent int64
+	// RequestsSent is the number of requests in the batches passed to the
+	// Sender, counted again each time a batch is retried.
+	RequestsSent int64
+	// RequestsFailed is the number of queued requests which were responded to
+	// with an error, whether or not they were sent.
+	RequestsFailed int64
+	// BatchesHedged is the number of batches which were sent a second time
+	// with HedgeSender.
+	BatchesHedged int64
+	// ShadowBatchesSent is the number of copies of batches which were sent
+	// successfully to ShadowSender.
+	ShadowBatchesSent int64
+	// ShadowBatchesFailed is the number of copies of batches sent to
+	// ShadowSender which returned an error.
+	ShadowBatchesFailed int64
+	// ShadowBatchesDropped is the number of copies of batches which were not
+	// sent to ShadowSender because too many were already in flight, the
+	// batcher was stopping or the batch could not be copied.
+	ShadowBatchesDropped int64
+	// RequestsDeduplicated is the number of requests which were attached to
+	// a pending or in-flight request with the same SendOptions.IdempotencyKey
+	// rather than queued.
+	RequestsDeduplicated int64
+	// BatchesRetried is the number of times batches were sent again after
+	// failing with a retryable error, see Config.RetryTransientErrors.
+	BatchesRetried int64
+	// BatchesRedispatched is the number of times the requests of batches which
+	// failed with a NotLeaseHolderError were queued again, see
+	// Config.MaxNotLeaseHolderRetries.
+	BatchesRedispatched int64
+}
+
+// stats holds the counters backing Stats. All fields are accessed atomically.
+type stats struct {
+	batchesSent    int64
+	requestsSent   int64
+	requestsFailed int64
+	batchesHedged  int64
+
+	shadowBatchesSent    int64
+	shadowBatchesFailed  int64
+	shadowBatchesDropped int64
+
+	requestsDeduplicated int64
+	batchesRetried       int64
+	batchesRedispatched  int64
+}
+
+func (s *stats) recordSent(numRequests int) {
+	atomic.AddInt64(&s.batchesSent, 1)
+	atomic.AddInt64(&s.requestsSent, int64(numRequests))
+}
+
+func (s *stats) recordFailed(numRequests int) {
+	atomic.AddInt64(&s.requestsFailed, int64(numRequests))
+}
+
+func (s *stats) recordHedged() {
+	atomic.AddInt64(&s.batchesHedged, 1)
+}
+
+func (s *stats) recordShadowSent() {
+	atomic.AddInt64(&s.shadowBatchesSent, 1)
+}
+
+func (s *stats) recordShadowFailed() {
+	atomic.AddInt64(&s.shadowBatchesFailed, 1)
+}
+
+func (s *stats) recordShadowDropped() {
+	atomic.AddInt64(&s.shadowBatchesDropped, 1)
+}
+
+func (s *stats) recordDeduplicated() {
+	atomic.AddInt64(&s.requestsDeduplicated, 1)
+}
+
+func (s *stats) recordRetried() {
+	atomic.AddInt64(&s.batchesRetried, 1)
+}
+
+func (s *stats) recordRedispatched() {
+	atomic.AddInt64(&s.batchesRedispatched, 1)
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		BatchesSent:    atomic.LoadInt64(&s.batchesSent),
+		RequestsSent:   atomic.LoadInt64(&s.requestsSent),
+		RequestsFailed: atomic.LoadInt64(&s.requestsFailed),
+		BatchesHedged:  atomic.LoadInt64(&s.batchesHedged),
+
+		ShadowBatchesSent:    atomic.LoadInt64(&s.shadowBatchesSent),
+		ShadowBatchesFailed:  atomic.LoadInt64(&s.shadowBatchesFailed),
+		ShadowBatchesDropped: atomic.LoadInt64(&s.shadowBatchesDropped),
+
+		RequestsDeduplicated: atomic.LoadInt64(&s.requestsDeduplicated),
+		BatchesRetried:       atomic.LoadInt64(&s.batchesRetried),
+		BatchesRedispatched:  atomic.LoadInt64(&s.batchesRedispatched),
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// requestQueue is a lock-free multi-producer, single-consumer queue which
+// hands requests from the callers of Send to a shard's run loop. Producers
+// push onto an intrusive stack with a compare-and-swap; the consumer takes the
+// whole stack at once with a swap and reverses it, which yields the requests
+// in the order in which they were pushed. Unlike a channel, pushing never
+// blocks, so Send does not wait for the run loop to be scheduled.
+type requestQueue struct {
+	head   unsafe.Pointer // *request, accessed atomically
+	closed int32          // accessed atomically
+
+	// wake has a capacity of 1 and is signaled whenever a request is pushed
+	// onto an empty queue.
+	wake chan struct{}
+}
+
+func makeRequestQueue() requestQueue {
+	return requestQueue{wake: make(chan struct{}, 1)}
+}
+
+// push adds r to the queue. It returns false if the queue has been closed, in
+// which case the consumer may already have drained it for the last time and
+// the caller is responsible for draining it again.
+func (q *requestQueue) push(r *request) bool {
+	for {
+		head := atomic.LoadPointer(&q.head)
+		r.next = (*request)(head)
+		if atomic.CompareAndSwapPointer(&q.head, head, unsafe.Pointer(r)) {
+			if head == nil {
+				select {
+				case q.wake <- struct{}{}:
+				default:
+				}
+			}
+			return atomic.LoadInt32(&q.closed) == 0
+		}
+	}
+}
+
+// popAll removes every request from the queue and returns the first of them,
+// linked through request.next in the order in which they were pushed.
+func (q *requestQueue) popAll() *request {
+	r := (*request)(atomic.SwapPointer(&q.head, nil))
+	var prev *request
+	for r != nil {
+		next := r.next
+		r.next = prev
+		prev, r = r, next
+	}
+	return prev
+}
+
+// close marks the queue as closed once its consumer has stopped. The
+// consumer must drain the queue after closing it.
+func (q *requestQueue) close() {
+	atomic.StoreInt32(&q.closed, 1)
+}
+
+// submit hands r to the run loop of the shard which owns it. It returns an
+// error if the batcher is stopping, in which case r has not been queued.
+// Should the run loop stop after r is queued, r fails with ErrStopped.
+func (b *RequestBatcher) submit(r *request) error {
+	select {
+	case <-b.cfg.Stopper.ShouldQuiesce():
+		return b.annotateError(ErrStopped)
+	default:
+	}
+	s := b.shardForRequest(r)
+	if !s.queue.push(r) {
+		s.failQueued(b.annotateError(ErrStopped))
+	}
+	return nil
+}
+
+// failQueued responds to every request in the shard's queue, along with the
+// members of any groups, with err.
+func (s *shard) failQueued(err error) {
+	b := s.b
+	for r := s.queue.popAll(); r != nil; {
+		next := r.next
+		r.next = nil
+		single := [1]*request{r}
+		members := single[:]
+		if r.group != nil {
+			members, r.group = r.group, nil
+		}
+		for _, m := range members {
+			b.pending.release(m)
+			b.stats.recordFailed(1)
+			b.sendResponse(m, response{err: err})
+		}
+		r = next
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+)
+
+// Requests sent with SendOptions.NoCopy are owned by the batcher until the
+// call to Send returns. In race builds the encoding of such requests is
+// recorded when they are queued and compared against their encoding when they
+// are sent in order to detect callers which violate the contract.
+
+// maybeFingerprint records the encoding of r if it was sent with
+// SendOptions.NoCopy and this is a race build.
+func maybeFingerprint(r *request, noCopy bool) {
+	if !noCopy || !util.RaceEnabled {
+		return
+	}
+	fp, err := protoutil.Marshal(r.req)
+	if err != nil {
+		return
+	}
+	r.fingerprint = fp
+}
+
+// assertUnmodified fatals if r has a fingerprint which no longer matches the
+// encoding of its request.
+func assertUnmodified(ctx context.Context, r *request) {
+	if r.fingerprint == nil {
+		return
+	}
+	fp, err := protoutil.Marshal(r.req)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(fp, r.fingerprint) {
+		log.Fatalf(ctx, "%s request was modified after being sent with SendOptions.NoCopy",
+			log.Safe(r.req.Method()))
+	}
+}
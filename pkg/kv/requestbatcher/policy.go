@@ -0,0 +1,73 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// BatchPolicy decides when batches are sent in place of MaxMsgsPerBatch,
+// MaxWait and MaxIdle, see Config.Policy. Its methods are called on the run
+// loop which owns the batch and so must be cheap and must not block.
+type BatchPolicy interface {
+	// ShouldFlush is called after each request is added to a batch and
+	// returns true if the batch should be sent immediately.
+	ShouldFlush(state BatchState) bool
+	// NextFlushTime is called after each request is added to a batch which is
+	// not sent immediately and returns the time at which it should be sent.
+	// A zero time indicates that the batch should wait for further requests
+	// without a deadline.
+	NextFlushTime(state BatchState) time.Time
+}
+
+// BatchState describes a batch which has not yet been sent to a BatchPolicy.
+// It is only valid for the duration of the call to which it is passed.
+type BatchState struct {
+	ba *batch
+}
+
+// RangeID returns the range to which the batch will be sent.
+func (s BatchState) RangeID() roachpb.RangeID {
+	return s.ba.rangeID()
+}
+
+// Len returns the number of requests in the batch.
+func (s BatchState) Len() int {
+	return len(s.ba.reqs)
+}
+
+// Request returns the i-th request in the batch. The request must not be
+// modified.
+func (s BatchState) Request(i int) roachpb.Request {
+	return s.ba.reqs[i].req
+}
+
+// Size returns the total size in bytes of the requests in the batch.
+func (s BatchState) Size() int {
+	return s.ba.size
+}
+
+// StartTime returns the time at which the batch's first request was queued.
+func (s BatchState) StartTime() time.Time {
+	return s.ba.startTime
+}
+
+// LastUpdated returns the time at which the latest request was added to the
+// batch.
+func (s BatchState) LastUpdated() time.Time {
+	return s.ba.lastUpdated
+}
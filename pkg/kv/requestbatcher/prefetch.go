@@ -0,0 +1,68 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+)
+
+// prefetchQueueSize is the number of keys which may be waiting to be
+// prefetched. Keys beyond this limit are dropped as prefetching is only an
+// optimization.
+const prefetchQueueSize = 128
+
+// prefetcher looks up the range descriptors for the keys of newly queued
+// batches in the background so that the lookups are not on the critical path
+// when the batches are sent.
+type prefetcher struct {
+	lookup func(ctx context.Context, key roachpb.RKey) error
+	keys   chan roachpb.RKey
+}
+
+func newPrefetcher(cfg *Config) *prefetcher {
+	return &prefetcher{
+		lookup: cfg.PrefetchRangeDescriptor,
+		keys:   make(chan roachpb.RKey, prefetchQueueSize),
+	}
+}
+
+// maybePrefetch queues the key of req to be looked up unless the queue is
+// full.
+func (p *prefetcher) maybePrefetch(req roachpb.Request) {
+	key, err := keys.Addr(req.Header().Key)
+	if err != nil {
+		return
+	}
+	select {
+	case p.keys <- key:
+	default:
+	}
+}
+
+func (p *prefetcher) run(ctx context.Context) {
+	for {
+		select {
+		case key := <-p.keys:
+			// Errors are ignored; the lookup will be retried when the batch is
+			// sent.
+			_ = p.lookup(ctx, key)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// maybeReroute is called when ba fails with pErr. If pErr is a
+// RangeKeyMismatchError and Config.MaxRangeMismatchRetries is set, each of the
+// requests is queued again to the range which the descriptors returned with
+// the error indicate now contains it, which splits the batch across the
+// ranges into which its range was split, and true is returned. Requests which
+// cannot be rerouted or have been retried too often fail with pErr. If false
+// is returned the caller is responsible for responding to the requests.
+func (b *RequestBatcher) maybeReroute(ctx context.Context, ba *batch, pErr *roachpb.Error) bool {
+	if b.cfg.MaxRangeMismatchRetries <= 0 {
+		return false
+	}
+	rkme, ok := pErr.GetDetail().(*roachpb.RangeKeyMismatchError)
+	// Requests batched by their target rather than their range cannot be
+	// rerouted.
+	fromRangeID := ba.rangeID()
+	if !ok || fromRangeID == 0 {
+		return false
+	}
+	err := pErr.GoError()
+	for _, r := range ba.reqs {
+		rangeID, ok := rerouteRangeID(rkme, r.req)
+		if !ok || r.retries >= b.cfg.MaxRangeMismatchRetries {
+			b.stats.recordFailed(1)
+			b.sendResponse(r, response{err: err})
+			continue
+		}
+		log.Eventf(r.ctx, "rerouting %s request from r%d to r%d after range key mismatch",
+			log.Safe(r.req.Method()), fromRangeID, rangeID)
+		r.rangeID = rangeID
+		b.retry(ctx, r, err)
+	}
+	return true
+}
+
+// rerouteRangeID returns the ID of the range which contains the keys of req
+// according to the descriptors carried by rkme, if either does.
+func rerouteRangeID(rkme *roachpb.RangeKeyMismatchError, req roachpb.Request) (roachpb.RangeID, bool) {
+	h := req.Header()
+	start, err := keys.Addr(h.Key)
+	if err != nil {
+		return 0, false
+	}
+	end := start.Next()
+	if len(h.EndKey) > 0 {
+		if end, err = keys.AddrUpperBound(h.EndKey); err != nil {
+			return 0, false
+		}
+	}
+	for _, desc := range []*roachpb.RangeDescriptor{rkme.MismatchedRange, rkme.SuggestedRange} {
+		if desc != nil && desc.ContainsKeyRange(start, end) {
+			return desc.RangeID, true
+		}
+	}
+	return 0, false
+}
+
+// maybeRedispatch is called when ba fails with pErr. If pErr is a
+// NotLeaseHolderError and every request in ba has been retried fewer than
+// Config.MaxNotLeaseHolderRetries times, the requests are queued again after a
+// backoff according to Config.RedispatchBackoff, which gives a lease transfer
+// time to complete, and true is returned. The lease hint carried by the error
+// has already been passed to Config.UpdateLeaseHolder. If false is returned
+// the caller is responsible for responding to the requests.
+func (b *RequestBatcher) maybeRedispatch(ctx context.Context, ba *batch, pErr *roachpb.Error) bool {
+	if b.cfg.MaxNotLeaseHolderRetries <= 0 {
+		return false
+	}
+	if _, ok := pErr.GetDetail().(*roachpb.NotLeaseHolderError); !ok {
+		return false
+	}
+	for _, r := range ba.reqs {
+		if r.retries >= b.cfg.MaxNotLeaseHolderRetries {
+			return false
+		}
+	}
+	b.stats.recordRedispatched()
+	log.Eventf(ctx, "re-dispatching batch of %d requests to r%d after %s",
+		len(ba.reqs), ba.rangeID(), redactPErr(pErr))
+	b.requeue(ctx, ba, pErr.GoError())
+	return true
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// maybeResume is called with the response to r from a batch. If the response
+// carries a ResumeSpan and r has resumes remaining, the response is retained
+// and the remainder of r's span is queued to be sent in a later batch, and
+// true is returned. Otherwise res is updated to combine the responses retained
+// from earlier batches, if any, and false is returned, at which point the
+// caller is responsible for responding to r.
+func (b *RequestBatcher) maybeResume(ctx context.Context, r *request, res *response) bool {
+	if r.done.stream != nil {
+		return b.maybeStream(ctx, r, res)
+	}
+	if b.cfg.MaxResumesPerRequest <= 0 || res.err != nil || res.resp == nil {
+		return false
+	}
+	if r.partial != nil {
+		if err := combineResponses(r.partial, res.resp); err != nil {
+			res.resp, res.err = nil, err
+			return false
+		}
+		res.resp = r.partial
+	}
+	resumeSpan := res.resp.Header().ResumeSpan
+	if resumeSpan == nil || r.resumes >= b.cfg.MaxResumesPerRequest {
+		return false
+	}
+	r.partial = res.resp
+	b.resume(ctx, r, resumeSpan)
+	return true
+}
+
+// maybeStream is the counterpart of maybeResume for requests sent with
+// SendStream. If the response carries a ResumeSpan it is delivered on the
+// request's stream and the remainder of r's span is queued, regardless of
+// Config.MaxResumesPerRequest, and true is returned. Otherwise false is
+// returned and the caller delivers the final response.
+func (b *RequestBatcher) maybeStream(ctx context.Context, r *request, res *response) bool {
+	if res.err != nil || res.resp == nil {
+		return false
+	}
+	resumeSpan := res.resp.Header().ResumeSpan
+	if resumeSpan == nil {
+		return false
+	}
+	select {
+	case r.done.stream <- Result{Response: res.resp}:
+	case <-r.ctx.Done():
+		b.stats.recordFailed(1)
+		b.sendResponse(r, response{err: r.ctx.Err()})
+		return true
+	}
+	b.resume(ctx, r, resumeSpan)
+	return true
+}
+
+// resume queues the remainder of r's span, starting at resumeSpan, to be sent
+// in a later batch.
+func (b *RequestBatcher) resume(ctx context.Context, r *request, resumeSpan *roachpb.Span) {
+	r.resumes, r.failures = r.resumes+1, 0
+	req := r.req.ShallowCopy()
+	h := req.Header()
+	h.SetSpan(*resumeSpan)
+	req.SetHeader(h)
+	// The copy is owned by the batcher so it need not be fingerprinted even if
+	// the original was sent with SendOptions.NoCopy.
+	releaseCaller(r)
+	r.req, r.size, r.fingerprint = req, req.Size(), nil
+	r.union = roachpb.RequestUnion{}
+	if r.caller != nil {
+		r.caller.budget.acquire(r)
+	}
+	log.Eventf(r.ctx, "resuming %s request (resume %d)", log.Safe(req.Method()), r.resumes)
+	if err := b.resubmit(r); err != nil {
+		b.stats.recordFailed(1)
+		b.sendResponse(r, response{err: err})
+	}
+}
+
+// combineResponses merges right, the response to the resumption of a ranged
+// request, into left, the response to its earlier portion. Responses which
+// are not combinable retain only the resume span of right.
+func combineResponses(left, right roachpb.Response) error {
+	h := left.Header()
+	h.ResumeSpan, h.ResumeReason = nil, 0
+	left.SetHeader(h)
+	var lbr, rbr roachpb.BatchResponse
+	lbr.Add(left)
+	rbr.Add(right)
+	if err := lbr.Combine(&rbr, []int{0}); err != nil {
+		return err
+	}
+	h, rh := left.Header(), right.Header()
+	h.ResumeSpan, h.ResumeReason = rh.ResumeSpan, rh.ResumeReason
+	left.SetHeader(h)
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// defaultRetryMaxRetries is the default of Config.RetryOptions.MaxRetries.
+const defaultRetryMaxRetries = 10
+
+// The defaults of Config.RedispatchBackoff.
+const (
+	defaultRedispatchInitialBackoff      = 10 * time.Millisecond
+	defaultRedispatchMaxBackoff          = time.Second
+	defaultRedispatchMultiplier          = 2
+	defaultRedispatchRandomizationFactor = 0.15
+)
+
+// sendWithRetries sends br, assembled from ba, like sendHedged. A batch which
+// fails with a retryable error is sent again with backoff according to
+// Config.RetryOptions until it succeeds, fails with an error which is not
+// retryable, the retries are exhausted or the contexts of all of its requests
+// are done, in which case its last error is returned. The batch holds its
+// in-flight slot while it backs off. Each attempt counts toward the retry
+// budget of the batch's requests. If the budget is exceeded, the last error is
+// returned along with true, and the requests must fail with an error whose
+// cause is ErrRetryBudgetExceeded.
+func (b *RequestBatcher) sendWithRetries(
+	ctx context.Context, ba *batch, br roachpb.BatchRequest,
+) (_ *roachpb.BatchResponse, _ *roachpb.Error, waitHedge func(), budgetExceeded bool) {
+	b.stats.recordSent(len(br.Requests))
+	resp, pErr, waitHedge := b.sendHedged(ctx, br)
+	if pErr == nil || !b.isRetryable(pErr) {
+		return resp, pErr, waitHedge, false
+	}
+	opts := b.cfg.RetryOptions
+	opts.Closer = b.cfg.Stopper.ShouldQuiesce()
+	retrier := retry.StartWithCtx(ctx, opts)
+	// The first call to Next returns immediately and accounts for the attempt
+	// which has already been made.
+	retrier.Next()
+	// The batch's budget is that of the request which has been retried most.
+	retries := ba.maxRetries()
+	for ; pErr != nil && b.isRetryable(pErr); retries++ {
+		if b.retryBudgetExceeded(retries, ba.startTime) {
+			return resp, pErr, waitHedge, true
+		}
+		if ba.allDone() || !retrier.Next() || ba.allDone() {
+			break
+		}
+		// The hedged send of the previous attempt must complete before the
+		// batch is sent again.
+		waitHedge()
+		b.stats.recordRetried()
+		log.Eventf(ctx, "retrying batch of %d requests after %s", len(br.Requests), redactPErr(pErr))
+		b.stats.recordSent(len(br.Requests))
+		resp, pErr, waitHedge = b.sendHedged(ctx, br)
+	}
+	return resp, pErr, waitHedge, false
+}
+
+// isRetryable returns true if a batch which failed with pErr should be sent
+// again, either because Config.ClassifyError returns DispositionRetry or
+// because Config.RetryTransientErrors is set and the error is retryable.
+func (b *RequestBatcher) isRetryable(pErr *roachpb.Error) bool {
+	if d := b.classifyError(pErr); d != DispositionDefault {
+		return d == DispositionRetry
+	}
+	if !b.cfg.RetryTransientErrors {
+		return false
+	}
+	if b.cfg.IsRetryableError != nil {
+		return b.cfg.IsRetryableError(pErr)
+	}
+	switch pErr.GetDetail().(type) {
+	case *roachpb.SendError, *roachpb.NodeUnavailableError, *roachpb.RangeNotFoundError:
+		return true
+	default:
+		return false
+	}
+}
+
+// allDone returns true if the contexts of all of the requests in ba are done,
+// in which case no caller is waiting for the batch's responses. Requests sent
+// with an IdempotencyKey may have followers waiting on them and so are never
+// considered done.
+func (ba *batch) allDone() bool {
+	for _, r := range ba.reqs {
+		if r.dedupKey != (dedupKey{}) || r.ctx.Err() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// maxRetries returns the number of times the request in ba which has been
+// retried most has been retried.
+func (ba *batch) maxRetries() int {
+	var retries int
+	for _, r := range ba.reqs {
+		if r.retries > retries {
+			retries = r.retries
+		}
+	}
+	return retries
+}
+
+// redispatchBackoff returns the amount of time to wait before the requests of
+// a failed batch whose requests have been retried up to retries times are
+// queued again, according to Config.RedispatchBackoff.
+func (b *RequestBatcher) redispatchBackoff(retries int) time.Duration {
+	opts := &b.cfg.RedispatchBackoff
+	backoff := float64(opts.InitialBackoff) * math.Pow(opts.Multiplier, float64(retries))
+	if maxBackoff := float64(opts.MaxBackoff); backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	delta := opts.RandomizationFactor * backoff
+	return time.Duration(backoff - delta + rand.Float64()*2*delta)
+}
+
+// waitRedispatch waits for the backoff before the requests of ba, which
+// failed, are queued again. The batch keeps its place in the in-flight limits
+// while it waits. If the batcher is stopping the wait ends early and the
+// requests fail when they are queued.
+func (b *RequestBatcher) waitRedispatch(ctx context.Context, ba *batch) {
+	timer := timeutil.NewTimer()
+	defer timer.Stop()
+	timer.Reset(b.redispatchBackoff(ba.maxRetries()))
+	select {
+	case <-timer.C:
+		timer.Read = true
+	case <-b.cfg.Stopper.ShouldQuiesce():
+	case <-ctx.Done():
+	}
+}
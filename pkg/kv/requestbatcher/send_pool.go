@@ -0,0 +1,251 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// defaultSendWorkerIdleTimeout is the default amount of time a send worker
+// beyond Config.MinSendWorkers will wait for a batch before exiting.
+const defaultSendWorkerIdleTimeout = 10 * time.Second
+
+// sendBacklogPerWorker is the number of batches per Config.MaxSendWorkers
+// which may wait in the backlog of the send pool.
+const sendBacklogPerWorker = 4
+
+// sendPool is an elastic pool of goroutines which send batches. The pool
+// always runs at least minWorkers workers. Additional workers, up to
+// maxWorkers, are started when dispatched batches are not immediately picked
+// up by an idle worker and exit after idleTimeout without work. This allows
+// quiet periods to use few goroutines while bursts of batches are drained
+// quickly.
+//
+// Batches which cannot be handed directly to an idle worker are added to a
+// backlog which workers drain as they finish. The backlog holds at most
+// maxBacklog batches; dispatching a batch while it is full blocks until a
+// worker makes room, which holds back the run loop.
+type sendPool struct {
+	b           *RequestBatcher
+	minWorkers  int
+	maxWorkers  int
+	maxBacklog  int
+	idleTimeout time.Duration
+
+	// work is used to hand a batch directly to an idle worker.
+	work chan *batch
+	// kick has a capacity of 1 and is used to wake an idle worker when a batch
+	// is added to the backlog. Whenever the backlog is non-empty either kick
+	// holds a token or some worker is busy and will check the backlog once it
+	// finishes.
+	kick chan struct{}
+	// space has a capacity of 1 and is signaled whenever a batch is removed
+	// from the backlog to wake a dispatcher waiting for room.
+	space chan struct{}
+
+	mu struct {
+		syncutil.Mutex
+		workers int
+		backlog []*batch
+	}
+}
+
+func newSendPool(b *RequestBatcher) *sendPool {
+	return &sendPool{
+		b:           b,
+		minWorkers:  b.cfg.MinSendWorkers,
+		maxWorkers:  b.cfg.MaxSendWorkers,
+		maxBacklog:  sendBacklogPerWorker * b.cfg.MaxSendWorkers,
+		idleTimeout: b.cfg.SendWorkerIdleTimeout,
+		work:        make(chan *batch),
+		kick:        make(chan struct{}, 1),
+		space:       make(chan struct{}, 1),
+	}
+}
+
+// start starts the minimum number of workers.
+func (p *sendPool) start(ctx context.Context) {
+	for i := 0; i < p.minWorkers; i++ {
+		p.maybeSpawn(ctx, nil)
+	}
+}
+
+// dispatch hands ba to the pool to be sent. It blocks while the backlog is
+// full. If the stopper is quiescing ba fails rather than being sent.
+func (p *sendPool) dispatch(ctx context.Context, ba *batch) {
+	for {
+		select {
+		case <-p.b.cfg.Stopper.ShouldQuiesce():
+			p.fail(ba, p.b.annotateError(ErrStopped))
+			return
+		case p.work <- ba:
+			return
+		default:
+		}
+		if p.maybeSpawn(ctx, ba) {
+			return
+		}
+		p.mu.Lock()
+		if len(p.mu.backlog) < p.maxBacklog {
+			p.mu.backlog = append(p.mu.backlog, ba)
+			p.mu.Unlock()
+			p.maybeKick()
+			return
+		}
+		p.mu.Unlock()
+		select {
+		case p.work <- ba:
+			return
+		case <-p.space:
+		case <-p.b.cfg.Stopper.ShouldQuiesce():
+			p.fail(ba, p.b.annotateError(ErrStopped))
+			return
+		}
+	}
+}
+
+func (p *sendPool) maybeKick() {
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+}
+
+// maybeSpawn starts a new worker which first sends ba, if non-nil, if fewer
+// than maxWorkers are running. It returns false if no worker was started.
+func (p *sendPool) maybeSpawn(ctx context.Context, ba *batch) bool {
+	p.mu.Lock()
+	if p.mu.workers >= p.maxWorkers {
+		p.mu.Unlock()
+		return false
+	}
+	p.mu.workers++
+	p.mu.Unlock()
+	p.b.cfg.Stopper.RunWorker(ctx, func(ctx context.Context) {
+		if ba != nil {
+			p.b.send(ctx, ba)
+		}
+		p.worker(ctx)
+	})
+	return true
+}
+
+// popBacklog removes and returns the oldest batch in the backlog if there is
+// one.
+func (p *sendPool) popBacklog() *batch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.mu.backlog) == 0 {
+		return nil
+	}
+	ba := p.mu.backlog[0]
+	p.mu.backlog[0] = nil
+	p.mu.backlog = p.mu.backlog[1:]
+	select {
+	case p.space <- struct{}{}:
+	default:
+	}
+	if len(p.mu.backlog) > 0 {
+		// Wake another worker to help drain the backlog.
+		p.maybeKick()
+	}
+	return ba
+}
+
+// appendBacklogFlushed appends the flushed channel of each batch in the
+// backlog to flushed, see FlushAll.
+func (p *sendPool) appendBacklogFlushed(flushed []chan struct{}) []chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ba := range p.mu.backlog {
+		flushed = append(flushed, ba.flushedChan())
+	}
+	return flushed
+}
+
+// maybeRetire decrements the number of workers and returns true if the
+// calling worker should exit because it is not needed.
+func (p *sendPool) maybeRetire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.workers <= p.minWorkers || len(p.mu.backlog) > 0 {
+		return false
+	}
+	p.mu.workers--
+	return true
+}
+
+func (p *sendPool) numWorkers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mu.workers
+}
+
+// quiesce is called by a worker which exits because the stopper is
+// quiescing. It fails the batches in the backlog rather than sending them.
+func (p *sendPool) quiesce() {
+	p.mu.Lock()
+	p.mu.workers--
+	p.mu.Unlock()
+	err := p.b.annotateError(ErrStopped)
+	for ba := p.popBacklog(); ba != nil; ba = p.popBacklog() {
+		p.fail(ba, err)
+	}
+}
+
+// fail fails ba, which was dispatched to the pool but will not be sent, with
+// err. The batch's in-flight accounting is released as though it had been
+// sent so that InFlight and the run loops holding back batches do not wait on
+// it.
+func (p *sendPool) fail(ba *batch, err error) {
+	rangeID, numRequests, size, span := ba.rangeID(), len(ba.reqs), ba.size, ba.span
+	p.b.failBatch(ba, err)
+	p.b.sendDone(rangeID, numRequests, size, span)
+}
+
+func (p *sendPool) worker(ctx context.Context) {
+	timer := timeutil.NewTimer()
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.b.cfg.Stopper.ShouldQuiesce():
+			p.quiesce()
+			return
+		default:
+		}
+		if ba := p.popBacklog(); ba != nil {
+			p.b.send(ctx, ba)
+			continue
+		}
+		timer.Reset(p.idleTimeout)
+		select {
+		case ba := <-p.work:
+			p.b.send(ctx, ba)
+		case <-p.kick:
+		case <-timer.C:
+			timer.Read = true
+			if p.maybeRetire() {
+				return
+			}
+		case <-p.b.cfg.Stopper.ShouldQuiesce():
+			p.quiesce()
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+)
+
+// defaultMaxShadowInFlight is the default value of Config.MaxShadowInFlight.
+const defaultMaxShadowInFlight = 16
+
+// shadow sends a copy of br to Config.ShadowSender without waiting for its
+// response. Failures are recorded in the batcher's Stats and otherwise
+// ignored. The copy is dropped if Config.MaxShadowInFlight copies are already
+// in flight so that a slow ShadowSender never holds up the batcher.
+func (b *RequestBatcher) shadow(ctx context.Context, br roachpb.BatchRequest) {
+	if b.cfg.ShadowSender == nil {
+		return
+	}
+	// The copy must not share memory with br, which is reused once the
+	// primary send completes, or with the callers' requests, which they own
+	// once they receive their responses. BatchRequest cannot be cloned with
+	// protoutil.Clone so it is copied by round-tripping it through its
+	// encoding instead.
+	data, err := protoutil.Marshal(&br)
+	if err != nil {
+		log.Eventf(ctx, "failed to copy shadow batch: %s", redactError(err))
+		b.stats.recordShadowDropped()
+		return
+	}
+	shadowBR := &roachpb.BatchRequest{}
+	if err := protoutil.Unmarshal(data, shadowBR); err != nil {
+		log.Eventf(ctx, "failed to copy shadow batch: %s", redactError(err))
+		b.stats.recordShadowDropped()
+		return
+	}
+	if err := b.cfg.Stopper.RunLimitedAsyncTask(
+		ctx, b.cfg.Name+".shadow", b.shadowSem, false, /* wait */
+		func(ctx context.Context) {
+			if _, pErr := b.cfg.ShadowSender.Send(ctx, *shadowBR); pErr != nil {
+				log.Eventf(ctx, "shadow batch of %d requests failed: %s",
+					len(shadowBR.Requests), redactPErr(pErr))
+				b.stats.recordShadowFailed()
+				return
+			}
+			b.stats.recordShadowSent()
+		},
+	); err != nil {
+		if err == stop.ErrThrottled {
+			log.Eventf(ctx, "dropping shadow batch of %d requests",
+				len(shadowBR.Requests))
+		}
+		b.stats.recordShadowDropped()
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+)
+
+// Statistics about the efficiency of batching are reported through the
+// telemetry feature counters, which are included in diagnostics reporting if
+// it is enabled, so that the batchers' defaults may be tuned based on the
+// behavior of real deployments. Only counts are reported: the distribution of
+// batch sizes, the reasons for which batches are sent and the frequency with
+// which requests are rejected due to backpressure. The names of batchers and
+// the ranges and keys of their requests are never included.
+
+// batchSizeBuckets are the values returned by telemetry.Bucket10 for which
+// batch sizes are counted. Larger batches are counted in the last bucket.
+var batchSizeBuckets = []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 100, 1000, 10000, 100000}
+
+var (
+	batchSizeCounters   = make([]telemetry.Counter, len(batchSizeBuckets))
+	flushReasonCounters [numFlushReasons]telemetry.Counter
+	queueFullCounter    = telemetry.GetCounter("requestbatcher.backpressure.queue-full")
+	quotaCounter        = telemetry.GetCounter("requestbatcher.backpressure.quota-exceeded")
+)
+
+func init() {
+	for i, bucket := range batchSizeBuckets {
+		batchSizeCounters[i] = telemetry.GetCounter(fmt.Sprintf("requestbatcher.batch-size.%d", bucket))
+	}
+	for r := range flushReasonCounters {
+		flushReasonCounters[r] = telemetry.GetCounter("requestbatcher.flush." + flushReason(r).String())
+	}
+}
+
+// recordBatchTelemetry counts a batch of numRequests requests sent for reason.
+func recordBatchTelemetry(numRequests int, reason flushReason) {
+	bucket := telemetry.Bucket10(int64(numRequests))
+	i := len(batchSizeBuckets) - 1
+	for j, b := range batchSizeBuckets {
+		if b == bucket {
+			i = j
+			break
+		}
+	}
+	telemetry.Inc(batchSizeCounters[i])
+	telemetry.Inc(flushReasonCounters[reason])
+}
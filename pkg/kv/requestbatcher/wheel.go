@@ -0,0 +1,125 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package requestbatcher
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// wheelSlots is the number of buckets of a timingWheel. Deadlines which are
+// more than wheelSlots ticks away share a bucket with nearer ones and are
+// skipped over when that bucket is expired.
+const wheelSlots = 512
+
+// timingWheel is a hashed timing wheel of the deadlines of batches, used in
+// place of the heap ordering of a batchQueue when
+// Config.FlushTimerResolution is set. Time is divided into ticks of
+// resolution and a batch is scheduled in the bucket of the first tick at or
+// after its deadline. Each bucket is an intrusive doubly linked list through
+// the batches so that scheduling and unscheduling a batch is O(1). The wheel
+// is advanced by expire, which is driven by the single timer of a shard.
+type timingWheel struct {
+	resolution time.Duration
+	// cursor is the last tick which has been expired.
+	cursor int64
+	// len is the number of scheduled batches.
+	len   int
+	slots [wheelSlots]*batch
+}
+
+func newTimingWheel(resolution time.Duration, now time.Time) *timingWheel {
+	return &timingWheel{
+		resolution: resolution,
+		cursor:     now.UnixNano() / int64(resolution),
+	}
+}
+
+// schedule adds ba to the wheel if it has a deadline. ba must not already be
+// scheduled.
+func (w *timingWheel) schedule(ba *batch) {
+	if ba.deadline.IsZero() {
+		return
+	}
+	res := int64(w.resolution)
+	tick := (ba.deadline.UnixNano() + res - 1) / res
+	if tick <= w.cursor {
+		// The deadline has passed, expire the batch on the next tick.
+		tick = w.cursor + 1
+	}
+	slot := &w.slots[tick%wheelSlots]
+	ba.wheelTick = tick
+	ba.wheelPrev = nil
+	ba.wheelNext = *slot
+	if *slot != nil {
+		(*slot).wheelPrev = ba
+	}
+	*slot = ba
+	w.len++
+}
+
+// unschedule removes ba from the wheel if it is scheduled.
+func (w *timingWheel) unschedule(ba *batch) {
+	if ba.wheelTick == 0 {
+		return
+	}
+	if ba.wheelPrev != nil {
+		ba.wheelPrev.wheelNext = ba.wheelNext
+	} else {
+		w.slots[ba.wheelTick%wheelSlots] = ba.wheelNext
+	}
+	if ba.wheelNext != nil {
+		ba.wheelNext.wheelPrev = ba.wheelPrev
+	}
+	ba.wheelTick, ba.wheelPrev, ba.wheelNext = 0, nil, nil
+	w.len--
+}
+
+// nextTick returns the time at which the wheel should next be expired, or the
+// zero time if no batch is scheduled.
+func (w *timingWheel) nextTick() time.Time {
+	if w.len == 0 {
+		return time.Time{}
+	}
+	return timeutil.Unix(0, (w.cursor+1)*int64(w.resolution))
+}
+
+// expire unschedules the batches whose tick is no later than now, appending
+// them to expired. None of them has a deadline after now.
+func (w *timingWheel) expire(now time.Time, expired []*batch) []*batch {
+	nowTick := now.UnixNano() / int64(w.resolution)
+	if nowTick <= w.cursor {
+		return expired
+	}
+	// Every bucket is visited at most once no matter how far behind the
+	// cursor is.
+	n := nowTick - w.cursor
+	if n > wheelSlots {
+		n = wheelSlots
+	}
+	for tick := w.cursor + 1; tick <= w.cursor+n; tick++ {
+		for ba := w.slots[tick%wheelSlots]; ba != nil; {
+			next := ba.wheelNext
+			if ba.wheelTick <= nowTick {
+				w.unschedule(ba)
+				expired = append(expired, ba)
+			}
+			ba = next
+		}
+	}
+	w.cursor = nowTick
+	return expired
+}
@@ -21,9 +21,11 @@ import (
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
-	"github.com/cockroachdb/cockroach/pkg/internal/client/requestbatcher"
 	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/kv/requestbatcher"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/storage/storagebase"
@@ -72,6 +74,36 @@ const (
 	// defaultGCBatchWait is the default duration which the gc request batcher
 	// will wait between requests for a range before sending it.
 	defaultGCBatchWait = time.Second
+
+	// defaultGCBatchSize is the default maximum number of transaction records
+	// which the gc request batcher will garbage collect in a single batch.
+	defaultGCBatchSize = 1024
+)
+
+// The parameters of the gc request batcher. They are consulted when an
+// IntentResolver is created and whenever they change. The corresponding Config
+// fields take precedence when set.
+var (
+	gcBatchSize = settings.RegisterPositiveIntSetting(
+		"kv.intent_resolver.gc_batcher.max_batch_size",
+		"maximum number of transaction records garbage collected in a single batch",
+		defaultGCBatchSize,
+	)
+	gcBatchWait = settings.RegisterNonNegativeDurationSetting(
+		"kv.intent_resolver.gc_batcher.max_wait",
+		"maximum amount of time a transaction record waits to be garbage collected in a batch (0 disables unless max_idle is also 0)",
+		defaultGCBatchWait,
+	)
+	gcBatchIdle = settings.RegisterNonNegativeDurationSetting(
+		"kv.intent_resolver.gc_batcher.max_idle",
+		"amount of time a batch of transaction records waits for additional records before being garbage collected (0 disables)",
+		0,
+	)
+	gcBatchMaxInFlight = settings.RegisterNonNegativeIntSetting(
+		"kv.intent_resolver.gc_batcher.max_in_flight",
+		"maximum number of batches of transaction records each store garbage collects concurrently (0 disables)",
+		0,
+	)
 )
 
 // Config contains the dependencies to construct an IntentResolver.
@@ -81,6 +113,12 @@ type Config struct {
 	Stopper      *stop.Stopper
 	AmbientCtx   log.AmbientContext
 	TestingKnobs storagebase.IntentResolverTestingKnobs
+	// Settings, if non-nil, are used to configure the gc request batcher.
+	Settings *cluster.Settings
+	// ResolvedIntents, if non-nil, is consulted to avoid resolving point
+	// intents which were recently resolved, possibly by another
+	// IntentResolver sharing the cache.
+	ResolvedIntents *ResolvedIntentCache
 
 	TaskLimit      int
 	MaxGCBatchWait time.Duration
@@ -100,7 +138,8 @@ type IntentResolver struct {
 	sem          chan struct{}    // Semaphore to limit async goroutines.
 	contentionQ  *contentionQueue // manages contention on individual keys
 
-	batcher *requestbatcher.RequestBatcher
+	batcher         *requestbatcher.RequestBatcher
+	resolvedIntents *ResolvedIntentCache
 
 	mu struct {
 		syncutil.Mutex
@@ -121,37 +160,96 @@ func setConfigDefaults(c *Config) {
 	if c.TaskLimit == -1 || c.TestingKnobs.ForceSyncIntentResolution {
 		c.TaskLimit = 0
 	}
-	if c.MaxGCBatchIdle == 0 {
-		c.MaxGCBatchIdle = defaultGCBatchIdle
+}
+
+// gcBatcherLimits returns the limits for the gc request batcher.
+func gcBatcherLimits(c *Config) requestbatcher.Limits {
+	limits := requestbatcher.Limits{
+		MaxMsgsPerBatch: defaultGCBatchSize,
+		MaxWait:         defaultGCBatchWait,
+		MaxIdle:         defaultGCBatchIdle,
+	}
+	if c.Settings != nil {
+		sv := &c.Settings.SV
+		limits.MaxMsgsPerBatch = int(gcBatchSize.Get(sv))
+		limits.MaxWait = gcBatchWait.Get(sv)
+		limits.MaxIdle = gcBatchIdle.Get(sv)
+		limits.MaxInFlightBatches = int(gcBatchMaxInFlight.Get(sv))
+	}
+	if c.MaxGCBatchWait != 0 {
+		limits.MaxWait = c.MaxGCBatchWait
 	}
-	if c.MaxGCBatchWait == 0 {
-		c.MaxGCBatchWait = defaultGCBatchWait
+	if c.MaxGCBatchIdle != 0 {
+		limits.MaxIdle = c.MaxGCBatchIdle
 	}
+	if limits.MaxWait <= 0 && limits.MaxIdle <= 0 {
+		// Without either timer batches would only be sent once full, leaving
+		// transaction records ungarbage collected indefinitely.
+		limits.MaxWait = defaultGCBatchWait
+	}
+	return limits
+}
+
+// gcLimitsUpdater applies changes to the settings of the gc request batcher.
+// Callbacks registered with the settings cannot be removed, so the updater is
+// cleared once the stopper stops to keep them from reaching a stopped batcher
+// and from retaining it.
+type gcLimitsUpdater struct {
+	syncutil.Mutex
+	c       *Config
+	batcher *requestbatcher.RequestBatcher
+}
+
+func (u *gcLimitsUpdater) update() {
+	u.Lock()
+	defer u.Unlock()
+	if u.batcher != nil {
+		u.batcher.SetLimits(gcBatcherLimits(u.c))
+	}
+}
+
+func (u *gcLimitsUpdater) stop() {
+	u.Lock()
+	defer u.Unlock()
+	u.c, u.batcher = nil, nil
 }
 
 // New creates an new IntentResolver.
 func New(c Config) *IntentResolver {
 	setConfigDefaults(&c)
 	ir := &IntentResolver{
-		clock:        c.Clock,
-		db:           c.DB,
-		stopper:      c.Stopper,
-		sem:          make(chan struct{}, c.TaskLimit),
-		contentionQ:  newContentionQueue(c.Clock, c.DB),
-		every:        log.Every(time.Minute),
-		Metrics:      makeMetrics(),
-		testingKnobs: c.TestingKnobs,
+		clock:           c.Clock,
+		db:              c.DB,
+		stopper:         c.Stopper,
+		sem:             make(chan struct{}, c.TaskLimit),
+		contentionQ:     newContentionQueue(c.Clock, c.DB),
+		every:           log.Every(time.Minute),
+		Metrics:         makeMetrics(),
+		testingKnobs:    c.TestingKnobs,
+		resolvedIntents: c.ResolvedIntents,
 	}
 	ir.mu.inFlightPushes = map[uuid.UUID]int{}
 	ir.mu.inFlightTxnCleanups = map[uuid.UUID]struct{}{}
+	limits := gcBatcherLimits(&c)
 	ir.batcher = requestbatcher.New(requestbatcher.Config{
-		Name:            "intent_resolver_batcher",
-		MaxMsgsPerBatch: 1024,
-		MaxWait:         c.MaxGCBatchWait,
-		MaxIdle:         c.MaxGCBatchIdle,
-		Stopper:         c.Stopper,
-		Sender:          c.DB.NonTransactionalSender(),
+		Name:               "intent_resolver_batcher",
+		MaxMsgsPerBatch:    limits.MaxMsgsPerBatch,
+		MaxWait:            limits.MaxWait,
+		MaxIdle:            limits.MaxIdle,
+		MaxInFlightBatches: limits.MaxInFlightBatches,
+		Stopper:            c.Stopper,
+		Sender:             c.DB.NonTransactionalSender(),
 	})
+	ir.Metrics.GCBatcher = ir.batcher.Metrics()
+	if c.Settings != nil {
+		u := &gcLimitsUpdater{c: &c, batcher: ir.batcher}
+		c.Stopper.AddCloser(stop.CloserFn(u.stop))
+		sv := &c.Settings.SV
+		gcBatchSize.SetOnChange(sv, u.update)
+		gcBatchWait.SetOnChange(sv, u.update)
+		gcBatchIdle.SetOnChange(sv, u.update)
+		gcBatchMaxInFlight.SetOnChange(sv, u.update)
+	}
 
 	return ir
 }
@@ -743,6 +841,28 @@ type ResolveOptions struct {
 	MinTimestamp hlc.Timestamp
 }
 
+// recentlyResolved returns true if the point intent was recently resolved to
+// the same finalized status and so need not be resolved again.
+func (ir *IntentResolver) recentlyResolved(intent roachpb.Intent, opts ResolveOptions) bool {
+	if ir.resolvedIntents == nil || intent.Status == roachpb.PENDING || opts.Poison {
+		return false
+	}
+	return ir.resolvedIntents.contains(intent.Key, intent.Txn.ID)
+}
+
+// recordResolved adds the finalized point intents resolved by reqs to the
+// resolved intent cache.
+func (ir *IntentResolver) recordResolved(reqs []roachpb.Request) {
+	if ir.resolvedIntents == nil {
+		return
+	}
+	for _, req := range reqs {
+		if ri, ok := req.(*roachpb.ResolveIntentRequest); ok && ri.Status != roachpb.PENDING && !ri.Poison {
+			ir.resolvedIntents.add(ri.Key, ri.IntentTxn.ID)
+		}
+	}
+}
+
 // ResolveIntents synchronously resolves intents accordings to opts.
 func (ir *IntentResolver) ResolveIntents(
 	ctx context.Context, intents []roachpb.Intent, opts ResolveOptions,
@@ -762,6 +882,9 @@ func (ir *IntentResolver) ResolveIntents(
 	for i := range intents {
 		intent := intents[i] // avoids a race in `i, intent := range ...`
 		if len(intent.EndKey) == 0 {
+			if ir.recentlyResolved(intent, opts) {
+				continue
+			}
 			resolveReqs = append(resolveReqs, &roachpb.ResolveIntentRequest{
 				RequestHeader: roachpb.RequestHeaderFromSpan(intent.Span),
 				IntentTxn:     intent.Txn,
@@ -790,13 +913,14 @@ func (ir *IntentResolver) ResolveIntents(
 	// might require more time than a single timeout allows.
 	for len(resolveReqs) > 0 {
 		b := &client.Batch{}
+		batchReqs := resolveReqs
 		if len(resolveReqs) > intentResolverBatchSize {
-			b.AddRawRequest(resolveReqs[:intentResolverBatchSize]...)
+			batchReqs = resolveReqs[:intentResolverBatchSize]
 			resolveReqs = resolveReqs[intentResolverBatchSize:]
 		} else {
-			b.AddRawRequest(resolveReqs...)
 			resolveReqs = nil
 		}
+		b.AddRawRequest(batchReqs...)
 		// Everything here is best effort; so give the context a timeout
 		// to avoid waiting too long. This may be a larger timeout than
 		// the context already has, in which case we'll respect the
@@ -812,6 +936,7 @@ func (ir *IntentResolver) ResolveIntents(
 			// Bail out on the first error.
 			return err
 		}
+		ir.recordResolved(batchReqs)
 	}
 
 	// Resolve spans differently. We don't know how many intents will be
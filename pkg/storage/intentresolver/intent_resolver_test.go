@@ -25,6 +25,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/storage/batcheval/result"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
@@ -771,3 +772,102 @@ var (
 		return resp, nil
 	}
 )
+
+// TestGCBatcherSettings verifies that changes to the cluster settings which
+// configure the gc request batcher are applied to a running IntentResolver.
+func TestGCBatcherSettings(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	db := client.NewDB(log.AmbientContext{
+		Tracer: tracing.NewTracer(),
+	}, client.NonTransactionalFactoryFunc(nil), clock)
+	st := cluster.MakeTestingClusterSettings()
+	ir := New(Config{
+		Stopper:  stopper,
+		DB:       db,
+		Clock:    clock,
+		Settings: st,
+	})
+	assert.Equal(t, defaultGCBatchSize, ir.batcher.Limits().MaxMsgsPerBatch)
+	assert.Equal(t, defaultGCBatchWait, ir.batcher.Limits().MaxWait)
+	gcBatchSize.Override(&st.SV, 10)
+	gcBatchWait.Override(&st.SV, time.Millisecond)
+	gcBatchMaxInFlight.Override(&st.SV, 2)
+	limits := ir.batcher.Limits()
+	assert.Equal(t, 10, limits.MaxMsgsPerBatch)
+	assert.Equal(t, time.Millisecond, limits.MaxWait)
+	assert.Equal(t, 2, limits.MaxInFlightBatches)
+	// MaxWait may only be disabled while MaxIdle is enabled.
+	gcBatchWait.Override(&st.SV, 0)
+	assert.Equal(t, defaultGCBatchWait, ir.batcher.Limits().MaxWait)
+	gcBatchIdle.Override(&st.SV, time.Millisecond)
+	limits = ir.batcher.Limits()
+	assert.Equal(t, time.Duration(0), limits.MaxWait)
+	assert.Equal(t, time.Millisecond, limits.MaxIdle)
+}
+
+// TestGCBatcherSettingsAfterRestart verifies that changes to the settings of
+// the gc batcher are only applied to the batchers of running IntentResolvers,
+// such as when a store is restarted with the same settings.
+func TestGCBatcherSettingsAfterRestart(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	db := client.NewDB(log.AmbientContext{
+		Tracer: tracing.NewTracer(),
+	}, client.NonTransactionalFactoryFunc(nil), clock)
+	st := cluster.MakeTestingClusterSettings()
+	newIR := func(stopper *stop.Stopper) *IntentResolver {
+		return New(Config{
+			Stopper:  stopper,
+			DB:       db,
+			Clock:    clock,
+			Settings: st,
+		})
+	}
+	stopper := stop.NewStopper()
+	ir := newIR(stopper)
+	stopper.Stop(context.Background())
+	restartedStopper := stop.NewStopper()
+	defer restartedStopper.Stop(context.Background())
+	restarted := newIR(restartedStopper)
+	gcBatchSize.Override(&st.SV, 10)
+	assert.Equal(t, 10, restarted.batcher.Limits().MaxMsgsPerBatch)
+	assert.Equal(t, defaultGCBatchSize, ir.batcher.Limits().MaxMsgsPerBatch)
+}
+
+// TestResolvedIntentCache verifies that IntentResolvers sharing a
+// ResolvedIntentCache do not resolve the same finalized point intent twice.
+func TestResolvedIntentCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	cache := NewResolvedIntentCache(time.Hour, 0)
+	txn := newTransaction("test", roachpb.Key("a"), 1, clock)
+	intents := []roachpb.Intent{{
+		Span:   roachpb.Span{Key: roachpb.Key("a")},
+		Txn:    txn.TxnMeta,
+		Status: roachpb.COMMITTED,
+	}}
+
+	sendFuncs := []sendFunc{resolveIntentsSendFunc}
+	ir1 := newIntentResolverWithSendFuncs(stopper, clock, &sendFuncs)
+	ir1.resolvedIntents = cache
+	assert.Nil(t, ir1.ResolveIntents(context.Background(), intents, ResolveOptions{}))
+	assert.Len(t, sendFuncs, 0)
+
+	// The second resolver has no send funcs and would panic if it attempted to
+	// resolve the intent again.
+	var noSendFuncs []sendFunc
+	ir2 := newIntentResolverWithSendFuncs(stopper, clock, &noSendFuncs)
+	ir2.resolvedIntents = cache
+	assert.Nil(t, ir2.ResolveIntents(context.Background(), intents, ResolveOptions{}))
+
+	// Pending intents are never skipped.
+	intents[0].Status = roachpb.PENDING
+	noSendFuncs = []sendFunc{resolveIntentsSendFunc}
+	assert.Nil(t, ir2.ResolveIntents(context.Background(), intents, ResolveOptions{}))
+	assert.Len(t, noSendFuncs, 0)
+}
@@ -15,7 +15,10 @@
 
 package intentresolver
 
-import "github.com/cockroachdb/cockroach/pkg/util/metric"
+import (
+	"github.com/cockroachdb/cockroach/pkg/kv/requestbatcher"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+)
 
 var (
 	// Intent resolver metrics.
@@ -31,6 +34,11 @@ var (
 type Metrics struct {
 	// Intent resolver metrics.
 	IntentResolverAsyncThrottled *metric.Counter
+
+	// GCBatcher contains the metrics of the batcher used to garbage collect
+	// transaction records. Each store has its own IntentResolver and so these
+	// are registered with the store's registry and labeled with its store ID.
+	GCBatcher *requestbatcher.Metrics
 }
 
 func makeMetrics() Metrics {
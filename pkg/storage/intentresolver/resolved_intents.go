@@ -0,0 +1,117 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package intentresolver
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+)
+
+const (
+	// defaultResolvedIntentWindow is the default amount of time for which a
+	// resolved intent is remembered by a ResolvedIntentCache.
+	defaultResolvedIntentWindow = 5 * time.Second
+
+	// defaultResolvedIntentCacheSize is the default maximum number of intents
+	// remembered by a ResolvedIntentCache.
+	defaultResolvedIntentCacheSize = 1 << 14
+)
+
+// ResolvedIntentCache is a small set of the point intents which were recently
+// resolved to a finalized status, keyed by intent key and transaction ID. It is
+// intended to be shared by the IntentResolvers of all of the stores of a node
+// so that independent callers which discover the same abandoned intent within
+// a short window do not all issue resolutions for it.
+type ResolvedIntentCache struct {
+	window  time.Duration
+	maxSize int
+
+	mu struct {
+		syncutil.Mutex
+		// entries maps each remembered intent to the time at which it was
+		// resolved.
+		entries map[resolvedIntentKey]time.Time
+		// queue holds the remembered intents in the order in which they were
+		// resolved. An intent which is resolved again is queued again and its
+		// earlier occurrence is skipped upon eviction.
+		queue []resolvedIntentEntry
+	}
+}
+
+type resolvedIntentKey struct {
+	key   string
+	txnID uuid.UUID
+}
+
+type resolvedIntentEntry struct {
+	resolvedIntentKey
+	resolved time.Time
+}
+
+// NewResolvedIntentCache creates a ResolvedIntentCache which remembers up to
+// maxSize intents for window after they are resolved. Non-positive values are
+// replaced with defaults.
+func NewResolvedIntentCache(window time.Duration, maxSize int) *ResolvedIntentCache {
+	if window <= 0 {
+		window = defaultResolvedIntentWindow
+	}
+	if maxSize <= 0 {
+		maxSize = defaultResolvedIntentCacheSize
+	}
+	c := &ResolvedIntentCache{window: window, maxSize: maxSize}
+	c.mu.entries = map[resolvedIntentKey]time.Time{}
+	return c
+}
+
+// contains returns true if the intent at key for txnID was resolved within the
+// cache's window.
+func (c *ResolvedIntentCache) contains(key roachpb.Key, txnID uuid.UUID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resolved, ok := c.mu.entries[resolvedIntentKey{key: string(key), txnID: txnID}]
+	return ok && timeutil.Since(resolved) < c.window
+}
+
+// add records that the intent at key for txnID has been resolved.
+func (c *ResolvedIntentCache) add(key roachpb.Key, txnID uuid.UUID) {
+	now := timeutil.Now()
+	k := resolvedIntentKey{key: string(key), txnID: txnID}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.entries[k] = now
+	c.mu.queue = append(c.mu.queue, resolvedIntentEntry{resolvedIntentKey: k, resolved: now})
+	c.evictLocked(now)
+}
+
+// evictLocked forgets intents which were resolved longer than the window ago
+// or which exceed the cache's size.
+func (c *ResolvedIntentCache) evictLocked(now time.Time) {
+	for len(c.mu.queue) > 0 {
+		e := c.mu.queue[0]
+		if len(c.mu.entries) <= c.maxSize && len(c.mu.queue) <= 2*c.maxSize &&
+			now.Sub(e.resolved) < c.window {
+			break
+		}
+		if resolved, ok := c.mu.entries[e.resolvedIntentKey]; ok && resolved.Equal(e.resolved) {
+			delete(c.mu.entries, e.resolvedIntentKey)
+		}
+		c.mu.queue[0] = resolvedIntentEntry{}
+		c.mu.queue = c.mu.queue[1:]
+	}
+}
@@ -665,6 +665,10 @@ type StoreConfig struct {
 	// which is non-zero.
 	IntentResolverTaskLimit int
 
+	// ResolvedIntents, if non-nil, is a set of recently resolved intents shared
+	// by the intent resolvers of all of the node's stores.
+	ResolvedIntents *intentresolver.ResolvedIntentCache
+
 	TestingKnobs StoreTestingKnobs
 
 	ConsistencyTestingKnobs ConsistencyTestingKnobs
@@ -1263,6 +1267,9 @@ func (s *Store) Start(ctx context.Context, stopper *stop.Stopper) error {
 		TaskLimit:    s.cfg.IntentResolverTaskLimit,
 		AmbientCtx:   s.cfg.AmbientCtx,
 		TestingKnobs: s.cfg.TestingKnobs.IntentResolverKnobs,
+		Settings:     s.cfg.Settings,
+
+		ResolvedIntents: s.cfg.ResolvedIntents,
 	})
 
 	s.metrics.registry.AddMetricStruct(s.intentResolver.Metrics)
@@ -0,0 +1,128 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package batcherutils provides a harness for testing a RequestBatcher
+// against the DistSender of a TestCluster so that batching is exercised
+// across real splits, lease transfers and node failures. Nodes may be stopped
+// but not restarted, as the TestCluster cannot restart a server in place.
+package batcherutils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/kv/requestbatcher"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils/testcluster"
+)
+
+// Harness wires a RequestBatcher to the DistSender of the first server of a
+// TestCluster. The cluster uses manual replication so that the range topology
+// only changes through the harness's helpers.
+type Harness struct {
+	t       testing.TB
+	TC      *testcluster.TestCluster
+	Batcher *requestbatcher.RequestBatcher
+}
+
+// NewHarness starts a TestCluster of numNodes nodes and a RequestBatcher
+// configured with cfg. If cfg.Sender or cfg.Stopper are nil, the DistSender
+// and Stopper of the cluster's first server are used. The caller must call
+// Stop once the harness is no longer needed.
+func NewHarness(t testing.TB, numNodes int, cfg requestbatcher.Config) *Harness {
+	tc := testcluster.StartTestCluster(t, numNodes, base.TestClusterArgs{
+		ReplicationMode: base.ReplicationManual,
+	})
+	if cfg.Sender == nil {
+		cfg.Sender = tc.Server(0).DistSender()
+	}
+	if cfg.Stopper == nil {
+		cfg.Stopper = tc.Stopper()
+	}
+	return &Harness{
+		t:       t,
+		TC:      tc,
+		Batcher: requestbatcher.New(cfg),
+	}
+}
+
+// Stop stops the cluster's Stopper, which stops the cluster along with the
+// batcher unless the batcher was configured with a Stopper of its own.
+func (h *Harness) Stop() {
+	h.TC.Stopper().Stop(context.TODO())
+}
+
+// RangeID returns the ID of the range which currently contains key.
+func (h *Harness) RangeID(key roachpb.Key) roachpb.RangeID {
+	desc, err := h.TC.LookupRange(key)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return desc.RangeID
+}
+
+// Send sends req through the batcher to the range which currently contains
+// its key.
+func (h *Harness) Send(ctx context.Context, req roachpb.Request) (roachpb.Response, error) {
+	return h.Batcher.Send(ctx, h.RangeID(req.Header().Key), req)
+}
+
+// Split splits the range containing key at key and returns the descriptors of
+// the resulting ranges.
+func (h *Harness) Split(key roachpb.Key) (left, right roachpb.RangeDescriptor) {
+	left, right, err := h.TC.SplitRange(key)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return left, right
+}
+
+// Replicate adds replicas of the range which starts at startKey to each of the
+// given servers and returns the range's new descriptor.
+func (h *Harness) Replicate(startKey roachpb.Key, serverIdxs ...int) roachpb.RangeDescriptor {
+	targets := make([]roachpb.ReplicationTarget, len(serverIdxs))
+	for i, idx := range serverIdxs {
+		targets[i] = h.TC.Target(idx)
+	}
+	desc, err := h.TC.AddReplicas(startKey, targets...)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return desc
+}
+
+// TransferLease transfers the lease of the range which starts at startKey to
+// the given server, which must already hold a replica of the range.
+func (h *Harness) TransferLease(startKey roachpb.Key, serverIdx int) {
+	desc, err := h.TC.LookupRange(startKey)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if err := h.TC.TransferRangeLease(desc, h.TC.Target(serverIdx)); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// StopNode stops the given server. The TestCluster does not support
+// restarting a server in place, so a stopped node remains down for the rest
+// of the test; ranges whose leases it held become available again once their
+// leases move to other replicas. The first server, whose DistSender the
+// batcher uses by default, must not be stopped.
+func (h *Harness) StopNode(serverIdx int) {
+	if serverIdx == 0 {
+		h.t.Fatal("cannot stop the server to which the batcher sends")
+	}
+	h.TC.StopServer(serverIdx)
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package batcherutils_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/kv/requestbatcher"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/testutils/batcherutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
+)
+
+// TestHarnessSplitAndLeaseTransfer ensures that requests sent through the
+// batcher reach their keys across a split of their range and a transfer of its
+// lease, including requests queued with the ID the range had before the split.
+func TestHarnessSplitAndLeaseTransfer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+	h := batcherutils.NewHarness(t, 3, requestbatcher.Config{
+		Name:            "test",
+		MaxMsgsPerBatch: 10,
+		MaxWait:         10 * time.Millisecond,
+	})
+	defer h.Stop()
+
+	key := func(suffix string) roachpb.Key {
+		return roachpb.Key(append(keys.MakeTablePrefix(keys.MinUserDescID), suffix...))
+	}
+	keyA, keyB, keyC := key("a"), key("b"), key("c")
+	h.Split(keys.UserTableDataMin)
+	rangeID := h.RangeID(keyA)
+	assert.Equal(t, rangeID, h.RangeID(keyC))
+
+	// Send the puts concurrently so that they may share a batch.
+	var g errgroup.Group
+	for _, k := range []roachpb.Key{keyA, keyC} {
+		k := k
+		g.Go(func() error {
+			_, err := h.Send(ctx, &roachpb.PutRequest{
+				RequestHeader: roachpb.RequestHeader{Key: k},
+				Value:         roachpb.MakeValueFromString(string(k)),
+			})
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	get := func(rangeID roachpb.RangeID, k roachpb.Key) {
+		t.Helper()
+		resp, err := h.Batcher.Send(ctx, rangeID, &roachpb.GetRequest{
+			RequestHeader: roachpb.RequestHeader{Key: k},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := resp.(*roachpb.GetResponse).Value.GetBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, string(k), string(value))
+	}
+
+	// Requests batched under the ID of the range from before the split are
+	// routed by the DistSender to both of its halves.
+	_, right := h.Split(keyB)
+	assert.NotEqual(t, rangeID, right.RangeID)
+	assert.Equal(t, right.RangeID, h.RangeID(keyC))
+	get(rangeID, keyA)
+	get(rangeID, keyC)
+
+	// Requests follow the lease of the right half to another node.
+	h.Replicate(keyB, 1, 2)
+	h.TransferLease(keyB, 1)
+	get(right.RangeID, keyC)
+	get(h.RangeID(keyA), keyA)
+}